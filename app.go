@@ -2,20 +2,24 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
-	"path/filepath"
 	"time"
 )
 
 type App struct {
-	ipnet2pool map[HashableIpNet]*Pool
+	// Several pools may share a network, if restricted to different
+	// client classes
+	ipnet2pool map[HashableIpNet][]*Pool
 	interfaces map[string]struct{}
+	classes    []*ClientClass
 }
 
 func NewApp() *App {
 	return &App{
-		ipnet2pool: map[HashableIpNet]*Pool{},
+		ipnet2pool: map[HashableIpNet][]*Pool{},
 		interfaces: map[string]struct{}{},
 	}
 }
@@ -30,18 +34,57 @@ func (a *App) InitConf(conf *Conf) error {
 		return errors.New("No interfaces configured")
 	}
 
+	classNames := map[string]struct{}{}
+	for _, cc := range conf.Classes {
+		class, err := cc.ToClass()
+		if err != nil {
+			return err
+		}
+		if _, ok := classNames[class.Name]; ok {
+			return fmt.Errorf("Duplicate class name: %v", class.Name)
+		}
+		classNames[class.Name] = struct{}{}
+		a.classes = append(a.classes, class)
+	}
+
 	for _, pc := range conf.Pools {
 		pool, err := pc.ToPool()
 		if err != nil {
 			return err
 		}
 
-		pool.Persistence = NewFilePersistence(filepath.Join(conf.Leasedir, pool.Name+".json"))
+		for _, name := range append(pool.AllowClasses, pool.DenyClasses...) {
+			if _, ok := classNames[name]; !ok {
+				return fmt.Errorf("Pool %v references unknown class %v", pool.Name, name)
+			}
+		}
+		pool.Classes = a.classes
+
+		if pool.DdnsUpdater != nil {
+			pool.DdnsUpdater.Start()
+			pool.AddListener(pool.DdnsUpdater.HandleEvent)
+		}
+
+		persistence, err := NewPersistence(conf, pool.Name)
+		if err != nil {
+			return err
+		}
+		pool.Persistence = persistence
+
+		durability, err := ParseDurability(conf.Durability)
+		if err != nil {
+			return err
+		}
+		pool.Durability = durability
+		pool.PersistInterval = time.Duration(conf.PersistIntervalMs) * time.Millisecond
+		pool.PersistMaxDirty = conf.PersistMaxDirty
 
 		count, err := pool.LoadLeases()
 		if err != nil {
 			return err
 		}
+		pool.StartReaper()
+		pool.StartWriter()
 
 		if count == 1 {
 			log.Printf("Loaded pool %v with %v lease", pool.Name, count)
@@ -64,18 +107,47 @@ func (a *App) insertPool(p *Pool) error {
 		Mask: IpToFixedV4(p.Netmask),
 	}
 
-	if _, ok := a.ipnet2pool[ipnet]; ok {
-		return errors.New("Duplicate IP network between pools")
+	for _, other := range a.ipnet2pool[ipnet] {
+		if p.Overlaps(other) {
+			return fmt.Errorf("Pools %v and %v have overlapping ranges on the same network", p.Name, other.Name)
+		}
 	}
 
-	a.ipnet2pool[ipnet] = p
+	a.ipnet2pool[ipnet] = append(a.ipnet2pool[ipnet], p)
 
 	return nil
 }
 
+// Every configured pool, across all networks
+func (a *App) Pools() []*Pool {
+	pools := []*Pool{}
+	for _, networkPools := range a.ipnet2pool {
+		pools = append(pools, networkPools...)
+	}
+	return pools
+}
+
+// Stop every pool's background work, saving outstanding lease changes
+func (a *App) Shutdown() {
+	for _, pool := range a.Pools() {
+		pool.StopReaper()
+		if err := pool.StopWriter(); err != nil {
+			log.Printf("Failed persisting leases for pool %v: %v", pool.Name, err)
+		}
+		if closer, ok := pool.Persistence.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				log.Printf("Failed closing lease storage for pool %v: %v", pool.Name, err)
+			}
+		}
+		if pool.DdnsUpdater != nil {
+			pool.DdnsUpdater.Stop()
+		}
+	}
+}
+
 // For non-relayed requests: find a pool by comparing nets to local nic
 // IPs
-func (a *App) findPoolByInterface(iface *net.Interface) (*Pool, error) {
+func (a *App) findPoolsByInterface(iface *net.Interface) ([]*Pool, error) {
 	addrs, err := iface.Addrs()
 
 	if err != nil {
@@ -94,8 +166,8 @@ func (a *App) findPoolByInterface(iface *net.Interface) (*Pool, error) {
 			continue
 		}
 
-		if pool, ok := a.ipnet2pool[hipnet]; ok {
-			return pool, nil
+		if pools, ok := a.ipnet2pool[hipnet]; ok {
+			return pools, nil
 		}
 	}
 
@@ -104,14 +176,14 @@ func (a *App) findPoolByInterface(iface *net.Interface) (*Pool, error) {
 
 // For relayed requests: find a pool by comparing giaddr to configured
 // pool nets
-func (a *App) findPoolbyGiaddr(giaddr FixedV4) (*Pool, error) {
-	for _, pool := range a.ipnet2pool {
+func (a *App) findPoolsbyGiaddr(giaddr FixedV4) ([]*Pool, error) {
+	for hipnet, pools := range a.ipnet2pool {
 		ipnet := &net.IPNet{
-			IP:   pool.Network,
-			Mask: net.IPMask([]byte(pool.Netmask)),
+			IP:   hipnet.IP.NetIp(),
+			Mask: net.IPMask(hipnet.Mask.Bytes()),
 		}
 		if ipnet.Contains(giaddr.NetIp()) {
-			return pool, nil
+			return pools, nil
 		}
 	}
 
@@ -162,25 +234,28 @@ func (a *App) DispatchMessage(myBuf, myOob []byte, remote *net.UDPAddr, localSoc
 		return
 	}
 
-	var pool *Pool
+	var pools []*Pool
 
 	// Relayed request. Find pool based on giaddr
 	if !message.Header.GatewayAddr.Empty() {
-		pool, err = a.findPoolbyGiaddr(message.Header.GatewayAddr)
+		pools, err = a.findPoolsbyGiaddr(message.Header.GatewayAddr)
 		if err != nil {
 			log.Printf("Can't find pool based on IPs bound to %v", iface.Name)
 			return
 		}
 
 	} else {
-		pool, err = a.findPoolByInterface(iface)
+		pools, err = a.findPoolsByInterface(iface)
 		if err != nil {
 			log.Printf("Can't find pool based on IPs bound to %v", iface.Name)
 			return
 		}
 	}
 
-	handler := NewRequestHandler(message, pool)
+	handler := selectRequestHandler(message, pools)
+	if message.Header.GatewayAddr.Empty() {
+		handler.iface = iface
+	}
 
 	response := handler.Handle()
 
@@ -193,3 +268,19 @@ func (a *App) DispatchMessage(myBuf, myOob []byte, remote *net.UDPAddr, localSoc
 		}
 	}
 }
+
+// Pick the first pool on the network which permits the client's classes. If
+// none do, the first pool gets the request, which it will refuse
+func selectRequestHandler(message *DHCPMessage, pools []*Pool) *RequestHandler {
+	var first *RequestHandler
+	for _, pool := range pools {
+		handler := NewRequestHandler(message, pool)
+		if handler.Permitted() {
+			return handler
+		}
+		if first == nil {
+			first = handler
+		}
+	}
+	return first
+}
@@ -0,0 +1,14 @@
+//go:build darwin
+
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// arpProbe is a stub for macOS, which lacks packet sockets
+func arpProbe(ip FixedV4, iface *net.Interface, timeout time.Duration) (bool, error) {
+	return false, errors.New("ARP probing is only supported on Linux")
+}
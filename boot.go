@@ -0,0 +1,101 @@
+// Helpers for network booting clients, over both PXE (TFTP) and UEFI HTTP boot
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Vendor class identifiers (option 60) sent by network booting clients
+const (
+	VENDOR_PXE_CLIENT  = "PXEClient"
+	VENDOR_HTTP_CLIENT = "HTTPClient"
+)
+
+// Parsed boot configuration, attached to pools and reserved hosts
+type BootConfig struct {
+	// Used by PXEClient requests. Filename is relative to the TFTP
+	// server at NextServer
+	NextServer FixedV4
+	Filename   string
+
+	// Used by HTTPClient requests. Full http(s) URL to the boot image
+	HttpUrl string
+}
+
+func (bc BootConf) ToBootConfig() (*BootConfig, error) {
+	boot := &BootConfig{
+		Filename: bc.Filename,
+		HttpUrl:  bc.HttpUrl,
+	}
+
+	if bc.NextServer != "" {
+		ip := net.ParseIP(bc.NextServer)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("Invalid boot nextserver: %v", bc.NextServer)
+		}
+		boot.NextServer = IpToFixedV4(ip)
+	}
+
+	// Filename is sent in the fixed 128 byte header field, which needs to be
+	// nul terminated
+	if len(boot.Filename) >= 128 {
+		return nil, errors.New("Boot filename must be shorter than 128 bytes")
+	}
+
+	if boot.HttpUrl != "" {
+		u, err := url.Parse(boot.HttpUrl)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid boot httpurl: %v", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("Boot httpurl must be a full http(s) URL, not %v", boot.HttpUrl)
+		}
+		if len(boot.HttpUrl) > 255 {
+			return nil, errors.New("Boot httpurl must be at most 255 bytes")
+		}
+	}
+
+	return boot, nil
+}
+
+// Fill in header fields and options needed by a booting client, based on the
+// vendor class it identified itself with. Returns false if the client is not
+// trying to boot, or we have nothing to offer it.
+func (b *BootConfig) Apply(vendorClass string, header *MessageHeader, options *Options) bool {
+	if b == nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(vendorClass, VENDOR_HTTP_CLIENT):
+		if b.HttpUrl == "" {
+			return false
+		}
+		// HTTP boot clients ignore offers which don't echo their vendor class
+		options.Set(OPTION_VENDOR, []byte(VENDOR_HTTP_CLIENT))
+		options.Set(OPTION_BOOT_FILE, []byte(b.HttpUrl))
+
+		// The URL may not fit in the header. Option 67 alone suffices in that case
+		if len(b.HttpUrl) < len(header.Filename) {
+			copy(header.Filename[:], b.HttpUrl)
+		}
+		return true
+
+	case strings.HasPrefix(vendorClass, VENDOR_PXE_CLIENT):
+		if b.Filename == "" {
+			return false
+		}
+		options.Set(OPTION_VENDOR, []byte(VENDOR_PXE_CLIENT))
+		if !b.NextServer.Empty() {
+			header.ServerAddr = b.NextServer
+		}
+		copy(header.Filename[:], b.Filename)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,410 @@
+// Client classification, so that groups of clients can get different options,
+// lease times and pools based on what they send us.
+//
+// Classes match using small expressions over request fields, eg:
+//
+//	vendor startswith "Cisco" and not hostname == "lobby-phone"
+//	mac startswith "00:1c:42" or relay.circuit_id == "eth0/1"
+//	fingerprint == "1,3,6,15,31,33,43,44,46,47,119,121,249,252"
+//	vivc.3561 contains "dslforum.org"
+//
+// Comparison operators are ==, !=, =~ (regex), startswith and contains. A
+// field on its own is true if the client sent it. Expressions can be combined
+// with and, or, not and parentheses.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ClientClass struct {
+	Name      string
+	Match     ClassExpr
+	Options   []ConfiguredOption
+	LeaseTime time.Duration
+}
+
+// Return the classes that message belongs to, in configured order
+func MatchClasses(classes []*ClientClass, message *DHCPMessage) []*ClientClass {
+	if len(classes) == 0 {
+		return nil
+	}
+	fields := NewRequestFields(message)
+	result := []*ClientClass{}
+	for _, class := range classes {
+		if class.Match.Eval(fields) {
+			result = append(result, class)
+		}
+	}
+	return result
+}
+
+//
+// Request fields available to expressions
+//
+
+// Lazily decoded view of a request, for classification
+type RequestFields struct {
+	message *DHCPMessage
+	relay   map[byte][]byte
+	vivc    map[uint32]string
+}
+
+func NewRequestFields(message *DHCPMessage) *RequestFields {
+	return &RequestFields{message: message}
+}
+
+// Option 82 sub-options, exposed as relay.<name>
+var relaySubOptionNames = map[string]byte{
+	"circuit_id":    RELAY_CIRCUIT_ID,
+	"remote_id":     RELAY_REMOTE_ID,
+	"subscriber_id": RELAY_SUBSCRIBER_ID,
+}
+
+func validRequestField(name string) bool {
+	switch name {
+	case "vendor", "user_class", "fingerprint", "mac", "hostname", "client_id":
+		return true
+	}
+	if sub, ok := strings.CutPrefix(name, "relay."); ok {
+		_, ok := relaySubOptionNames[sub]
+		return ok
+	}
+	if enterprise, ok := strings.CutPrefix(name, "vivc."); ok {
+		_, err := strconv.ParseUint(enterprise, 10, 32)
+		return err == nil
+	}
+	return false
+}
+
+// Look up a field by name. The bool is false if the client did not send it
+func (f *RequestFields) Get(name string) (string, bool) {
+	options := f.message.Options
+
+	optionString := func(code byte) (string, bool) {
+		if option, ok := options.Get(code); ok {
+			return string(option.Data), true
+		}
+		return "", false
+	}
+
+	switch name {
+	case "vendor":
+		return optionString(OPTION_VENDOR)
+	case "hostname":
+		return optionString(OPTION_HOST_NAME)
+	case "mac":
+		m := f.message.Header.Mac
+		return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", m[0], m[1], m[2], m[3], m[4], m[5]), true
+	case "client_id":
+		if option, ok := options.Get(OPTION_CLIENT_ID); ok {
+			return fmt.Sprintf("%x", option.Data), true
+		}
+		return "", false
+	case "fingerprint":
+		option, ok := options.Get(OPTION_PARAM_REQ)
+		if !ok {
+			return "", false
+		}
+		codes := make([]string, len(option.Data))
+		for i, code := range option.Data {
+			codes[i] = strconv.Itoa(int(code))
+		}
+		return strings.Join(codes, ","), true
+	case "user_class":
+		option, ok := options.Get(OPTION_USER_CLASS)
+		if !ok {
+			return "", false
+		}
+		return decodeUserClass(option.Data), true
+	}
+
+	if sub, ok := strings.CutPrefix(name, "relay."); ok {
+		if f.relay == nil {
+			f.relay = map[byte][]byte{}
+			if option, ok := options.Get(OPTION_RELAY_INFO); ok {
+				if subOptions, err := ParseSubOptions(option.Data); err == nil {
+					f.relay = subOptions
+				}
+			}
+		}
+		if data, ok := f.relay[relaySubOptionNames[sub]]; ok {
+			return string(data), true
+		}
+	}
+
+	// Option 124 vendor classes, by enterprise number
+	if enterprise, ok := strings.CutPrefix(name, "vivc."); ok {
+		if f.vivc == nil {
+			f.vivc = map[uint32]string{}
+			if option, ok := options.Get(OPTION_VIVC); ok {
+				if classes, err := ParseVendorIdentifyingClasses(option.Data); err == nil {
+					f.vivc = classes
+				}
+			}
+		}
+		number, _ := strconv.ParseUint(enterprise, 10, 32)
+		if class, ok := f.vivc[uint32(number)]; ok {
+			return class, true
+		}
+	}
+
+	return "", false
+}
+
+// RFC 3004 user classes are length prefixed, though plenty of clients
+// (eg dhclient) just send a bare string. Multiple classes are comma joined.
+func decodeUserClass(data []byte) string {
+	classes := []string{}
+	for i := 0; i < len(data); {
+		length := int(data[i])
+		if length == 0 || i+1+length > len(data) {
+			return string(data)
+		}
+		classes = append(classes, string(data[i+1:i+1+length]))
+		i += 1 + length
+	}
+	return strings.Join(classes, ",")
+}
+
+//
+// Expressions
+//
+
+type ClassExpr interface {
+	Eval(fields *RequestFields) bool
+}
+
+type andExpr struct{ left, right ClassExpr }
+type orExpr struct{ left, right ClassExpr }
+type notExpr struct{ expr ClassExpr }
+type existsExpr struct{ field string }
+
+type compareExpr struct {
+	field string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func (e andExpr) Eval(f *RequestFields) bool { return e.left.Eval(f) && e.right.Eval(f) }
+func (e orExpr) Eval(f *RequestFields) bool  { return e.left.Eval(f) || e.right.Eval(f) }
+func (e notExpr) Eval(f *RequestFields) bool { return !e.expr.Eval(f) }
+
+func (e existsExpr) Eval(f *RequestFields) bool {
+	_, ok := f.Get(e.field)
+	return ok
+}
+
+func (e compareExpr) Eval(f *RequestFields) bool {
+	value, _ := f.Get(e.field)
+	switch e.op {
+	case "==":
+		return value == e.value
+	case "!=":
+		return value != e.value
+	case "=~":
+		return e.re.MatchString(value)
+	case "startswith":
+		return strings.HasPrefix(value, e.value)
+	case "contains":
+		return strings.Contains(value, e.value)
+	}
+	return false
+}
+
+// Parse a class match expression
+func ParseClassExpr(input string) (ClassExpr, error) {
+	tokens, err := tokenizeClassExpr(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("Empty expression")
+	}
+
+	p := &classExprParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("Unexpected '%v'", p.tokens[p.pos].text)
+	}
+	return expr, nil
+}
+
+type classToken struct {
+	text   string
+	quoted bool
+}
+
+func tokenizeClassExpr(input string) ([]classToken, error) {
+	tokens := []classToken{}
+
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, classToken{text: string(c)})
+			i++
+		case c == '"' || c == '\'':
+			// Find the closing quote, skipping escaped ones
+			end := i + 1
+			for end < len(input) && input[end] != c {
+				if input[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(input) {
+				return nil, errors.New("Unterminated string")
+			}
+			raw := input[i : end+1]
+			if c == '\'' {
+				raw = `"` + strings.ReplaceAll(raw[1:len(raw)-1], `"`, `\"`) + `"`
+			}
+			text, err := strconv.Unquote(raw)
+			if err != nil {
+				return nil, fmt.Errorf("Bad string %v: %v", input[i:end+1], err)
+			}
+			tokens = append(tokens, classToken{text: text, quoted: true})
+			i = end + 1
+		case strings.HasPrefix(input[i:], "=="), strings.HasPrefix(input[i:], "!="), strings.HasPrefix(input[i:], "=~"):
+			tokens = append(tokens, classToken{text: input[i : i+2]})
+			i += 2
+		default:
+			end := i
+			for end < len(input) && strings.IndexByte(" \t\n()\"'=!", input[end]) == -1 {
+				end++
+			}
+			if end == i {
+				return nil, fmt.Errorf("Unexpected '%c'", c)
+			}
+			tokens = append(tokens, classToken{text: input[i:end]})
+			i = end
+		}
+	}
+
+	return tokens, nil
+}
+
+type classExprParser struct {
+	tokens []classToken
+	pos    int
+}
+
+func (p *classExprParser) peek() (classToken, bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+	return classToken{}, false
+}
+
+// True and consumed if the next token is the unquoted keyword
+func (p *classExprParser) accept(keyword string) bool {
+	if token, ok := p.peek(); ok && !token.quoted && token.text == keyword {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *classExprParser) parseOr() (ClassExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *classExprParser) parseAnd() (ClassExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *classExprParser) parseUnary() (ClassExpr, error) {
+	if p.accept("not") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{expr}, nil
+	}
+
+	if p.accept("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, errors.New("Missing ')'")
+		}
+		return expr, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *classExprParser) parseComparison() (ClassExpr, error) {
+	token, ok := p.peek()
+	if !ok {
+		return nil, errors.New("Unexpected end of expression")
+	}
+	if token.quoted || !validRequestField(token.text) {
+		return nil, fmt.Errorf("Unknown field '%v'", token.text)
+	}
+	p.pos++
+	field := token.text
+
+	op, ok := p.peek()
+	if !ok || op.quoted {
+		return existsExpr{field}, nil
+	}
+	switch op.text {
+	case "==", "!=", "=~", "startswith", "contains":
+	default:
+		return existsExpr{field}, nil
+	}
+	p.pos++
+
+	value, ok := p.peek()
+	if !ok || !value.quoted {
+		return nil, fmt.Errorf("Expected a quoted string after %v %v", field, op.text)
+	}
+	p.pos++
+
+	expr := compareExpr{field: field, op: op.text, value: value.text}
+	if op.text == "=~" {
+		re, err := regexp.Compile(value.text)
+		if err != nil {
+			return nil, err
+		}
+		expr.re = re
+	}
+	return expr, nil
+}
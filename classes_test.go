@@ -0,0 +1,149 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"net"
+	"testing"
+	"time"
+)
+
+func newClassTestMessage(mac MacAddress, options map[byte][]byte) *DHCPMessage {
+	message := NewDhcpMessage()
+	message.Header.Op = BOOT_REQUEST
+	message.Header.Mac = mac
+	message.Options.Set(OPTION_MESSAGE_TYPE, []byte{DHCPDISCOVER})
+	for code, data := range options {
+		message.Options.Set(code, data)
+	}
+	return message
+}
+
+func TestClassExpressions(t *testing.T) {
+	message := newClassTestMessage(MacAddress{0, 0x1c, 0x42, 0xb4, 0x6e, 0x1d}, map[byte][]byte{
+		OPTION_VENDOR:     []byte("Cisco Systems, Inc. IP Phone CP-7941G"),
+		OPTION_HOST_NAME:  []byte("lobby-phone"),
+		OPTION_PARAM_REQ:  {1, 3, 6, 15},
+		OPTION_USER_CLASS: {4, 'i', 'P', 'X', 'E', 3, 'f', 'o', 'o'},
+		OPTION_RELAY_INFO: {RELAY_CIRCUIT_ID, 6, 'e', 't', 'h', '0', '/', '1', RELAY_REMOTE_ID, 2, 0xde, 0xad},
+	})
+	fields := NewRequestFields(message)
+
+	cases := map[string]bool{
+		`vendor startswith "Cisco"`:                          true,
+		`vendor startswith "Aruba"`:                          false,
+		`vendor contains 'IP Phone'`:                         true,
+		`vendor =~ "CP-79[0-9]+G$"`:                          true,
+		`hostname == "lobby-phone"`:                          true,
+		`hostname != "lobby-phone"`:                          false,
+		`mac startswith "00:1c:42"`:                          true,
+		`fingerprint == "1,3,6,15"`:                          true,
+		`user_class == "iPXE,foo"`:                           true,
+		`relay.circuit_id == "eth0/1"`:                       true,
+		`relay.remote_id == "\xde\xad"`:                      true,
+		`relay.subscriber_id`:                                false,
+		`client_id`:                                          false,
+		`vendor`:                                             true,
+		`not vendor startswith "Cisco"`:                      false,
+		`vendor startswith "Aruba" or hostname contains "-"`: true,
+		`vendor startswith "Cisco" and not (hostname == "lobby-phone" or client_id)`: false,
+		`(vendor startswith "Aruba" or mac startswith "00:1c") and fingerprint`:      true,
+	}
+
+	for input, expected := range cases {
+		expr, err := ParseClassExpr(input)
+		require.Nil(t, err, input)
+		require.Equal(t, expected, expr.Eval(fields), input)
+	}
+
+	// Bare strings are used as-is by clients such as dhclient
+	require.Equal(t, "laptops", decodeUserClass([]byte("laptops")))
+
+	invalid := []string{
+		``,
+		`vendor ==`,
+		`vendor == unquoted`,
+		`nonsense == "x"`,
+		`relay.nonsense == "x"`,
+		`(vendor == "x"`,
+		`vendor == "x")`,
+		`vendor == "unterminated`,
+		`vendor =~ "("`,
+		`vendor == "x" and`,
+	}
+
+	for _, input := range invalid {
+		_, err := ParseClassExpr(input)
+		require.NotNil(t, err, input)
+	}
+}
+
+func TestClassPoolsAndOptions(t *testing.T) {
+	phones, err := ClassConf{
+		Name:      "phones",
+		Match:     `vendor startswith "Cisco"`,
+		LeaseTime: 600,
+		Options: []OptionConf{
+			{Name: "tftp_server", Type: "string", Value: "10.0.0.5"},
+			{Name: "dns_server", Type: "ips", Value: []interface{}{"10.0.0.53"}},
+		},
+	}.ToClass()
+	require.Nil(t, err)
+
+	cameras, err := ClassConf{
+		Name:  "cameras",
+		Match: `mac startswith "00:40:8c"`,
+	}.ToClass()
+	require.Nil(t, err)
+
+	classes := []*ClientClass{phones, cameras}
+
+	newPool := func(start, end string) *Pool {
+		pool := NewPool()
+		pool.Start = net.ParseIP(start)
+		pool.End = net.ParseIP(end)
+		pool.Netmask = net.ParseIP("255.255.255.0")
+		pool.LeaseTime = time.Hour
+		pool.Dns = []net.IP{net.ParseIP("1.1.1.1")}
+		pool.Classes = classes
+		return pool
+	}
+
+	// Phones get their own pool, and everything but cameras gets the other
+	phonePool := newPool("10.0.0.10", "10.0.0.19")
+	phonePool.AllowClasses = []string{"phones"}
+	generalPool := newPool("10.0.0.20", "10.0.0.29")
+	generalPool.DenyClasses = []string{"cameras"}
+	pools := []*Pool{phonePool, generalPool}
+
+	// Phone
+	message := newClassTestMessage(MacAddress{0, 0, 0, 0, 0, 1}, map[byte][]byte{
+		OPTION_VENDOR: []byte("Cisco Systems, Inc. IP Phone CP-7941G"),
+	})
+	handler := selectRequestHandler(message, pools)
+	require.Equal(t, phonePool, handler.pool)
+	response := handler.Handle()
+	require.Equal(t, IpToFixedV4(net.ParseIP("10.0.0.10")), response.Header.YourAddr)
+	require.Equal(t, long2bytes(600), response.Options.data[OPTION_LEASE_TIME].Data)
+	require.Equal(t, []FixedV4{IpToFixedV4(net.ParseIP("10.0.0.53"))}, response.Options.GetFixedV4s(OPTION_DNS_SERVER))
+	opt, ok := response.Options.Get(OPTION_TFTP_SERVER)
+	require.True(t, ok)
+	require.Equal(t, []byte("10.0.0.5"), opt.Data)
+
+	// Laptop
+	message = newClassTestMessage(MacAddress{0, 0, 0, 0, 0, 2}, nil)
+	handler = selectRequestHandler(message, pools)
+	require.Equal(t, generalPool, handler.pool)
+	response = handler.Handle()
+	require.Equal(t, IpToFixedV4(net.ParseIP("10.0.0.20")), response.Header.YourAddr)
+	require.Equal(t, long2bytes(3600), response.Options.data[OPTION_LEASE_TIME].Data)
+	require.Equal(t, []FixedV4{IpToFixedV4(net.ParseIP("1.1.1.1"))}, response.Options.GetFixedV4s(OPTION_DNS_SERVER))
+	_, ok = response.Options.Get(OPTION_TFTP_SERVER)
+	require.False(t, ok)
+
+	// Cameras aren't permitted anywhere
+	message = newClassTestMessage(MacAddress{0, 0x40, 0x8c, 0, 0, 3}, nil)
+	handler = selectRequestHandler(message, pools)
+	require.False(t, handler.Permitted())
+	require.Nil(t, handler.Handle())
+}
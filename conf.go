@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"os"
 	"strings"
@@ -23,13 +24,46 @@ type PoolConf struct {
 	Start string `yaml:"start"`
 	End   string `yaml:"end"`
 
-	Router []string `yaml:"routers"`
-	Dns    []string `yaml:"dns"`
+	Router []string    `yaml:"routers"`
+	Dns    []string    `yaml:"dns"`
+	Routes []RouteConf `yaml:"routes"`
+
+	// Domain name (option 15) and search list (option 119)
+	Domain string   `yaml:"domain"`
+	Search []string `yaml:"search"`
+
+	Ddns DdnsConf `yaml:"ddns"`
+
+	Hostnames HostnameConf `yaml:"hostnames"`
+
+	// Optional probing of addresses before offering them
+	Probe ProbeConf `yaml:"probe"`
 
 	LeaseTime uint32 `yaml:"leasetime"`
 
+	// How new addresses are picked: lowest (default), random, hash (of the
+	// client identifier or MAC) or lru
+	Allocation string `yaml:"allocation"`
+
+	// How long addresses stay held for their previous client after its
+	// lease is released or expires. Defaults to the lease time
+	AffinitySeconds uint32 `yaml:"affinity_seconds"`
+
 	// TODO: add arbitrary options aside from just router/dns
 
+	Boot *BootConf `yaml:"boot"`
+
+	// Option 43 sub-options, chosen by the client's vendor class
+	VendorOptions []VendorOptionConf `yaml:"vendor_options"`
+
+	// Option 125 sub-options by enterprise number
+	VendorIdentifyingOptions []VendorIdentifyingConf `yaml:"vivso"`
+
+	// Restrict this pool by client class name. Clients in any denied class
+	// are refused, and if any classes are allowed, clients must be in one
+	AllowClasses []string `yaml:"allow_classes"`
+	DenyClasses  []string `yaml:"deny_classes"`
+
 	ReservedHosts []HostConf `yaml:"hosts"`
 }
 
@@ -50,6 +84,8 @@ func (pc PoolConf) ToPool() (*Pool, error) {
 	pool.End = net.ParseIP(pc.End)
 	pool.MyIp = IpToFixedV4(net.ParseIP(pc.MyIp))
 	pool.LeaseTime = time.Second * time.Duration(pc.LeaseTime)
+	pool.AllowClasses = pc.AllowClasses
+	pool.DenyClasses = pc.DenyClasses
 
 	pool.Broadcast = calcBroadcast(pool.Network, pool.Netmask)
 
@@ -61,8 +97,102 @@ func (pc PoolConf) ToPool() (*Pool, error) {
 		pool.Dns = append(pool.Dns, net.ParseIP(ip))
 	}
 
-	for _, host := range pc.ReservedHosts {
-		if err := pool.AddReservedHost(host.ToHost()); err != nil {
+	if pc.Domain != "" {
+		if _, err := SplitDomainName(pc.Domain); err != nil {
+			return nil, err
+		}
+		pool.Domain = pc.Domain
+	}
+
+	updates, err := ParseDdnsUpdates(pc.Ddns.Updates)
+	if err != nil {
+		return nil, err
+	}
+	pool.DdnsUpdates = updates
+
+	if updates != DDNS_UPDATES_NONE {
+		updater, err := pc.Ddns.ToUpdater()
+		if err != nil {
+			return nil, fmt.Errorf("Pool %v: %v", pc.Name, err)
+		}
+		pool.DdnsUpdater = updater
+	}
+
+	allocator, err := ParseAllocator(pc.Allocation)
+	if err != nil {
+		return nil, err
+	}
+	pool.Allocator = allocator
+
+	pool.AffinityTime = pool.LeaseTime
+	if pc.AffinitySeconds > 0 {
+		pool.AffinityTime = time.Second * time.Duration(pc.AffinitySeconds)
+	}
+
+	detector, err := pc.Probe.ToConflictDetector()
+	if err != nil {
+		return nil, err
+	}
+	pool.ConflictDetector = detector
+	if pc.Probe.AbandonSeconds > 0 {
+		pool.AbandonTime = time.Second * time.Duration(pc.Probe.AbandonSeconds)
+	}
+
+	template, err := ParseHostnameTemplate(pc.Hostnames.Template)
+	if err != nil {
+		return nil, err
+	}
+	pool.HostnameTemplate = template
+
+	duplicates, err := ParseHostnameDuplicates(pc.Hostnames.Duplicates)
+	if err != nil {
+		return nil, err
+	}
+	pool.HostnameDuplicates = duplicates
+
+	if _, err := EncodeDomainSearch(pc.Search); err != nil {
+		return nil, err
+	}
+	pool.Search = pc.Search
+
+	for _, rc := range pc.Routes {
+		route, err := rc.ToRoute()
+		if err != nil {
+			return nil, err
+		}
+		pool.Routes = append(pool.Routes, route)
+	}
+
+	for _, vc := range pc.VendorOptions {
+		vendorOptions, err := vc.ToVendorOptions()
+		if err != nil {
+			return nil, err
+		}
+		pool.VendorOptions = append(pool.VendorOptions, vendorOptions)
+	}
+
+	for _, vc := range pc.VendorIdentifyingOptions {
+		block, err := vc.ToEnterpriseData()
+		if err != nil {
+			return nil, err
+		}
+		pool.VendorIdentifyingOptions = append(pool.VendorIdentifyingOptions, block)
+	}
+
+	if pc.Boot != nil {
+		boot, err := pc.Boot.ToBootConfig()
+		if err != nil {
+			return nil, err
+		}
+		pool.Boot = boot
+	}
+
+	for _, hc := range pc.ReservedHosts {
+		host, err := hc.ToHost()
+		if err != nil {
+			return nil, err
+		}
+		if err := pool.AddReservedHost(host); err != nil {
 			return nil, err
 		}
 	}
@@ -75,22 +205,132 @@ type HostConf struct {
 	Mac      string `yaml:"hw"`
 	Hostname string `yaml:"hostname"`
 	// TODO: add custom options scoped to host
+
+	// Overrides the pool's boot settings for this host
+	Boot *BootConf `yaml:"boot"`
 }
 
-func (hc *HostConf) ToHost() *ReservedHost {
-	return &ReservedHost{
+func (hc *HostConf) ToHost() (*ReservedHost, error) {
+	host := &ReservedHost{
 		Mac: StrToMac(hc.Mac),
 		IP:  IpToFixedV4(net.ParseIP(hc.IP)),
 	}
+
+	if hc.Hostname != "" {
+		host.Hostname = SanitizeHostname(hc.Hostname)
+		if host.Hostname != strings.ToLower(hc.Hostname) {
+			return nil, fmt.Errorf("Invalid hostname for host %v: %v", hc.Mac, hc.Hostname)
+		}
+	}
+
+	if hc.Boot != nil {
+		boot, err := hc.Boot.ToBootConfig()
+		if err != nil {
+			return nil, err
+		}
+		host.Boot = boot
+	}
+
+	return host, nil
+}
+
+// Network boot conf. Filename is handed to PXE clients, and HttpUrl to UEFI
+// HTTP boot clients
+type BootConf struct {
+	NextServer string `yaml:"nextserver"`
+	Filename   string `yaml:"filename"`
+	HttpUrl    string `yaml:"httpurl"`
+}
+
+// Dynamic DNS settings for a pool. Updates is one of none (the default),
+// client or server, and decides who performs DNS updates
+type DdnsConf struct {
+	Updates string `yaml:"updates"`
+
+	// DNS server accepting updates, and the zones to update. Either zone may
+	// be left out to skip its records
+	Server      string `yaml:"server"`
+	ForwardZone string `yaml:"forward_zone"`
+	ReverseZone string `yaml:"reverse_zone"`
+	TTL         uint32 `yaml:"ttl"`
+
+	Key *TsigConf `yaml:"key"`
+}
+
+// TSIG key for signing updates. Secret is base64, as in BIND key files
+type TsigConf struct {
+	Name      string `yaml:"name"`
+	Algorithm string `yaml:"algorithm"`
+	Secret    string `yaml:"secret"`
+}
+
+// Client class, matched against each request
+type ClassConf struct {
+	Name      string       `yaml:"name"`
+	Match     string       `yaml:"match"`
+	Options   []OptionConf `yaml:"options"`
+	LeaseTime uint32       `yaml:"leasetime"`
+}
+
+func (cc ClassConf) ToClass() (*ClientClass, error) {
+	if cc.Name == "" {
+		return nil, errors.New("Classes need a name")
+	}
+
+	match, err := ParseClassExpr(cc.Match)
+	if err != nil {
+		return nil, fmt.Errorf("Class %v has invalid match expression: %v", cc.Name, err)
+	}
+
+	options, err := ToOptions(cc.Options)
+	if err != nil {
+		return nil, fmt.Errorf("Class %v: %v", cc.Name, err)
+	}
+
+	return &ClientClass{
+		Name:      cc.Name,
+		Match:     match,
+		Options:   options,
+		LeaseTime: time.Second * time.Duration(cc.LeaseTime),
+	}, nil
+}
+
+// Optional built in read-only TFTP server, for serving boot files
+type TftpConf struct {
+	Enabled bool   `yaml:"enabled"`
+	Root    string `yaml:"root"`
+	Listen  string `yaml:"listen"`
+}
+
+// Optional built in DNS server, answering for lease hostnames and
+// forwarding other queries to upstream resolvers
+type DnsServerConf struct {
+	Enabled              bool     `yaml:"enabled"`
+	Listen               string   `yaml:"listen"`
+	Domain               string   `yaml:"domain"`
+	Upstreams            []string `yaml:"upstreams"`
+	TTL                  uint32   `yaml:"ttl"`
+	MaxConcurrentQueries int      `yaml:"max_concurrent_queries"`
 }
 
 // Root yaml conf
 type Conf struct {
-	Pools                 []PoolConf `yaml:"pools"`
-	Leasedir              string     `yaml:"leasedir"`
-	Interfaces            []string   `yaml:"interfaces"`
-	MaxConcurrentRequests int        `yaml:"max_concurrent_requests"`
-	RequestTimeoutSeconds int        `yaml:"request_timeout_seconds"`
+	Pools                 []PoolConf    `yaml:"pools"`
+	Classes               []ClassConf   `yaml:"classes"`
+	Leasedir              string        `yaml:"leasedir"`
+	Persistence           string        `yaml:"persistence"`
+	LeaseBackups          int           `yaml:"lease_backups"`
+	JournalSyncIntervalMs int           `yaml:"journal_sync_interval_ms"`
+	Database              string        `yaml:"database"`
+	ServerId              string        `yaml:"server_id"`
+	Durability            string        `yaml:"durability"`
+	PersistIntervalMs     int           `yaml:"persist_interval_ms"`
+	PersistMaxDirty       int           `yaml:"persist_max_dirty"`
+	Interfaces            []string      `yaml:"interfaces"`
+	MaxConcurrentRequests int           `yaml:"max_concurrent_requests"`
+	RequestTimeoutSeconds int           `yaml:"request_timeout_seconds"`
+	Tftp                  TftpConf      `yaml:"tftp"`
+	DnsServer             DnsServerConf `yaml:"dns_server"`
 }
 
 func ParseConf(path string) (*Conf, error) {
@@ -111,6 +351,34 @@ func ParseConf(path string) (*Conf, error) {
 	if conf.RequestTimeoutSeconds == 0 {
 		conf.RequestTimeoutSeconds = 5
 	}
+	if conf.LeaseBackups == 0 {
+		conf.LeaseBackups = defaultLeaseBackups
+	} else if conf.LeaseBackups < 0 {
+		conf.LeaseBackups = 0
+	}
+	if conf.Tftp.Listen == "" {
+		conf.Tftp.Listen = "0.0.0.0:69"
+	}
+	if conf.Tftp.Enabled && conf.Tftp.Root == "" {
+		return nil, errors.New("tftp root directory must be configured")
+	}
+	if conf.DnsServer.Listen == "" {
+		conf.DnsServer.Listen = "127.0.0.1:53"
+	}
+	if conf.DnsServer.MaxConcurrentQueries == 0 {
+		conf.DnsServer.MaxConcurrentQueries = 50
+	}
+	if conf.DnsServer.TTL == 0 {
+		conf.DnsServer.TTL = 60
+	}
+	if _, err := SplitDomainName(conf.DnsServer.Domain); err != nil {
+		return nil, err
+	}
+	for i, upstream := range conf.DnsServer.Upstreams {
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			conf.DnsServer.Upstreams[i] = net.JoinHostPort(upstream, "53")
+		}
+	}
 
 	return conf, nil
 }
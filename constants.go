@@ -48,6 +48,7 @@ const (
 	OPTION_MTU           byte = 26
 	OPTION_BROADCAST     byte = 28
 	OPTION_NTP_SERVER    byte = 42
+	OPTION_VENDOR_INFO   byte = 43
 	OPTION_WINS_SERVER   byte = 44
 	OPTION_REQUESTED_IP  byte = 50
 	OPTION_LEASE_TIME    byte = 51
@@ -61,11 +62,27 @@ const (
 	OPTION_T2            byte = 59
 	OPTION_VENDOR        byte = 60
 	OPTION_CLIENT_ID     byte = 61
+	OPTION_TFTP_SERVER   byte = 66
+	OPTION_BOOT_FILE     byte = 67
+	OPTION_USER_CLASS    byte = 77
+	OPTION_CLIENT_FQDN   byte = 81
+	OPTION_RELAY_INFO    byte = 82
+	OPTION_CLIENT_ARCH   byte = 93
 	OPTION_DNS_SEARCH    byte = 119
 	OPTION_STATIC_ROUTES byte = 121
+	OPTION_VIVC          byte = 124
+	OPTION_VIVSO         byte = 125
+	OPTION_MS_ROUTES     byte = 249
 	OPTION_SENTINEL      byte = 255
 )
 
+// Relay agent information (option 82) sub-options
+const (
+	RELAY_CIRCUIT_ID    byte = 1
+	RELAY_REMOTE_ID     byte = 2
+	RELAY_SUBSCRIBER_ID byte = 6
+)
+
 var nameToOption = map[string]byte{
 	"padding":       OPTION_PADDING,
 	"subnet":        OPTION_SUBNET,
@@ -86,6 +103,7 @@ var nameToOption = map[string]byte{
 	"mtu":           OPTION_MTU,
 	"broadcast":     OPTION_BROADCAST,
 	"ntp_server":    OPTION_NTP_SERVER,
+	"vendor_info":   OPTION_VENDOR_INFO,
 	"wins_server":   OPTION_WINS_SERVER,
 	"requested_ip":  OPTION_REQUESTED_IP,
 	"dns_search":    OPTION_DNS_SEARCH,
@@ -98,7 +116,16 @@ var nameToOption = map[string]byte{
 	"max_size":      OPTION_MAX_SIZE,
 	"vendor":        OPTION_VENDOR,
 	"client_id":     OPTION_CLIENT_ID,
+	"tftp_server":   OPTION_TFTP_SERVER,
+	"boot_file":     OPTION_BOOT_FILE,
+	"user_class":    OPTION_USER_CLASS,
+	"client_fqdn":   OPTION_CLIENT_FQDN,
+	"relay_info":    OPTION_RELAY_INFO,
+	"client_arch":   OPTION_CLIENT_ARCH,
 	"static_routes": OPTION_STATIC_ROUTES,
+	"vivc":          OPTION_VIVC,
+	"vivso":         OPTION_VIVSO,
+	"ms_routes":     OPTION_MS_ROUTES,
 	"sentinel":      OPTION_SENTINEL,
 }
 
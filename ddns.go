@@ -0,0 +1,682 @@
+// Dynamic DNS updates (RFC 2136) for leases, authenticated with TSIG
+// (RFC 8945), using DHCID records (RFC 4701) to avoid clobbering names owned
+// by other clients (RFC 4703)
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDdnsConflict = errors.New("Name is owned by another client")
+	ErrTsigInvalid  = errors.New("Invalid TSIG")
+)
+
+//
+// TSIG
+//
+
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-md5.sig-alg.reg.int": md5.New,
+	"hmac-sha1":                sha1.New,
+	"hmac-sha256":              sha256.New,
+	"hmac-sha512":              sha512.New,
+}
+
+// Allowed clock skew between us and the DNS server
+const tsigFudge = 300
+
+type TsigKey struct {
+	Name      string
+	Algorithm string
+	Secret    []byte
+}
+
+func NewTsigKey(name, algorithm, secret string) (*TsigKey, error) {
+	if name == "" {
+		return nil, errors.New("TSIG key needs a name")
+	}
+	if algorithm == "" {
+		algorithm = "hmac-sha256"
+	}
+	algorithm = strings.ToLower(strings.TrimSuffix(algorithm, "."))
+	if algorithm == "hmac-md5" {
+		algorithm = "hmac-md5.sig-alg.reg.int"
+	}
+	if _, ok := tsigAlgorithms[algorithm]; !ok {
+		return nil, fmt.Errorf("Unsupported TSIG algorithm %v", algorithm)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("TSIG secret is not valid base64: %v", err)
+	}
+	return &TsigKey{strings.TrimSuffix(name, "."), algorithm, decoded}, nil
+}
+
+// Compute the MAC over a message (without its TSIG record) and the TSIG
+// variables. Responses also cover the request's MAC
+func (k *TsigKey) mac(requestMac, msg []byte, timeSigned uint64, fudge, tsigError uint16, other []byte) ([]byte, error) {
+	h := hmac.New(tsigAlgorithms[k.Algorithm], k.Secret)
+
+	if requestMac != nil {
+		binary.Write(h, binary.BigEndian, uint16(len(requestMac)))
+		h.Write(requestMac)
+	}
+
+	h.Write(msg)
+
+	keyName, err := EncodeDnsName(k.Name, true)
+	if err != nil {
+		return nil, err
+	}
+	algName, err := EncodeDnsName(k.Algorithm, true)
+	if err != nil {
+		return nil, err
+	}
+
+	h.Write(keyName)
+	binary.Write(h, binary.BigEndian, DNS_CLASS_ANY)
+	binary.Write(h, binary.BigEndian, uint32(0))
+	h.Write(algName)
+	h.Write([]byte{byte(timeSigned >> 40), byte(timeSigned >> 32), byte(timeSigned >> 24), byte(timeSigned >> 16), byte(timeSigned >> 8), byte(timeSigned)})
+	binary.Write(h, binary.BigEndian, fudge)
+	binary.Write(h, binary.BigEndian, tsigError)
+	binary.Write(h, binary.BigEndian, uint16(len(other)))
+	h.Write(other)
+
+	return h.Sum(nil), nil
+}
+
+// Encode and sign a message, returning the wire format and its MAC. Pass
+// the request's MAC when signing a response
+func (k *TsigKey) Sign(m *DnsMessage, requestMac []byte, now time.Time) ([]byte, []byte, error) {
+	msg, err := m.Encode()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	timeSigned := uint64(now.Unix())
+	mac, err := k.mac(requestMac, msg, timeSigned, tsigFudge, 0, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	algName, _ := EncodeDnsName(k.Algorithm, false)
+	rdata := append([]byte{}, algName...)
+	rdata = append(rdata, byte(timeSigned>>40), byte(timeSigned>>32), byte(timeSigned>>24), byte(timeSigned>>16), byte(timeSigned>>8), byte(timeSigned))
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(mac)))
+	rdata = append(rdata, mac...)
+	rdata = binary.BigEndian.AppendUint16(rdata, m.ID)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0) // Error
+	rdata = binary.BigEndian.AppendUint16(rdata, 0) // Other len
+
+	// Append the TSIG record and bump ARCOUNT, leaving the signed bytes intact
+	keyName, _ := EncodeDnsName(k.Name, false)
+	signed := append(msg, keyName...)
+	signed = binary.BigEndian.AppendUint16(signed, DNS_TYPE_TSIG)
+	signed = binary.BigEndian.AppendUint16(signed, DNS_CLASS_ANY)
+	signed = binary.BigEndian.AppendUint32(signed, 0)
+	signed = binary.BigEndian.AppendUint16(signed, uint16(len(rdata)))
+	signed = append(signed, rdata...)
+	binary.BigEndian.PutUint16(signed[10:], uint16(len(m.Additional)+1))
+
+	return signed, mac, nil
+}
+
+// Verify the TSIG record ending a message, returning its MAC
+func (k *TsigKey) Verify(b []byte, requestMac []byte, now time.Time) ([]byte, error) {
+	m, err := ParseDnsMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Additional) == 0 {
+		return nil, fmt.Errorf("%w: message is unsigned", ErrTsigInvalid)
+	}
+
+	tsig := m.Additional[len(m.Additional)-1]
+	if tsig.Type != DNS_TYPE_TSIG || !strings.EqualFold(tsig.Name, k.Name) {
+		return nil, fmt.Errorf("%w: not signed with key %v", ErrTsigInvalid, k.Name)
+	}
+
+	// Parse the TSIG RDATA
+	rdata := tsig.Data
+	algName, offset, err := ReadDnsName(rdata, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(algName, k.Algorithm) {
+		return nil, fmt.Errorf("%w: algorithm mismatch", ErrTsigInvalid)
+	}
+	if offset+10 > len(rdata) {
+		return nil, ErrDnsTruncated
+	}
+	timeSigned := uint64(binary.BigEndian.Uint16(rdata[offset:]))<<32 | uint64(binary.BigEndian.Uint32(rdata[offset+2:]))
+	fudge := binary.BigEndian.Uint16(rdata[offset+6:])
+	macSize := int(binary.BigEndian.Uint16(rdata[offset+8:]))
+	offset += 10
+	if offset+macSize+6 > len(rdata) {
+		return nil, ErrDnsTruncated
+	}
+	mac := rdata[offset : offset+macSize]
+	offset += macSize
+	originalId := binary.BigEndian.Uint16(rdata[offset:])
+	tsigError := binary.BigEndian.Uint16(rdata[offset+2:])
+	otherLen := int(binary.BigEndian.Uint16(rdata[offset+4:]))
+	offset += 6
+	if offset+otherLen > len(rdata) {
+		return nil, ErrDnsTruncated
+	}
+	other := rdata[offset : offset+otherLen]
+
+	// Reconstruct the message as it was before signing: without the TSIG
+	// record, which is always last, and with the original ID
+	tsigStart := len(b) - m.tsigLength()
+	unsigned := append([]byte{}, b[:tsigStart]...)
+	binary.BigEndian.PutUint16(unsigned, originalId)
+	binary.BigEndian.PutUint16(unsigned[10:], uint16(len(m.Additional)-1))
+
+	expected, err := k.mac(requestMac, unsigned, timeSigned, fudge, tsigError, other)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(expected, mac) {
+		return nil, fmt.Errorf("%w: bad MAC", ErrTsigInvalid)
+	}
+
+	skew := int64(now.Unix()) - int64(timeSigned)
+	if skew < -int64(fudge) || skew > int64(fudge) {
+		return nil, fmt.Errorf("%w: time outside of fudge", ErrTsigInvalid)
+	}
+
+	return mac, nil
+}
+
+// Wire length of the last additional record, which callers only use when it
+// is a TSIG record. Its owner name is never compressed
+func (m *DnsMessage) tsigLength() int {
+	tsig := m.Additional[len(m.Additional)-1]
+	name, _ := EncodeDnsName(tsig.Name, false)
+	return len(name) + 10 + len(tsig.Data)
+}
+
+//
+// DHCID
+//
+
+// DHCID RDATA (RFC 4701) for a client and name, using the type 0 identifier
+// of hardware type and address, with a SHA-256 digest
+func DhcidRdata(mac MacAddress, fqdn string) ([]byte, error) {
+	name, err := EncodeDnsName(fqdn, true)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	h.Write([]byte{1}) // Ethernet
+	h.Write(mac[:])
+	h.Write(name)
+
+	return append([]byte{0, 0, 1}, h.Sum(nil)...), nil
+}
+
+//
+// Sending updates
+//
+
+// Sends UPDATE messages to a single server
+type DdnsClient struct {
+	Server  string
+	Key     *TsigKey
+	Timeout time.Duration
+}
+
+// Send an update for zone, returning the response code
+func (c *DdnsClient) Update(zone string, prereqs, updates []DnsRR) (uint16, error) {
+	idBytes := make([]byte, 2)
+	if _, err := rand.Read(idBytes); err != nil {
+		return 0, err
+	}
+
+	m := &DnsMessage{
+		ID:        binary.BigEndian.Uint16(idBytes),
+		Questions: []DnsQuestion{{Name: zone, Type: DNS_TYPE_SOA, Class: DNS_CLASS_IN}},
+		Answers:   prereqs,
+		Authority: updates,
+	}
+	m.SetOpcode(DNS_OPCODE_UPDATE)
+
+	var payload, requestMac []byte
+	var err error
+	if c.Key != nil {
+		payload, requestMac, err = c.Key.Sign(m, nil, time.Now())
+	} else {
+		payload, err = m.Encode()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	conn, err := net.Dial("udp", c.Server)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(payload); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+
+		response, err := ParseDnsMessage(buf[:n])
+		if err != nil || response.ID != m.ID || response.Flags&DNS_FLAG_QR == 0 {
+			continue
+		}
+
+		// Anyone can send an unsigned response, so with a key they're refused
+		// even if they look like errors
+		if c.Key != nil {
+			if _, err := c.Key.Verify(buf[:n], requestMac, time.Now()); err != nil {
+				return 0, fmt.Errorf("Response to update of %v (rcode %v): %w", zone, response.Rcode(), err)
+			}
+		}
+
+		return response.Rcode(), nil
+	}
+}
+
+// Keeps A, PTR and DHCID records up to date for leases in the background,
+// retrying failed updates so packet handling is never blocked on DNS
+type DdnsUpdater struct {
+	Client      *DdnsClient
+	ForwardZone string
+	ReverseZone string
+	TTL         uint32
+
+	Retries       int
+	RetryInterval time.Duration
+
+	queue chan ddnsJob
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	// The newest event queued for each address and name, so retries of
+	// older ones are dropped rather than undoing it
+	m      sync.Mutex
+	seq    uint64
+	latest map[ddnsKey]uint64
+}
+
+type ddnsKey struct {
+	ip   FixedV4
+	fqdn string
+}
+
+type ddnsJob struct {
+	event   LeaseEvent
+	fqdn    string
+	attempt int
+	seq     uint64
+}
+
+func (j ddnsJob) key() ddnsKey {
+	return ddnsKey{j.event.Lease.IP, strings.ToLower(j.fqdn)}
+}
+
+func NewDdnsUpdater(client *DdnsClient, forwardZone, reverseZone string) *DdnsUpdater {
+	return &DdnsUpdater{
+		Client:        client,
+		ForwardZone:   strings.TrimSuffix(forwardZone, "."),
+		ReverseZone:   strings.TrimSuffix(reverseZone, "."),
+		TTL:           300,
+		Retries:       5,
+		RetryInterval: time.Second * 2,
+		queue:         make(chan ddnsJob, 1024),
+		done:          make(chan struct{}),
+		latest:        map[ddnsKey]uint64{},
+	}
+}
+
+// Build the updater for a pool, or nil if it doesn't send updates
+func (dc DdnsConf) ToUpdater() (*DdnsUpdater, error) {
+	if dc.Server == "" {
+		if dc.ForwardZone != "" || dc.ReverseZone != "" {
+			return nil, errors.New("DDNS zones need a server to send updates to")
+		}
+		return nil, nil
+	}
+
+	server := dc.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	for _, zone := range []string{dc.ForwardZone, dc.ReverseZone} {
+		if _, err := SplitDomainName(zone); err != nil {
+			return nil, err
+		}
+	}
+	if dc.ForwardZone == "" && dc.ReverseZone == "" {
+		return nil, errors.New("DDNS needs a forward or reverse zone")
+	}
+
+	client := &DdnsClient{Server: server, Timeout: time.Second * 5}
+	if dc.Key != nil {
+		key, err := NewTsigKey(dc.Key.Name, dc.Key.Algorithm, dc.Key.Secret)
+		if err != nil {
+			return nil, err
+		}
+		client.Key = key
+	}
+
+	updater := NewDdnsUpdater(client, dc.ForwardZone, dc.ReverseZone)
+	if dc.TTL != 0 {
+		updater.TTL = dc.TTL
+	}
+	return updater, nil
+}
+
+func (u *DdnsUpdater) Start() {
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		for {
+			select {
+			case job := <-u.queue:
+				u.process(job)
+			case <-u.done:
+				return
+			}
+		}
+	}()
+}
+
+func (u *DdnsUpdater) Stop() {
+	close(u.done)
+	u.wg.Wait()
+}
+
+// LeaseListener which queues updates for bound, released and expired leases,
+// and removes the old names of renamed ones
+func (u *DdnsUpdater) HandleEvent(pool *Pool, event LeaseEvent) {
+	// Records under the client's FQDN don't depend on its hostname
+	if event.Type == LEASE_RENAMED && event.Lease.FQDN != "" {
+		return
+	}
+
+	fqdn := event.Lease.FQDN
+	if fqdn == "" && event.Lease.Hostname != "" {
+		domain := pool.Domain
+		if domain == "" {
+			domain = u.ForwardZone
+		}
+		fqdn = event.Lease.Hostname + "." + strings.TrimSuffix(domain, ".")
+	}
+	if fqdn == "" {
+		return
+	}
+
+	job := ddnsJob{event: event, fqdn: fqdn}
+	u.m.Lock()
+	u.seq++
+	job.seq = u.seq
+	u.latest[job.key()] = job.seq
+	u.m.Unlock()
+	u.enqueue(job)
+}
+
+// Whether a newer event for the same address and name has been queued since
+// a job
+func (u *DdnsUpdater) superseded(job ddnsJob) bool {
+	u.m.Lock()
+	defer u.m.Unlock()
+	return u.latest[job.key()] != job.seq
+}
+
+// Forget a job once it's done with, unless a newer one replaced it
+func (u *DdnsUpdater) finished(job ddnsJob) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	if u.latest[job.key()] == job.seq {
+		delete(u.latest, job.key())
+	}
+}
+
+func (u *DdnsUpdater) enqueue(job ddnsJob) {
+	select {
+	case u.queue <- job:
+	case <-u.done:
+	default:
+		log.Printf("DDNS queue full; dropping update for %v", job.fqdn)
+		u.finished(job)
+	}
+}
+
+// Apply a job, retrying it later on failure unless a newer event for the
+// same lease comes along first
+func (u *DdnsUpdater) process(job ddnsJob) {
+	if u.superseded(job) {
+		return
+	}
+
+	var err error
+	lease := job.event.Lease
+
+	switch job.event.Type {
+	case LEASE_BOUND:
+		err = u.add(lease, job.fqdn, job.event.UpdateForward)
+	default:
+		err = u.remove(lease, job.fqdn)
+	}
+
+	if err == nil {
+		u.finished(job)
+		return
+	}
+
+	if errors.Is(err, ErrDdnsConflict) || job.attempt >= u.Retries {
+		log.Printf("DDNS update for %v (%v) failed: %v", job.fqdn, lease.IP, err)
+		u.finished(job)
+		return
+	}
+
+	job.attempt++
+	backoff := u.RetryInterval * time.Duration(1<<(job.attempt-1))
+	log.Printf("DDNS update for %v (%v) failed, retrying in %v: %v", job.fqdn, lease.IP, backoff, err)
+	time.AfterFunc(backoff, func() {
+		if !u.superseded(job) {
+			u.enqueue(job)
+		}
+	})
+}
+
+func inZone(name, zone string) bool {
+	name = strings.ToLower(name)
+	zone = strings.ToLower(zone)
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+func rcodeError(rcode uint16) error {
+	return fmt.Errorf("Server responded with rcode %v", rcode)
+}
+
+func (u *DdnsUpdater) add(lease Lease, fqdn string, updateForward bool) error {
+	if updateForward && u.ForwardZone != "" {
+		if !inZone(fqdn, u.ForwardZone) {
+			log.Printf("DDNS: not updating %v as it is outside of %v", fqdn, u.ForwardZone)
+		} else if err := u.addForward(lease, fqdn); err != nil {
+			return err
+		}
+	}
+
+	if u.ReverseZone != "" {
+		if err := u.addReverse(lease, fqdn); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("DDNS: added %v for %v", fqdn, lease.IP)
+	return nil
+}
+
+func (u *DdnsUpdater) remove(lease Lease, fqdn string) error {
+	if u.ForwardZone != "" && inZone(fqdn, u.ForwardZone) {
+		if err := u.removeForward(lease, fqdn); err != nil {
+			return err
+		}
+	}
+
+	if u.ReverseZone != "" {
+		if err := u.removeReverse(lease, fqdn); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("DDNS: removed %v for %v", fqdn, lease.IP)
+	return nil
+}
+
+// Per RFC 4703 section 5.3: claim the name if nobody uses it, otherwise take
+// it over only if its DHCID shows it is ours
+func (u *DdnsUpdater) addForward(lease Lease, fqdn string) error {
+	dhcid, err := DhcidRdata(lease.Mac, fqdn)
+	if err != nil {
+		return err
+	}
+
+	a := DnsRR{Name: fqdn, Type: DNS_TYPE_A, Class: DNS_CLASS_IN, TTL: u.TTL, Data: lease.IP.Bytes()}
+
+	rcode, err := u.Client.Update(u.ForwardZone,
+		[]DnsRR{{Name: fqdn, Type: DNS_TYPE_ANY, Class: DNS_CLASS_NONE}},
+		[]DnsRR{a, {Name: fqdn, Type: DNS_TYPE_DHCID, Class: DNS_CLASS_IN, TTL: u.TTL, Data: dhcid}},
+	)
+	if err != nil {
+		return err
+	}
+	if rcode == DNS_RCODE_SUCCESS {
+		return nil
+	}
+	if rcode != DNS_RCODE_YXDOMAIN {
+		return rcodeError(rcode)
+	}
+
+	rcode, err = u.Client.Update(u.ForwardZone,
+		[]DnsRR{{Name: fqdn, Type: DNS_TYPE_DHCID, Class: DNS_CLASS_IN, Data: dhcid}},
+		[]DnsRR{{Name: fqdn, Type: DNS_TYPE_A, Class: DNS_CLASS_ANY}, a},
+	)
+	if err != nil {
+		return err
+	}
+	switch rcode {
+	case DNS_RCODE_SUCCESS:
+		return nil
+	case DNS_RCODE_NXRRSET:
+		return ErrDdnsConflict
+	}
+	return rcodeError(rcode)
+}
+
+// Per RFC 4703 section 5.5: only remove our address, and only if the name
+// is still ours
+func (u *DdnsUpdater) removeForward(lease Lease, fqdn string) error {
+	dhcid, err := DhcidRdata(lease.Mac, fqdn)
+	if err != nil {
+		return err
+	}
+
+	rcode, err := u.Client.Update(u.ForwardZone,
+		[]DnsRR{{Name: fqdn, Type: DNS_TYPE_DHCID, Class: DNS_CLASS_IN, Data: dhcid}},
+		[]DnsRR{
+			{Name: fqdn, Type: DNS_TYPE_A, Class: DNS_CLASS_NONE, Data: lease.IP.Bytes()},
+			{Name: fqdn, Type: DNS_TYPE_DHCID, Class: DNS_CLASS_ANY},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	switch rcode {
+	case DNS_RCODE_SUCCESS:
+		return nil
+	case DNS_RCODE_NXRRSET, DNS_RCODE_NXDOMAIN:
+		// Already gone, or owned by someone else now
+		return nil
+	}
+	return rcodeError(rcode)
+}
+
+func (u *DdnsUpdater) addReverse(lease Lease, fqdn string) error {
+	name := ReverseName(lease.IP)
+	if !inZone(name, u.ReverseZone) {
+		log.Printf("DDNS: not updating %v as it is outside of %v", name, u.ReverseZone)
+		return nil
+	}
+
+	target, err := EncodeDnsName(fqdn, false)
+	if err != nil {
+		return err
+	}
+
+	rcode, err := u.Client.Update(u.ReverseZone, nil, []DnsRR{
+		{Name: name, Type: DNS_TYPE_PTR, Class: DNS_CLASS_ANY},
+		{Name: name, Type: DNS_TYPE_PTR, Class: DNS_CLASS_IN, TTL: u.TTL, Data: target},
+	})
+	if err != nil {
+		return err
+	}
+	if rcode != DNS_RCODE_SUCCESS {
+		return rcodeError(rcode)
+	}
+	return nil
+}
+
+// Only remove the PTR if it still points at the lease's name, as the address
+// may have been given to another client since
+func (u *DdnsUpdater) removeReverse(lease Lease, fqdn string) error {
+	name := ReverseName(lease.IP)
+	if !inZone(name, u.ReverseZone) {
+		return nil
+	}
+
+	target, err := EncodeDnsName(fqdn, false)
+	if err != nil {
+		return err
+	}
+
+	rcode, err := u.Client.Update(u.ReverseZone,
+		[]DnsRR{{Name: name, Type: DNS_TYPE_PTR, Class: DNS_CLASS_IN, Data: target}},
+		[]DnsRR{{Name: name, Type: DNS_TYPE_PTR, Class: DNS_CLASS_NONE, Data: target}},
+	)
+	if err != nil {
+		return err
+	}
+	switch rcode {
+	case DNS_RCODE_SUCCESS:
+		return nil
+	case DNS_RCODE_NXRRSET, DNS_RCODE_NXDOMAIN:
+		// Already gone, or pointing at someone else now
+		return nil
+	}
+	return rcodeError(rcode)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"bytes"
+	"encoding/base64"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Minimal authoritative stand-in which verifies TSIG and applies UPDATE
+// prerequisites and updates (RFC 2136 sections 3.2 and 3.4) to a record map
+type testDnsServer struct {
+	key  *TsigKey
+	conn *net.UDPConn
+
+	m        sync.Mutex
+	records  map[string][]DnsRR
+	drop     int
+	unsigned bool
+}
+
+func startTestDnsServer(t *testing.T, key *TsigKey) *testDnsServer {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+
+	s := &testDnsServer{key: key, conn: conn, records: map[string][]DnsRR{}}
+	go s.serve()
+	t.Cleanup(func() { conn.Close() })
+	return s
+}
+
+func (s *testDnsServer) serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, remote, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		s.m.Lock()
+		if s.drop > 0 {
+			s.drop--
+			s.m.Unlock()
+			continue
+		}
+
+		requestMac, err := s.key.Verify(buf[:n], nil, time.Now())
+		request, _ := ParseDnsMessage(buf[:n])
+		response := &DnsMessage{ID: request.ID, Flags: DNS_FLAG_QR, Questions: request.Questions}
+		response.SetOpcode(DNS_OPCODE_UPDATE)
+		if err != nil {
+			response.SetRcode(DNS_RCODE_NOTAUTH)
+		} else {
+			response.SetRcode(s.apply(request))
+		}
+		unsigned := s.unsigned
+		s.m.Unlock()
+
+		payload, _, _ := s.key.Sign(response, requestMac, time.Now())
+		if unsigned {
+			payload, _ = response.Encode()
+		}
+		s.conn.WriteToUDP(payload, remote)
+	}
+}
+
+func (s *testDnsServer) apply(request *DnsMessage) uint16 {
+	for _, rr := range request.Answers {
+		existing := s.records[strings.ToLower(rr.Name)]
+		switch {
+		case rr.Class == DNS_CLASS_NONE && rr.Type == DNS_TYPE_ANY:
+			if len(existing) > 0 {
+				return DNS_RCODE_YXDOMAIN
+			}
+		case rr.Class == DNS_CLASS_IN:
+			found := false
+			for _, e := range existing {
+				if e.Type == rr.Type && bytes.Equal(e.Data, rr.Data) {
+					found = true
+				}
+			}
+			if !found {
+				return DNS_RCODE_NXRRSET
+			}
+		}
+	}
+
+	for _, rr := range request.Authority {
+		name := strings.ToLower(rr.Name)
+		kept := []DnsRR{}
+		for _, e := range s.records[name] {
+			switch rr.Class {
+			case DNS_CLASS_ANY:
+				if e.Type == rr.Type {
+					continue
+				}
+			case DNS_CLASS_NONE:
+				if e.Type == rr.Type && bytes.Equal(e.Data, rr.Data) {
+					continue
+				}
+			}
+			kept = append(kept, e)
+		}
+		if rr.Class == DNS_CLASS_IN {
+			kept = append(kept, DnsRR{Name: name, Type: rr.Type, Class: rr.Class, TTL: rr.TTL, Data: append([]byte{}, rr.Data...)})
+		}
+		s.records[name] = kept
+	}
+
+	return DNS_RCODE_SUCCESS
+}
+
+func (s *testDnsServer) lookup(name string, rrType uint16) [][]byte {
+	s.m.Lock()
+	defer s.m.Unlock()
+	result := [][]byte{}
+	for _, rr := range s.records[name] {
+		if rr.Type == rrType {
+			result = append(result, rr.Data)
+		}
+	}
+	return result
+}
+
+func testTsigKey(t *testing.T) *TsigKey {
+	key, err := NewTsigKey("dhcp-key.", "hmac-sha256", base64.StdEncoding.EncodeToString([]byte("0123456789abcdef")))
+	require.Nil(t, err)
+	return key
+}
+
+func TestTsig(t *testing.T) {
+	key := testTsigKey(t)
+
+	m := &DnsMessage{ID: 1234, Questions: []DnsQuestion{{"example.com", DNS_TYPE_SOA, DNS_CLASS_IN}}}
+	m.SetOpcode(DNS_OPCODE_UPDATE)
+
+	now := time.Now()
+	signed, mac, err := key.Sign(m, nil, now)
+	require.Nil(t, err)
+
+	verified, err := key.Verify(signed, nil, now)
+	require.Nil(t, err)
+	require.Equal(t, mac, verified)
+
+	// Tampering breaks the MAC
+	tampered := append([]byte{}, signed...)
+	tampered[3] ^= 0x01
+	_, err = key.Verify(tampered, nil, now)
+	require.ErrorIs(t, err, ErrTsigInvalid)
+
+	// As does a different secret
+	other, err := NewTsigKey("dhcp-key", "hmac-sha256", base64.StdEncoding.EncodeToString([]byte("fedcba9876543210")))
+	require.Nil(t, err)
+	_, err = other.Verify(signed, nil, now)
+	require.ErrorIs(t, err, ErrTsigInvalid)
+
+	// And signing too long ago
+	_, err = key.Verify(signed, nil, now.Add(time.Hour))
+	require.ErrorIs(t, err, ErrTsigInvalid)
+
+	// Responses chain the request's MAC
+	response := &DnsMessage{ID: 1234, Flags: DNS_FLAG_QR}
+	signedResponse, _, err := key.Sign(response, mac, now)
+	require.Nil(t, err)
+	_, err = key.Verify(signedResponse, mac, now)
+	require.Nil(t, err)
+	_, err = key.Verify(signedResponse, nil, now)
+	require.ErrorIs(t, err, ErrTsigInvalid)
+
+	_, err = NewTsigKey("dhcp-key", "hmac-sha3", "")
+	require.NotNil(t, err)
+}
+
+func TestDhcid(t *testing.T) {
+	mac := MacAddress{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}
+
+	a, err := DhcidRdata(mac, "Laptop.Example.com")
+	require.Nil(t, err)
+	require.Len(t, a, 35)
+	require.Equal(t, []byte{0, 0, 1}, a[:3])
+
+	// Names are compared canonically
+	b, err := DhcidRdata(mac, "laptop.example.com.")
+	require.Nil(t, err)
+	require.Equal(t, a, b)
+
+	c, err := DhcidRdata(MacAddress{0x01, 0x02, 0x03, 0x04, 0x05, 0x07}, "laptop.example.com")
+	require.Nil(t, err)
+	require.NotEqual(t, a, c)
+}
+
+func TestDdnsUpdates(t *testing.T) {
+	key := testTsigKey(t)
+	server := startTestDnsServer(t, key)
+
+	updater := NewDdnsUpdater(&DdnsClient{
+		Server:  server.conn.LocalAddr().String(),
+		Key:     key,
+		Timeout: time.Millisecond * 200,
+	}, "example.com", "0.168.192.in-addr.arpa")
+
+	mac := MacAddress{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}
+	lease := Lease{Mac: mac, FQDN: "laptop.example.com", IP: IpToFixedV4(net.ParseIP("192.168.0.10"))}
+
+	require.Nil(t, updater.add(lease, lease.FQDN, true))
+	require.Equal(t, [][]byte{{192, 168, 0, 10}}, server.lookup("laptop.example.com", DNS_TYPE_A))
+	require.Len(t, server.lookup("laptop.example.com", DNS_TYPE_DHCID), 1)
+	ptr, _ := EncodeDnsName("laptop.example.com", false)
+	require.Equal(t, [][]byte{ptr}, server.lookup("10.0.168.192.in-addr.arpa", DNS_TYPE_PTR))
+
+	// The same client may move to a new address
+	lease.IP = IpToFixedV4(net.ParseIP("192.168.0.11"))
+	require.Nil(t, updater.add(lease, lease.FQDN, true))
+	require.Equal(t, [][]byte{{192, 168, 0, 11}}, server.lookup("laptop.example.com", DNS_TYPE_A))
+
+	// Another client can't take the name over
+	other := Lease{Mac: MacAddress{0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}, IP: IpToFixedV4(net.ParseIP("192.168.0.12"))}
+	require.ErrorIs(t, updater.add(other, "laptop.example.com", true), ErrDdnsConflict)
+	require.Equal(t, [][]byte{{192, 168, 0, 11}}, server.lookup("laptop.example.com", DNS_TYPE_A))
+
+	// Nor remove it
+	require.Nil(t, updater.remove(other, "laptop.example.com"))
+	require.Equal(t, [][]byte{{192, 168, 0, 11}}, server.lookup("laptop.example.com", DNS_TYPE_A))
+
+	// Clients which update their own A record only get a PTR
+	require.Nil(t, updater.add(other, "desktop.example.com", false))
+	require.Empty(t, server.lookup("desktop.example.com", DNS_TYPE_A))
+	require.Len(t, server.lookup("12.0.168.192.in-addr.arpa", DNS_TYPE_PTR), 1)
+
+	// whose previous holder can't remove once it's pointing elsewhere
+	require.Nil(t, updater.remove(Lease{Mac: MacAddress{9, 9, 9, 9, 9, 9}, IP: other.IP}, "printer.example.com"))
+	require.Len(t, server.lookup("12.0.168.192.in-addr.arpa", DNS_TYPE_PTR), 1)
+
+	require.Nil(t, updater.remove(lease, lease.FQDN))
+	require.Empty(t, server.lookup("laptop.example.com", DNS_TYPE_A))
+	require.Empty(t, server.lookup("laptop.example.com", DNS_TYPE_DHCID))
+	require.Empty(t, server.lookup("11.0.168.192.in-addr.arpa", DNS_TYPE_PTR))
+
+	// Unsigned responses could be spoofed, so aren't taken as success
+	server.m.Lock()
+	server.unsigned = true
+	server.m.Unlock()
+	_, err := updater.Client.Update("example.com", nil, nil)
+	require.ErrorIs(t, err, ErrTsigInvalid)
+	server.m.Lock()
+	server.unsigned = false
+	server.m.Unlock()
+
+	// Unsigned updates are refused
+	updater.Client.Key = nil
+	require.NotNil(t, updater.add(lease, lease.FQDN, true))
+}
+
+func TestDdnsUpdaterRetries(t *testing.T) {
+	key := testTsigKey(t)
+	server := startTestDnsServer(t, key)
+
+	// Lose the first update
+	server.m.Lock()
+	server.drop = 1
+	server.m.Unlock()
+
+	updater := NewDdnsUpdater(&DdnsClient{
+		Server:  server.conn.LocalAddr().String(),
+		Key:     key,
+		Timeout: time.Millisecond * 100,
+	}, "example.com", "")
+	updater.RetryInterval = time.Millisecond * 10
+	updater.Start()
+	defer updater.Stop()
+
+	pool := NewPool()
+	pool.Domain = "example.com"
+	pool.AddListener(updater.HandleEvent)
+
+	lease := Lease{Mac: MacAddress{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}, Hostname: "laptop", IP: IpToFixedV4(net.ParseIP("192.168.0.10"))}
+	pool.notify(LeaseEvent{Type: LEASE_BOUND, Lease: lease, UpdateForward: true})
+
+	require.Eventually(t, func() bool {
+		return len(server.lookup("laptop.example.com", DNS_TYPE_A)) == 1
+	}, time.Second*2, time.Millisecond*10)
+
+	pool.notify(LeaseEvent{Type: LEASE_RELEASED, Lease: lease})
+
+	require.Eventually(t, func() bool {
+		return len(server.lookup("laptop.example.com", DNS_TYPE_A)) == 0
+	}, time.Second*2, time.Millisecond*10)
+}
+
+func TestDdnsUpdaterRetryOrder(t *testing.T) {
+	key := testTsigKey(t)
+	server := startTestDnsServer(t, key)
+
+	// Lose the binding's update, so its retry comes after the release
+	server.m.Lock()
+	server.drop = 1
+	server.m.Unlock()
+
+	updater := NewDdnsUpdater(&DdnsClient{
+		Server:  server.conn.LocalAddr().String(),
+		Key:     key,
+		Timeout: time.Millisecond * 100,
+	}, "example.com", "")
+	updater.RetryInterval = time.Millisecond * 50
+	updater.Start()
+	defer updater.Stop()
+
+	pool := NewPool()
+	pool.Domain = "example.com"
+	pool.AddListener(updater.HandleEvent)
+
+	lease := Lease{Mac: MacAddress{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}, Hostname: "laptop", IP: IpToFixedV4(net.ParseIP("192.168.0.10"))}
+	pool.notify(LeaseEvent{Type: LEASE_BOUND, Lease: lease, UpdateForward: true})
+	pool.notify(LeaseEvent{Type: LEASE_RELEASED, Lease: lease})
+
+	// The stale retry is dropped rather than bringing the name back
+	time.Sleep(time.Millisecond * 400)
+	require.Empty(t, server.lookup("laptop.example.com", DNS_TYPE_A))
+	updater.m.Lock()
+	require.Empty(t, updater.latest)
+	updater.m.Unlock()
+}
+
+func TestDdnsConf(t *testing.T) {
+	updater, err := DdnsConf{Updates: "server"}.ToUpdater()
+	require.Nil(t, err)
+	require.Nil(t, updater)
+
+	_, err = DdnsConf{ForwardZone: "example.com"}.ToUpdater()
+	require.NotNil(t, err)
+
+	updater, err = DdnsConf{
+		Server:      "127.0.0.1",
+		ForwardZone: "example.com.",
+		TTL:         60,
+		Key:         &TsigConf{Name: "dhcp-key", Secret: "c2VjcmV0"},
+	}.ToUpdater()
+	require.Nil(t, err)
+	require.Equal(t, "127.0.0.1:53", updater.Client.Server)
+	require.Equal(t, "example.com", updater.ForwardZone)
+	require.Equal(t, uint32(60), updater.TTL)
+	require.Equal(t, "hmac-sha256", updater.Client.Key.Algorithm)
+
+	_, err = DdnsConf{Server: "127.0.0.1", ForwardZone: "example.com", Key: &TsigConf{Name: "k", Secret: "not base64!"}}.ToUpdater()
+	require.NotNil(t, err)
+}
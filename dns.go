@@ -0,0 +1,391 @@
+// Helpers for DNS wire format names (RFC 1035)
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidDomain = errors.New("Invalid domain name")
+
+// Split a domain name into its labels, validating lengths. A trailing dot is
+// accepted, and the root domain has no labels
+func SplitDomainName(name string) ([]string, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil, nil
+	}
+
+	labels := strings.Split(name, ".")
+
+	// Wire length is a length byte per label, the labels, and the root byte
+	total := 1
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidDomain, name)
+		}
+		total += 1 + len(label)
+	}
+	if total > 255 {
+		return nil, fmt.Errorf("%w: %q is too long", ErrInvalidDomain, name)
+	}
+
+	return labels, nil
+}
+
+// Encodes domain names into DNS wire format, replacing suffixes which were
+// already written with compression pointers
+type DnsNameWriter struct {
+	Buf []byte
+
+	// Offsets of suffixes we've already written, keyed by lowercase name
+	offsets map[string]int
+}
+
+func NewDnsNameWriter() *DnsNameWriter {
+	return &DnsNameWriter{offsets: map[string]int{}}
+}
+
+func (w *DnsNameWriter) WriteName(name string) error {
+	labels, err := SplitDomainName(name)
+	if err != nil {
+		return err
+	}
+
+	for i := range labels {
+		suffix := strings.ToLower(strings.Join(labels[i:], "."))
+		if offset, ok := w.offsets[suffix]; ok {
+			w.Buf = append(w.Buf, 0xc0|byte(offset>>8), byte(offset))
+			return nil
+		}
+
+		// Pointers only have 14 bits of offset
+		if offset := len(w.Buf); offset < 0x3fff {
+			w.offsets[suffix] = offset
+		}
+
+		w.Buf = append(w.Buf, byte(len(labels[i])))
+		w.Buf = append(w.Buf, labels[i]...)
+	}
+
+	w.Buf = append(w.Buf, 0)
+	return nil
+}
+
+// Read a possibly compressed name starting at offset within msg, returning it
+// along with the offset just past it
+func ReadDnsName(msg []byte, offset int) (string, int, error) {
+	labels := []string{}
+	end := -1
+
+	// Guard against pointer loops
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, fmt.Errorf("%w: truncated", ErrInvalidDomain)
+		}
+
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if end == -1 {
+				end = offset + 1
+			}
+			return strings.Join(labels, "."), end, nil
+
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(msg) {
+				return "", 0, fmt.Errorf("%w: truncated pointer", ErrInvalidDomain)
+			}
+			if end == -1 {
+				end = offset + 2
+			}
+			jumps++
+			if jumps > 64 {
+				return "", 0, fmt.Errorf("%w: too many pointers", ErrInvalidDomain)
+			}
+			offset = (length&0x3f)<<8 | int(msg[offset+1])
+
+		case length > 63:
+			return "", 0, fmt.Errorf("%w: bad label length %v", ErrInvalidDomain, length)
+
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, fmt.Errorf("%w: truncated label", ErrInvalidDomain)
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+// Encode a domain search list as option 119 (RFC 3397) wants it
+func EncodeDomainSearch(domains []string) ([]byte, error) {
+	w := NewDnsNameWriter()
+	for _, domain := range domains {
+		if err := w.WriteName(domain); err != nil {
+			return nil, err
+		}
+	}
+	return w.Buf, nil
+}
+
+// Decode option 119 back into a list of domains
+func DecodeDomainSearch(data []byte) ([]string, error) {
+	domains := []string{}
+	for offset := 0; offset < len(data); {
+		name, next, err := ReadDnsName(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, name)
+		offset = next
+	}
+	return domains, nil
+}
+
+//
+// DNS messages
+//
+
+// Record types
+const (
+	DNS_TYPE_A     uint16 = 1
+	DNS_TYPE_NS    uint16 = 2
+	DNS_TYPE_CNAME uint16 = 5
+	DNS_TYPE_SOA   uint16 = 6
+	DNS_TYPE_PTR   uint16 = 12
+	DNS_TYPE_AAAA  uint16 = 28
+	DNS_TYPE_DHCID uint16 = 49
+	DNS_TYPE_TSIG  uint16 = 250
+	DNS_TYPE_ANY   uint16 = 255
+)
+
+// Record classes
+const (
+	DNS_CLASS_IN   uint16 = 1
+	DNS_CLASS_NONE uint16 = 254
+	DNS_CLASS_ANY  uint16 = 255
+)
+
+// Opcodes
+const (
+	DNS_OPCODE_QUERY  byte = 0
+	DNS_OPCODE_UPDATE byte = 5
+)
+
+// Response codes
+const (
+	DNS_RCODE_SUCCESS  uint16 = 0
+	DNS_RCODE_FORMERR  uint16 = 1
+	DNS_RCODE_SERVFAIL uint16 = 2
+	DNS_RCODE_NXDOMAIN uint16 = 3
+	DNS_RCODE_NOTIMP   uint16 = 4
+	DNS_RCODE_REFUSED  uint16 = 5
+	DNS_RCODE_YXDOMAIN uint16 = 6
+	DNS_RCODE_YXRRSET  uint16 = 7
+	DNS_RCODE_NXRRSET  uint16 = 8
+	DNS_RCODE_NOTAUTH  uint16 = 9
+	DNS_RCODE_NOTZONE  uint16 = 10
+)
+
+// Header flag bits
+const (
+	DNS_FLAG_QR uint16 = 0x8000
+	DNS_FLAG_AA uint16 = 0x0400
+	DNS_FLAG_TC uint16 = 0x0200
+	DNS_FLAG_RD uint16 = 0x0100
+	DNS_FLAG_RA uint16 = 0x0080
+)
+
+type DnsQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// Resource record. Data is the raw RDATA, which we never compress
+type DnsRR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// DNS message. For UPDATE messages (RFC 2136) the sections are instead the
+// zone, prerequisites, updates and additional data.
+type DnsMessage struct {
+	ID         uint16
+	Flags      uint16
+	Questions  []DnsQuestion
+	Answers    []DnsRR
+	Authority  []DnsRR
+	Additional []DnsRR
+}
+
+func (m *DnsMessage) Opcode() byte {
+	return byte(m.Flags>>11) & 0xf
+}
+
+func (m *DnsMessage) SetOpcode(opcode byte) {
+	m.Flags = m.Flags&^(0xf<<11) | uint16(opcode&0xf)<<11
+}
+
+func (m *DnsMessage) Rcode() uint16 {
+	return m.Flags & 0xf
+}
+
+func (m *DnsMessage) SetRcode(rcode uint16) {
+	m.Flags = m.Flags&^0xf | rcode&0xf
+}
+
+func (m *DnsMessage) Encode() ([]byte, error) {
+	w := NewDnsNameWriter()
+
+	w.Buf = binary.BigEndian.AppendUint16(w.Buf, m.ID)
+	w.Buf = binary.BigEndian.AppendUint16(w.Buf, m.Flags)
+	for _, count := range []int{len(m.Questions), len(m.Answers), len(m.Authority), len(m.Additional)} {
+		w.Buf = binary.BigEndian.AppendUint16(w.Buf, uint16(count))
+	}
+
+	for _, q := range m.Questions {
+		if err := w.WriteName(q.Name); err != nil {
+			return nil, err
+		}
+		w.Buf = binary.BigEndian.AppendUint16(w.Buf, q.Type)
+		w.Buf = binary.BigEndian.AppendUint16(w.Buf, q.Class)
+	}
+
+	for _, section := range [][]DnsRR{m.Answers, m.Authority, m.Additional} {
+		for _, rr := range section {
+			if err := w.WriteName(rr.Name); err != nil {
+				return nil, err
+			}
+			if len(rr.Data) > 0xffff {
+				return nil, fmt.Errorf("RDATA for %v too long", rr.Name)
+			}
+			w.Buf = binary.BigEndian.AppendUint16(w.Buf, rr.Type)
+			w.Buf = binary.BigEndian.AppendUint16(w.Buf, rr.Class)
+			w.Buf = binary.BigEndian.AppendUint32(w.Buf, rr.TTL)
+			w.Buf = binary.BigEndian.AppendUint16(w.Buf, uint16(len(rr.Data)))
+			w.Buf = append(w.Buf, rr.Data...)
+		}
+	}
+
+	return w.Buf, nil
+}
+
+var ErrDnsTruncated = errors.New("Truncated DNS message")
+
+func ParseDnsMessage(b []byte) (*DnsMessage, error) {
+	if len(b) < 12 {
+		return nil, ErrDnsTruncated
+	}
+
+	m := &DnsMessage{
+		ID:    binary.BigEndian.Uint16(b),
+		Flags: binary.BigEndian.Uint16(b[2:]),
+	}
+
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(b[4+i*2:]))
+	}
+
+	offset := 12
+	for i := 0; i < counts[0]; i++ {
+		name, next, err := ReadDnsName(b, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(b) {
+			return nil, ErrDnsTruncated
+		}
+		m.Questions = append(m.Questions, DnsQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[next:]),
+			Class: binary.BigEndian.Uint16(b[next+2:]),
+		})
+		offset = next + 4
+	}
+
+	sections := []*[]DnsRR{&m.Answers, &m.Authority, &m.Additional}
+	for s, section := range sections {
+		for i := 0; i < counts[s+1]; i++ {
+			name, next, err := ReadDnsName(b, offset)
+			if err != nil {
+				return nil, err
+			}
+			if next+10 > len(b) {
+				return nil, ErrDnsTruncated
+			}
+			length := int(binary.BigEndian.Uint16(b[next+8:]))
+			if next+10+length > len(b) {
+				return nil, ErrDnsTruncated
+			}
+			*section = append(*section, DnsRR{
+				Name:  name,
+				Type:  binary.BigEndian.Uint16(b[next:]),
+				Class: binary.BigEndian.Uint16(b[next+2:]),
+				TTL:   binary.BigEndian.Uint32(b[next+4:]),
+				Data:  b[next+10 : next+10+length],
+			})
+			offset = next + 10 + length
+		}
+	}
+
+	return m, nil
+}
+
+// Uncompressed wire encoding of a name, as used within RDATA and when
+// computing digests. Canonical form additionally lowercases it (RFC 4034)
+func EncodeDnsName(name string, canonical bool) ([]byte, error) {
+	labels, err := SplitDomainName(name)
+	if err != nil {
+		return nil, err
+	}
+	buf := []byte{}
+	for _, label := range labels {
+		if canonical {
+			label = strings.ToLower(label)
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+	return append(buf, 0), nil
+}
+
+// Reverse lookup name for an IP, eg 5.0.17.172.in-addr.arpa
+func ReverseName(ip FixedV4) string {
+	b := ip.Bytes()
+	return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", b[3], b[2], b[1], b[0])
+}
+
+// Inverse of ReverseName, for queries under in-addr.arpa
+func ParseReverseName(name string) (FixedV4, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	prefix, ok := strings.CutSuffix(name, ".in-addr.arpa")
+	if !ok {
+		return 0, false
+	}
+
+	labels := strings.Split(prefix, ".")
+	if len(labels) != 4 {
+		return 0, false
+	}
+
+	b := make([]byte, 4)
+	for i, label := range labels {
+		n, err := strconv.ParseUint(label, 10, 8)
+		if err != nil {
+			return 0, false
+		}
+		b[3-i] = byte(n)
+	}
+
+	ip, err := BytesToFixedV4(b)
+	return ip, err == nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDomainSearchEncoding(t *testing.T) {
+	// Example from RFC 3397
+	data, err := EncodeDomainSearch([]string{"eng.apple.com.", "marketing.apple.com."})
+	require.Nil(t, err)
+	require.Equal(t, []byte{
+		3, 'e', 'n', 'g', 5, 'a', 'p', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		9, 'm', 'a', 'r', 'k', 'e', 't', 'i', 'n', 'g', 0xc0, 4,
+	}, data)
+
+	domains, err := DecodeDomainSearch(data)
+	require.Nil(t, err)
+	require.Equal(t, []string{"eng.apple.com", "marketing.apple.com"}, domains)
+
+	// Compression is case insensitive, and whole names can be pointers
+	data, err = EncodeDomainSearch([]string{"Example.com", "example.COM"})
+	require.Nil(t, err)
+	require.Equal(t, []byte{7, 'E', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0xc0, 0}, data)
+
+	for _, invalid := range []string{
+		"double..dot",
+		strings.Repeat("a", 64) + ".com",
+		strings.Repeat(strings.Repeat("a", 60)+".", 5) + "com",
+	} {
+		_, err := EncodeDomainSearch([]string{invalid})
+		require.ErrorIs(t, err, ErrInvalidDomain, invalid)
+	}
+
+	// Pointer loops and truncation are caught
+	_, err = DecodeDomainSearch([]byte{0xc0, 0})
+	require.ErrorIs(t, err, ErrInvalidDomain)
+	_, err = DecodeDomainSearch([]byte{3, 'c', 'o'})
+	require.ErrorIs(t, err, ErrInvalidDomain)
+}
+
+func TestLongDomainSearchOption(t *testing.T) {
+	search := []string{}
+	for i := 0; i < 30; i++ {
+		search = append(search, fmt.Sprintf("site%d.region%d.corp.example.com", i, i))
+	}
+
+	pool := NewPool()
+	pool.Start = net.ParseIP("10.0.0.10")
+	pool.End = net.ParseIP("10.0.0.20")
+	pool.Netmask = net.ParseIP("255.255.255.0")
+	pool.Domain = "corp.example.com"
+	pool.Search = search
+
+	message := NewDhcpMessage()
+	message.Header.Mac = MacAddress{0, 0, 0, 0, 0, 1}
+	message.Options.Set(OPTION_MESSAGE_TYPE, []byte{DHCPDISCOVER})
+	response := NewRequestHandler(message, pool).Handle()
+
+	opt, ok := response.Options.Get(OPTION_DOMAIN_NAME)
+	require.True(t, ok)
+	require.Equal(t, []byte("corp.example.com"), opt.Data)
+
+	expected, err := EncodeDomainSearch(search)
+	require.Nil(t, err)
+	require.Greater(t, len(expected), 255)
+
+	// Over the wire, the search list is split into several option instances
+	buf := new(bytes.Buffer)
+	require.Nil(t, response.Encode(buf))
+
+	instances := 0
+	options := buf.Bytes()[240:]
+	for i := 0; i < len(options) && options[i] != OPTION_SENTINEL; i += 2 + int(options[i+1]) {
+		if options[i] == OPTION_DNS_SEARCH {
+			instances++
+		}
+	}
+	require.Equal(t, (len(expected)+254)/255, instances)
+
+	// And joined back together when parsed
+	parsed, err := ParseDhcpMessage(buf.Bytes())
+	require.Nil(t, err)
+	opt, ok = parsed.Options.Get(OPTION_DNS_SEARCH)
+	require.True(t, ok)
+	require.Equal(t, expected, opt.Data)
+
+	domains, err := DecodeDomainSearch(opt.Data)
+	require.Nil(t, err)
+	require.Equal(t, search, domains)
+}
@@ -0,0 +1,107 @@
+// Reading and writing dnsmasq's dnsmasq.leases format
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Name for a lease in other servers' files: its FQDN if the client sent one
+func exportedHostname(lease *Lease) string {
+	if lease.FQDN != "" {
+		return lease.FQDN
+	}
+	return lease.Hostname
+}
+
+// Our hostname and FQDN for a name from other servers' files
+func importedHostname(name string) (string, string) {
+	name = strings.TrimSuffix(name, ".")
+	if strings.Contains(name, ".") {
+		return SanitizeHostname(name), strings.ToLower(name)
+	}
+	return SanitizeHostname(name), ""
+}
+
+// Read the IPv4 leases of a dnsmasq.leases file. Each line is the expiry
+// time (0 for never), MAC, address, hostname and client ID, with * for
+// unknown values. IPv6 leases follow a "duid" line, and are skipped, as are
+// leases of non ethernet clients
+func ReadDnsmasqLeases(r io.Reader) ([]*Lease, error) {
+	byIp := map[FixedV4]*Lease{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "duid" {
+			break
+		}
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("Line %v: expected at least 4 fields, got %v", line, len(fields))
+		}
+
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Line %v: invalid expiry time '%v'", line, fields[0])
+		}
+		ip := net.ParseIP(fields[2]).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("Line %v: invalid address '%v'", line, fields[2])
+		}
+		// Other hardware types are written as type-address
+		if strings.Contains(fields[1], "-") {
+			continue
+		}
+		mac, err := net.ParseMAC(fields[1])
+		if err != nil || len(mac) != 6 {
+			return nil, fmt.Errorf("Line %v: invalid hardware address '%v'", line, fields[1])
+		}
+
+		lease := &Lease{IP: IpToFixedV4(ip), Expiration: leaseNever}
+		copy(lease.Mac[:], mac)
+		if expiry != 0 {
+			lease.Expiration = time.Unix(expiry, 0).UTC()
+		}
+		if fields[3] != "*" {
+			lease.Hostname, lease.FQDN = importedHostname(fields[3])
+		}
+		byIp[lease.IP] = lease
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	leases := []*Lease{}
+	for _, lease := range byIp {
+		leases = append(leases, lease)
+	}
+	sortLeases(leases)
+	return leases, nil
+}
+
+// Write leases as dnsmasq.leases. We don't keep client IDs, so they're
+// written as unknown
+func WriteDnsmasqLeases(w io.Writer, leases []*Lease, params LeaseExportParams) error {
+	bw := bufio.NewWriter(w)
+	for _, lease := range leases {
+		expiry := int64(0)
+		if lease.Expiration.Before(leaseNever) {
+			expiry = lease.Expiration.Unix()
+		}
+		name := exportedHostname(lease)
+		if name == "" {
+			name = "*"
+		}
+		fmt.Fprintf(bw, "%v %v %v %v *\n", expiry, net.HardwareAddr(lease.Mac[:]).String(), lease.IP.String(), name)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,250 @@
+// Optional DNS responder, answering for lease and reservation hostnames and
+// forwarding everything else to upstream resolvers
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+type DnsServer struct {
+	Pools func() []*Pool
+
+	// Domain for hostnames in pools which have none of their own
+	Domain string
+
+	Upstreams []string
+	TTL       uint32
+	Timeout   time.Duration
+
+	// Queries handled at once. Further queries are dropped until some finish
+	MaxConcurrentQueries int
+
+	conn *net.UDPConn
+}
+
+func NewDnsServer(pools func() []*Pool, domain string, upstreams []string) *DnsServer {
+	return &DnsServer{
+		Pools:     pools,
+		Domain:    strings.TrimSuffix(domain, "."),
+		Upstreams: upstreams,
+		TTL:       60,
+		Timeout:   time.Second * 2,
+
+		MaxConcurrentQueries: 50,
+	}
+}
+
+func (s *DnsServer) ListenAndServe(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+func (s *DnsServer) Serve(conn *net.UDPConn) error {
+	s.conn = conn
+
+	buf := make([]byte, 4096)
+	querySem := make(chan struct{}, s.MaxConcurrentQueries)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		query := append([]byte{}, buf[:n]...)
+
+		// Forwarding may take a while, so don't hold up other queries
+		select {
+		case querySem <- struct{}{}:
+			go func() {
+				defer func() { <-querySem }()
+				if response := s.Handle(query, remote.IP); response != nil {
+					conn.WriteToUDP(response, remote)
+				}
+			}()
+		default:
+			log.Printf("DNS query from %v dropped - server busy", remote)
+		}
+	}
+}
+
+func (s *DnsServer) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// Answer a single query from source, returning nil if it should be ignored
+func (s *DnsServer) Handle(query []byte, source net.IP) []byte {
+	m, err := ParseDnsMessage(query)
+	if err != nil || m.Flags&DNS_FLAG_QR != 0 {
+		return nil
+	}
+
+	response := &DnsMessage{
+		ID:        m.ID,
+		Flags:     DNS_FLAG_QR | m.Flags&DNS_FLAG_RD,
+		Questions: m.Questions,
+	}
+	response.SetOpcode(m.Opcode())
+
+	if m.Opcode() != DNS_OPCODE_QUERY {
+		response.SetRcode(DNS_RCODE_NOTIMP)
+		return s.encode(response)
+	}
+	if len(m.Questions) != 1 {
+		response.SetRcode(DNS_RCODE_FORMERR)
+		return s.encode(response)
+	}
+
+	q := m.Questions[0]
+	if answers, ok := s.answer(q); ok {
+		response.Flags |= DNS_FLAG_AA
+		response.Answers = answers
+		return s.encode(response)
+	}
+
+	if len(s.Upstreams) == 0 || !s.mayRecurse(source) {
+		response.SetRcode(DNS_RCODE_REFUSED)
+		return s.encode(response)
+	}
+
+	if forwarded, err := s.forward(query); err == nil {
+		return forwarded
+	} else {
+		log.Printf("Failed forwarding DNS query for %v: %v", q.Name, err)
+	}
+
+	response.SetRcode(DNS_RCODE_SERVFAIL)
+	return s.encode(response)
+}
+
+// Only we and clients of our pools may have queries forwarded, so we're not
+// an open resolver
+func (s *DnsServer) mayRecurse(source net.IP) bool {
+	if source.IsLoopback() {
+		return true
+	}
+	ip4 := source.To4()
+	if ip4 == nil {
+		return false
+	}
+	for _, pool := range s.Pools() {
+		if pool.Network.To4() == nil || pool.Netmask.To4() == nil {
+			continue
+		}
+		mask := IpToFixedV4(pool.Netmask)
+		if IpToFixedV4(ip4)&mask == IpToFixedV4(pool.Network)&mask {
+			return true
+		}
+	}
+	return false
+}
+
+// Answers from our own leases and reservations. Hostnames are only unique
+// within a pool, so names get an A record from every pool which has them. A
+// name we know with a type we don't have gets an empty answer rather than
+// being forwarded
+func (s *DnsServer) answer(q DnsQuestion) ([]DnsRR, bool) {
+	if q.Class != DNS_CLASS_IN && q.Class != DNS_CLASS_ANY {
+		return nil, false
+	}
+
+	if ip, ok := ParseReverseName(q.Name); ok {
+		for _, pool := range s.Pools() {
+			name, ok := pool.LookupAddr(ip, s.Domain)
+			if !ok {
+				continue
+			}
+			if q.Type != DNS_TYPE_PTR && q.Type != DNS_TYPE_ANY {
+				return nil, true
+			}
+			target, err := EncodeDnsName(name, false)
+			if err != nil {
+				return nil, false
+			}
+			return []DnsRR{{Name: q.Name, Type: DNS_TYPE_PTR, Class: DNS_CLASS_IN, TTL: s.TTL, Data: target}}, true
+		}
+		return nil, false
+	}
+
+	found := false
+	seen := map[FixedV4]bool{}
+	answers := []DnsRR{}
+	for _, pool := range s.Pools() {
+		ip, ok := pool.LookupName(q.Name, s.Domain)
+		if !ok {
+			continue
+		}
+		found = true
+		if seen[ip] || (q.Type != DNS_TYPE_A && q.Type != DNS_TYPE_ANY) {
+			continue
+		}
+		seen[ip] = true
+		answers = append(answers, DnsRR{Name: q.Name, Type: DNS_TYPE_A, Class: DNS_CLASS_IN, TTL: s.TTL, Data: ip.Bytes()})
+	}
+
+	return answers, found
+}
+
+// Relay the query verbatim to each upstream in turn, returning the first
+// response
+func (s *DnsServer) forward(query []byte) ([]byte, error) {
+	var lastErr error
+	buf := make([]byte, 4096)
+
+	for _, upstream := range s.Upstreams {
+		conn, err := net.Dial("udp", upstream)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		conn.SetDeadline(time.Now().Add(s.Timeout))
+		if _, err := conn.Write(query); err != nil {
+			conn.Close()
+			lastErr = err
+			continue
+		}
+
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				lastErr = err
+				break
+			}
+			// Drop anything not answering our query
+			if n < 2 || buf[0] != query[0] || buf[1] != query[1] {
+				continue
+			}
+			conn.Close()
+			return append([]byte{}, buf[:n]...), nil
+		}
+		conn.Close()
+	}
+
+	return nil, lastErr
+}
+
+func (s *DnsServer) encode(m *DnsMessage) []byte {
+	b, err := m.Encode()
+	if err != nil {
+		log.Printf("Failed encoding DNS response: %v", err)
+		return nil
+	}
+	return b
+}
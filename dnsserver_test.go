@@ -0,0 +1,175 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"net"
+	"testing"
+	"time"
+)
+
+func testDnsQuery(t *testing.T, s *DnsServer, name string, qtype uint16) *DnsMessage {
+	return testDnsQueryFrom(t, s, net.IPv4(127, 0, 0, 1), name, qtype)
+}
+
+func testDnsQueryFrom(t *testing.T, s *DnsServer, source net.IP, name string, qtype uint16) *DnsMessage {
+	query := &DnsMessage{ID: 4321, Flags: DNS_FLAG_RD, Questions: []DnsQuestion{{name, qtype, DNS_CLASS_IN}}}
+	b, err := query.Encode()
+	require.Nil(t, err)
+
+	response, err := ParseDnsMessage(s.Handle(b, source))
+	require.Nil(t, err)
+	require.Equal(t, uint16(4321), response.ID)
+	require.NotZero(t, response.Flags&DNS_FLAG_QR)
+	return response
+}
+
+func TestDnsServer(t *testing.T) {
+	pool := NewPool()
+	pool.Network = net.ParseIP("192.168.0.0")
+	pool.Netmask = net.ParseIP("255.255.255.0")
+	pool.Start = net.ParseIP("192.168.0.10")
+	pool.End = net.ParseIP("192.168.0.20")
+	pool.LeaseTime = time.Hour
+	pool.Domain = "lan"
+
+	require.Nil(t, pool.AddReservedHost(&ReservedHost{
+		Mac:      MacAddress{0, 0, 0, 0, 0, 9},
+		Hostname: "printer",
+		IP:       IpToFixedV4(net.ParseIP("192.168.0.5")),
+	}))
+
+	_, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 1}, "laptop")
+	require.Nil(t, err)
+	_, err = pool.GetNextLeaseWithParams(MacAddress{0, 0, 0, 0, 0, 2}, LeaseParams{LeaseTime: time.Hour, Hostname: "phone", FQDN: "phone.example.com"})
+	require.Nil(t, err)
+	// Claiming a reservation's name through the FQDN gets nowhere
+	_, err = pool.GetNextLeaseWithParams(MacAddress{0, 0, 0, 0, 0, 4}, LeaseParams{LeaseTime: time.Hour, FQDN: "printer.lan"})
+	require.Nil(t, err)
+	expired, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 3}, "gone")
+	require.Nil(t, err)
+	pool.SetLeaseExpiration(expired, time.Now().Add(-time.Minute))
+
+	// Fake upstream which answers everything with a single A record
+	upstream, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, remote, err := upstream.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			query, _ := ParseDnsMessage(buf[:n])
+			response := &DnsMessage{ID: query.ID, Flags: DNS_FLAG_QR | DNS_FLAG_RA, Questions: query.Questions}
+			response.Answers = []DnsRR{{query.Questions[0].Name, DNS_TYPE_A, DNS_CLASS_IN, 30, []byte{1, 2, 3, 4}}}
+			b, _ := response.Encode()
+			upstream.WriteToUDP(b, remote)
+		}
+	}()
+
+	pools := []*Pool{pool}
+	s := NewDnsServer(func() []*Pool { return pools }, "", []string{upstream.LocalAddr().String()})
+
+	// Leases by hostname within the pool's domain
+	response := testDnsQuery(t, s, "laptop.lan", DNS_TYPE_A)
+	require.Equal(t, DNS_RCODE_SUCCESS, response.Rcode())
+	require.NotZero(t, response.Flags&DNS_FLAG_AA)
+	require.Len(t, response.Answers, 1)
+	require.Equal(t, []byte{192, 168, 0, 10}, response.Answers[0].Data)
+	require.Equal(t, uint32(60), response.Answers[0].TTL)
+
+	response = testDnsQuery(t, s, "PHONE.lan.", DNS_TYPE_A)
+	require.Len(t, response.Answers, 1)
+	require.Equal(t, []byte{192, 168, 0, 11}, response.Answers[0].Data)
+
+	// But not by FQDNs outside it, which clients choose for themselves
+	response = testDnsQuery(t, s, "phone.example.com", DNS_TYPE_A)
+	require.Zero(t, response.Flags&DNS_FLAG_AA)
+	require.Equal(t, []byte{1, 2, 3, 4}, response.Answers[0].Data)
+
+	response = testDnsQuery(t, s, "printer.lan", DNS_TYPE_A)
+	require.Len(t, response.Answers, 1)
+	require.Equal(t, []byte{192, 168, 0, 5}, response.Answers[0].Data)
+	response = testDnsQuery(t, s, "printer-2.lan", DNS_TYPE_A)
+	require.Len(t, response.Answers, 1)
+	require.Equal(t, []byte{192, 168, 0, 12}, response.Answers[0].Data)
+
+	// Known names without the asked for type get an empty answer
+	response = testDnsQuery(t, s, "laptop.lan", DNS_TYPE_AAAA)
+	require.Equal(t, DNS_RCODE_SUCCESS, response.Rcode())
+	require.Empty(t, response.Answers)
+
+	// Reverse lookups
+	response = testDnsQuery(t, s, "10.0.168.192.in-addr.arpa", DNS_TYPE_PTR)
+	require.Len(t, response.Answers, 1)
+	name, _, err := ReadDnsName(response.Answers[0].Data, 0)
+	require.Nil(t, err)
+	require.Equal(t, "laptop.lan", name)
+
+	response = testDnsQuery(t, s, "5.0.168.192.in-addr.arpa", DNS_TYPE_PTR)
+	require.Len(t, response.Answers, 1)
+
+	// Expired leases and everything else go upstream
+	for _, name := range []string{"gone.lan", "example.org"} {
+		response = testDnsQuery(t, s, name, DNS_TYPE_A)
+		require.Zero(t, response.Flags&DNS_FLAG_AA)
+		require.Len(t, response.Answers, 1)
+		require.Equal(t, []byte{1, 2, 3, 4}, response.Answers[0].Data)
+	}
+
+	// Only clients in our pools' networks get queries forwarded, though
+	// anyone may look up our own names
+	response = testDnsQueryFrom(t, s, net.ParseIP("192.168.0.50"), "example.org", DNS_TYPE_A)
+	require.Len(t, response.Answers, 1)
+	response = testDnsQueryFrom(t, s, net.ParseIP("203.0.113.1"), "example.org", DNS_TYPE_A)
+	require.Equal(t, DNS_RCODE_REFUSED, response.Rcode())
+	require.Empty(t, response.Answers)
+	response = testDnsQueryFrom(t, s, net.ParseIP("203.0.113.1"), "laptop.lan", DNS_TYPE_A)
+	require.Len(t, response.Answers, 1)
+
+	// Without upstreams we refuse, and with dead ones we fail
+	s.Upstreams = nil
+	require.Equal(t, DNS_RCODE_REFUSED, testDnsQuery(t, s, "example.org", DNS_TYPE_A).Rcode())
+
+	dead, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer dead.Close()
+	s.Upstreams = []string{dead.LocalAddr().String()}
+	s.Timeout = time.Millisecond * 50
+	require.Equal(t, DNS_RCODE_SERVFAIL, testDnsQuery(t, s, "example.org", DNS_TYPE_A).Rcode())
+
+	// A name in several pools' domains gets each pool's address
+	other := NewPool()
+	other.Start = net.ParseIP("192.168.1.10")
+	other.End = net.ParseIP("192.168.1.20")
+	other.LeaseTime = time.Hour
+	other.Domain = "lan"
+	_, err = other.GetNextLease(MacAddress{0, 0, 0, 0, 1, 1}, "laptop")
+	require.Nil(t, err)
+	pools = append(pools, other)
+	response = testDnsQuery(t, s, "laptop.lan", DNS_TYPE_A)
+	require.Len(t, response.Answers, 2)
+	require.Equal(t, []byte{192, 168, 0, 10}, response.Answers[0].Data)
+	require.Equal(t, []byte{192, 168, 1, 10}, response.Answers[1].Data)
+	pools = pools[:1]
+
+	// Pools without a domain use the server's
+	pool.Domain = ""
+	s.Domain = "home.arpa"
+	response = testDnsQuery(t, s, "laptop.home.arpa", DNS_TYPE_A)
+	require.Len(t, response.Answers, 1)
+}
+
+func TestParseReverseName(t *testing.T) {
+	ip, ok := ParseReverseName("5.0.17.172.in-addr.arpa.")
+	require.True(t, ok)
+	require.Equal(t, IpToFixedV4(net.ParseIP("172.17.0.5")), ip)
+	require.Equal(t, "5.0.17.172.in-addr.arpa", ReverseName(ip))
+
+	for _, name := range []string{"0.17.172.in-addr.arpa", "256.0.17.172.in-addr.arpa", "5.0.17.172.ip6.arpa", "a.b.c.d.in-addr.arpa"} {
+		_, ok := ParseReverseName(name)
+		require.False(t, ok, name)
+	}
+}
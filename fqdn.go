@@ -0,0 +1,168 @@
+// Helpers for the client FQDN option (RFC 4702), through which clients and
+// servers agree on who performs DNS updates
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Option 81 flags
+const (
+	FQDN_FLAG_S byte = 0x01 // Server should perform A updates
+	FQDN_FLAG_O byte = 0x02 // Server overrode the client's S flag
+	FQDN_FLAG_E byte = 0x04 // Name is in canonical wire format
+	FQDN_FLAG_N byte = 0x08 // Server performs no updates
+)
+
+// Who performs DNS updates for leases in a pool
+type DdnsUpdates int
+
+const (
+	// Server performs no updates at all
+	DDNS_UPDATES_NONE DdnsUpdates = iota
+
+	// Server always updates PTR records, and A records if the client asks
+	DDNS_UPDATES_CLIENT
+
+	// Server updates both A and PTR records, overriding the client
+	DDNS_UPDATES_SERVER
+)
+
+func ParseDdnsUpdates(s string) (DdnsUpdates, error) {
+	switch s {
+	case "", "none":
+		return DDNS_UPDATES_NONE, nil
+	case "client":
+		return DDNS_UPDATES_CLIENT, nil
+	case "server":
+		return DDNS_UPDATES_SERVER, nil
+	}
+	return DDNS_UPDATES_NONE, fmt.Errorf("Unknown ddns updates policy '%v'", s)
+}
+
+// Decoded option 81
+type ClientFQDN struct {
+	Flags byte
+
+	// Name without trailing dot. Partial names are those the client expects
+	// us to qualify with our domain
+	Name    string
+	Partial bool
+}
+
+func ParseClientFQDN(data []byte) (*ClientFQDN, error) {
+	if len(data) < 3 {
+		return nil, errors.New("Client FQDN option too short")
+	}
+
+	fqdn := &ClientFQDN{Flags: data[0]}
+	name := data[3:]
+
+	// Canonical wire format. Partial names lack the terminating root label
+	if fqdn.Flags&FQDN_FLAG_E != 0 {
+		labels := []string{}
+		fqdn.Partial = true
+		for i := 0; i < len(name); {
+			length := int(name[i])
+			if length == 0 {
+				if i != len(name)-1 {
+					return nil, errors.New("Trailing data after client FQDN")
+				}
+				fqdn.Partial = false
+				break
+			}
+			if length > 63 || i+1+length > len(name) {
+				return nil, fmt.Errorf("%w: bad label in client FQDN", ErrInvalidDomain)
+			}
+			labels = append(labels, string(name[i+1:i+1+length]))
+			i += 1 + length
+		}
+		fqdn.Name = strings.Join(labels, ".")
+	} else {
+		// Deprecated ASCII encoding, where only a trailing dot marks a full name
+		ascii := strings.TrimRight(string(name), "\x00")
+		fqdn.Partial = !strings.HasSuffix(ascii, ".")
+		fqdn.Name = strings.TrimSuffix(ascii, ".")
+	}
+
+	if fqdn.Name == "" {
+		fqdn.Partial = false
+		return fqdn, nil
+	}
+
+	if _, err := SplitDomainName(fqdn.Name); err != nil {
+		return nil, err
+	}
+
+	return fqdn, nil
+}
+
+// Whether the client asked us to perform A updates
+func (f *ClientFQDN) ServerUpdate() bool {
+	return f.Flags&FQDN_FLAG_S != 0
+}
+
+// Fully qualified name, using domain to qualify partial names
+func (f *ClientFQDN) Qualify(domain string) string {
+	if f.Name == "" {
+		return ""
+	}
+	if f.Partial && domain != "" {
+		return f.Name + "." + strings.TrimSuffix(domain, ".")
+	}
+	return f.Name
+}
+
+// Flags we reply with, and whether we'll perform A updates, per RFC 4702
+// section 4.2
+func (f *ClientFQDN) ReplyFlags(policy DdnsUpdates) (byte, bool) {
+	// Mirror the client's encoding
+	flags := f.Flags & FQDN_FLAG_E
+
+	switch policy {
+	case DDNS_UPDATES_CLIENT:
+		if f.ServerUpdate() {
+			return flags | FQDN_FLAG_S, true
+		}
+		return flags, false
+	case DDNS_UPDATES_SERVER:
+		if !f.ServerUpdate() {
+			flags |= FQDN_FLAG_O
+		}
+		return flags | FQDN_FLAG_S, true
+	}
+
+	return flags | FQDN_FLAG_N, false
+}
+
+// Encode our reply, with the name qualified by domain in the client's encoding
+func (f *ClientFQDN) EncodeReply(policy DdnsUpdates, domain string) []byte {
+	flags, _ := f.ReplyFlags(policy)
+	name := f.Qualify(domain)
+	partial := f.Partial && domain == ""
+
+	// RCODE1 and RCODE2 are deprecated, and servers must send 255
+	data := []byte{flags, 255, 255}
+
+	if flags&FQDN_FLAG_E != 0 {
+		labels, err := SplitDomainName(name)
+		if err != nil {
+			return data
+		}
+		for _, label := range labels {
+			data = append(data, byte(len(label)))
+			data = append(data, label...)
+		}
+		if partial || name == "" {
+			return data
+		}
+		return append(data, 0)
+	}
+
+	if partial || name == "" {
+		return append(data, name...)
+	}
+	return append(data, name+"."...)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"net"
+	"testing"
+)
+
+func TestParseClientFQDN(t *testing.T) {
+	// Canonical wire format, fully qualified
+	fqdn, err := ParseClientFQDN([]byte{FQDN_FLAG_E | FQDN_FLAG_S, 0, 0, 4, 'h', 'o', 's', 't', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0})
+	require.Nil(t, err)
+	require.Equal(t, "host.example.com", fqdn.Name)
+	require.False(t, fqdn.Partial)
+	require.True(t, fqdn.ServerUpdate())
+	require.Equal(t, "host.example.com", fqdn.Qualify("lab.example.com"))
+
+	// Canonical wire format, partial
+	fqdn, err = ParseClientFQDN([]byte{FQDN_FLAG_E, 0, 0, 4, 'h', 'o', 's', 't'})
+	require.Nil(t, err)
+	require.Equal(t, "host", fqdn.Name)
+	require.True(t, fqdn.Partial)
+	require.False(t, fqdn.ServerUpdate())
+	require.Equal(t, "host.lab.example.com", fqdn.Qualify("lab.example.com"))
+
+	// ASCII, as sent by Windows
+	fqdn, err = ParseClientFQDN([]byte("\x00\x00\x00DESKTOP-1.corp.example.com."))
+	require.Nil(t, err)
+	require.Equal(t, "DESKTOP-1.corp.example.com", fqdn.Name)
+	require.False(t, fqdn.Partial)
+
+	fqdn, err = ParseClientFQDN([]byte("\x01\x00\x00laptop"))
+	require.Nil(t, err)
+	require.Equal(t, "laptop", fqdn.Name)
+	require.True(t, fqdn.Partial)
+	require.Equal(t, "laptop", fqdn.Qualify(""))
+
+	// Empty names are allowed, for clients just negotiating flags
+	fqdn, err = ParseClientFQDN([]byte{FQDN_FLAG_E, 0, 0})
+	require.Nil(t, err)
+	require.Equal(t, "", fqdn.Qualify("example.com"))
+
+	for _, invalid := range [][]byte{
+		{0, 0},
+		{FQDN_FLAG_E, 0, 0, 10, 'h', 'o'},
+		{FQDN_FLAG_E, 0, 0, 1, 'h', 0, 1, 'x'},
+		[]byte("\x00\x00\x00double..dot"),
+	} {
+		_, err := ParseClientFQDN(invalid)
+		require.NotNil(t, err, invalid)
+	}
+}
+
+func TestClientFQDNReplyFlags(t *testing.T) {
+	wantsServer := &ClientFQDN{Flags: FQDN_FLAG_S | FQDN_FLAG_E}
+	wantsClient := &ClientFQDN{Flags: FQDN_FLAG_E}
+
+	cases := []struct {
+		fqdn     *ClientFQDN
+		policy   DdnsUpdates
+		flags    byte
+		updatesA bool
+	}{
+		{wantsServer, DDNS_UPDATES_NONE, FQDN_FLAG_E | FQDN_FLAG_N, false},
+		{wantsClient, DDNS_UPDATES_NONE, FQDN_FLAG_E | FQDN_FLAG_N, false},
+		{wantsServer, DDNS_UPDATES_CLIENT, FQDN_FLAG_E | FQDN_FLAG_S, true},
+		{wantsClient, DDNS_UPDATES_CLIENT, FQDN_FLAG_E, false},
+		{wantsServer, DDNS_UPDATES_SERVER, FQDN_FLAG_E | FQDN_FLAG_S, true},
+		{wantsClient, DDNS_UPDATES_SERVER, FQDN_FLAG_E | FQDN_FLAG_S | FQDN_FLAG_O, true},
+	}
+
+	for _, c := range cases {
+		flags, updatesA := c.fqdn.ReplyFlags(c.policy)
+		require.Equal(t, c.flags, flags, c)
+		require.Equal(t, c.updatesA, updatesA, c)
+	}
+
+	_, err := ParseDdnsUpdates("sometimes")
+	require.NotNil(t, err)
+}
+
+func TestClientFQDNRequest(t *testing.T) {
+	pool := NewPool()
+	pool.Start = net.ParseIP("10.0.0.10")
+	pool.End = net.ParseIP("10.0.0.20")
+	pool.Netmask = net.ParseIP("255.255.255.0")
+	pool.Domain = "lab.example.com"
+	pool.DdnsUpdates = DDNS_UPDATES_SERVER
+
+	mac := MacAddress{0, 0, 0, 0, 0, 1}
+
+	message := NewDhcpMessage()
+	message.Header.Mac = mac
+	message.Options.Set(OPTION_MESSAGE_TYPE, []byte{DHCPDISCOVER})
+	message.Options.Set(OPTION_CLIENT_FQDN, []byte{FQDN_FLAG_E, 0, 0, 6, 'l', 'a', 'p', 't', 'o', 'p'})
+	response := NewRequestHandler(message, pool).Handle()
+
+	// Server overrides the client, and replies with the qualified name
+	opt, ok := response.Options.Get(OPTION_CLIENT_FQDN)
+	require.True(t, ok)
+	reply, err := ParseClientFQDN(opt.Data)
+	require.Nil(t, err)
+	require.Equal(t, FQDN_FLAG_E|FQDN_FLAG_S|FQDN_FLAG_O, reply.Flags)
+	require.Equal(t, []byte{255, 255}, opt.Data[1:3])
+	require.Equal(t, "laptop.lab.example.com", reply.Name)
+	require.False(t, reply.Partial)
+
+	lease, ok := pool.TouchLeaseByMac(mac)
+	require.True(t, ok)
+	require.Equal(t, "laptop.lab.example.com", lease.FQDN)
+
+	// ASCII replies mirror the client's encoding
+	fqdn, err := ParseClientFQDN([]byte("\x01\x00\x00laptop"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("\x01\xff\xfflaptop.lab.example.com."), fqdn.EncodeReply(DDNS_UPDATES_CLIENT, "lab.example.com"))
+}
@@ -0,0 +1,113 @@
+// Hostname handling: cleaning up what clients send in option 12, generating
+// names for clients which send none, and resolving duplicates
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Reduce a client supplied hostname to a single valid DNS label, or "" if
+// nothing usable remains. Anything after the first dot is dropped, as the
+// domain is ours to decide
+func SanitizeHostname(raw string) string {
+	raw = strings.TrimRight(raw, "\x00")
+	if i := strings.IndexByte(raw, '.'); i != -1 {
+		raw = raw[:i]
+	}
+
+	var b strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(raw) {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' {
+			b.WriteRune(c)
+			dash = false
+		} else if !dash {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+
+	name := strings.Trim(b.String(), "-")
+	if len(name) > 63 {
+		name = strings.TrimRight(name[:63], "-")
+	}
+	return name
+}
+
+var hostnamePlaceholder = regexp.MustCompile(`\{[^}]*\}`)
+
+// Placeholders available in hostname templates
+var hostnameTemplateFields = map[string]func(ip FixedV4, mac MacAddress) string{
+	"ip-dashed": func(ip FixedV4, mac MacAddress) string {
+		return strings.ReplaceAll(ip.String(), ".", "-")
+	},
+	"mac": func(ip FixedV4, mac MacAddress) string {
+		return fmt.Sprintf("%02x%02x%02x%02x%02x%02x", mac[0], mac[1], mac[2], mac[3], mac[4], mac[5])
+	},
+	"mac-dashed": func(ip FixedV4, mac MacAddress) string {
+		return fmt.Sprintf("%02x-%02x-%02x-%02x-%02x-%02x", mac[0], mac[1], mac[2], mac[3], mac[4], mac[5])
+	},
+	"octet3": func(ip FixedV4, mac MacAddress) string {
+		return strconv.Itoa(int(ip.Bytes()[2]))
+	},
+	"octet4": func(ip FixedV4, mac MacAddress) string {
+		return strconv.Itoa(int(ip.Bytes()[3]))
+	},
+}
+
+// Template for generating hostnames, eg dyn-{ip-dashed}
+type HostnameTemplate string
+
+func ParseHostnameTemplate(template string) (HostnameTemplate, error) {
+	for _, placeholder := range hostnamePlaceholder.FindAllString(template, -1) {
+		if _, ok := hostnameTemplateFields[strings.Trim(placeholder, "{}")]; !ok {
+			return "", fmt.Errorf("Unknown hostname template field %v", placeholder)
+		}
+	}
+	return HostnameTemplate(template), nil
+}
+
+func (t HostnameTemplate) Expand(ip FixedV4, mac MacAddress) string {
+	if t == "" {
+		return ""
+	}
+	expanded := hostnamePlaceholder.ReplaceAllStringFunc(string(t), func(placeholder string) string {
+		return hostnameTemplateFields[strings.Trim(placeholder, "{}")](ip, mac)
+	})
+	return SanitizeHostname(expanded)
+}
+
+// What to do when a client asks for a hostname another client already has
+type HostnameDuplicates int
+
+const (
+	// Append -2, -3 and so on until the name is unique
+	HOSTNAME_DUPLICATES_SUFFIX HostnameDuplicates = iota
+
+	// Ignore the requested name, falling back to the template
+	HOSTNAME_DUPLICATES_REJECT
+
+	// Take the name from the other lease. Reserved hostnames are never taken
+	HOSTNAME_DUPLICATES_LAST_WINS
+)
+
+func ParseHostnameDuplicates(s string) (HostnameDuplicates, error) {
+	switch s {
+	case "", "suffix":
+		return HOSTNAME_DUPLICATES_SUFFIX, nil
+	case "reject":
+		return HOSTNAME_DUPLICATES_REJECT, nil
+	case "last-wins":
+		return HOSTNAME_DUPLICATES_LAST_WINS, nil
+	}
+	return HOSTNAME_DUPLICATES_SUFFIX, fmt.Errorf("Unknown hostname duplicates policy '%v'", s)
+}
+
+// Hostname settings for a pool
+type HostnameConf struct {
+	Template   string `yaml:"template"`
+	Duplicates string `yaml:"duplicates"`
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitizeHostname(t *testing.T) {
+	for raw, expected := range map[string]string{
+		"laptop":                       "laptop",
+		"My Laptop":                    "my-laptop",
+		"Bob's iPhone":                 "bob-s-iphone",
+		"host.example.com":             "host",
+		"--weird__name--\x00":          "weird-name",
+		"":                             "",
+		"!!!":                          "",
+		strings.Repeat("a", 70):        strings.Repeat("a", 63),
+		"ünïcode-host":                 "n-code-host",
+		strings.Repeat("a", 62) + "-b": strings.Repeat("a", 62),
+	} {
+		require.Equal(t, expected, SanitizeHostname(raw), raw)
+	}
+}
+
+func TestHostnameTemplate(t *testing.T) {
+	template, err := ParseHostnameTemplate("dyn-{ip-dashed}")
+	require.Nil(t, err)
+
+	ip := IpToFixedV4(net.ParseIP("10.0.1.23"))
+	mac := MacAddress{0xaa, 0xbb, 0xcc, 0x00, 0x11, 0x22}
+	require.Equal(t, "dyn-10-0-1-23", template.Expand(ip, mac))
+
+	template, err = ParseHostnameTemplate("Host_{mac}-{octet3}-{octet4}")
+	require.Nil(t, err)
+	require.Equal(t, "host-aabbcc001122-1-23", template.Expand(ip, mac))
+
+	require.Equal(t, "", HostnameTemplate("").Expand(ip, mac))
+
+	_, err = ParseHostnameTemplate("dyn-{ip}")
+	require.NotNil(t, err)
+}
+
+func TestHostnameDuplicates(t *testing.T) {
+	newPool := func(duplicates HostnameDuplicates) *Pool {
+		pool := NewPool()
+		pool.Start = net.ParseIP("10.0.0.10")
+		pool.End = net.ParseIP("10.0.0.20")
+		pool.LeaseTime = time.Hour
+		pool.HostnameTemplate = "dyn-{ip-dashed}"
+		pool.HostnameDuplicates = duplicates
+		require.Nil(t, pool.AddReservedHost(&ReservedHost{
+			Mac:      MacAddress{0, 0, 0, 0, 0, 9},
+			Hostname: "printer",
+			IP:       IpToFixedV4(net.ParseIP("10.0.0.5")),
+		}))
+		return pool
+	}
+
+	mac1 := MacAddress{0, 0, 0, 0, 0, 1}
+	mac2 := MacAddress{0, 0, 0, 0, 0, 2}
+	mac3 := MacAddress{0, 0, 0, 0, 0, 3}
+
+	// Suffix
+	pool := newPool(HOSTNAME_DUPLICATES_SUFFIX)
+	lease1, err := pool.GetNextLease(mac1, "Laptop")
+	require.Nil(t, err)
+	require.Equal(t, "laptop", lease1.Hostname)
+	lease2, err := pool.GetNextLease(mac2, "laptop")
+	require.Nil(t, err)
+	require.Equal(t, "laptop-2", lease2.Hostname)
+	lease3, err := pool.GetNextLease(mac3, "printer")
+	require.Nil(t, err)
+	require.Equal(t, "printer-2", lease3.Hostname)
+
+	// Renewing keeps the suffixed name
+	lease2, ok := pool.TouchLeaseByMacWithParams(mac2, LeaseParams{LeaseTime: time.Hour, Hostname: "laptop"})
+	require.True(t, ok)
+	require.Equal(t, "laptop-2", lease2.Hostname)
+
+	// Clients without names get templated ones, and reserved hosts theirs
+	lease, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 4}, "")
+	require.Nil(t, err)
+	require.Equal(t, "dyn-10-0-0-13", lease.Hostname)
+	lease, err = pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 9}, "whatever")
+	require.Nil(t, err)
+	require.Equal(t, "printer", lease.Hostname)
+
+	// Reject
+	pool = newPool(HOSTNAME_DUPLICATES_REJECT)
+	_, err = pool.GetNextLease(mac1, "laptop")
+	require.Nil(t, err)
+	lease2, err = pool.GetNextLease(mac2, "laptop")
+	require.Nil(t, err)
+	require.Equal(t, "dyn-10-0-0-11", lease2.Hostname)
+
+	// Last wins, except against reservations. The previous owner is
+	// renamed, so its records can be removed
+	pool = newPool(HOSTNAME_DUPLICATES_LAST_WINS)
+	events := []LeaseEvent{}
+	pool.AddListener(func(pool *Pool, event LeaseEvent) { events = append(events, event) })
+	lease1, err = pool.GetNextLease(mac1, "laptop")
+	require.Nil(t, err)
+	lease2, err = pool.GetNextLease(mac2, "laptop")
+	require.Nil(t, err)
+	require.Equal(t, "laptop", lease2.Hostname)
+	require.Equal(t, "", lease1.Hostname)
+	require.Len(t, events, 1)
+	require.Equal(t, LEASE_RENAMED, events[0].Type)
+	require.Equal(t, mac1, events[0].Lease.Mac)
+	require.Equal(t, "laptop", events[0].Lease.Hostname)
+	ip, ok := pool.LookupName("laptop", "")
+	require.True(t, ok)
+	require.Equal(t, lease2.IP, ip)
+	lease3, err = pool.GetNextLease(mac3, "printer")
+	require.Nil(t, err)
+	require.Equal(t, "dyn-10-0-0-12", lease3.Hostname)
+
+	// Expired leases don't hold on to their names
+	pool = newPool(HOSTNAME_DUPLICATES_REJECT)
+	lease1, err = pool.GetNextLease(mac1, "laptop")
+	require.Nil(t, err)
+	pool.SetLeaseExpiration(lease1, time.Now().Add(-time.Minute))
+	lease2, err = pool.GetNextLease(mac2, "laptop")
+	require.Nil(t, err)
+	require.Equal(t, "laptop", lease2.Hostname)
+
+	// Clients sending only an FQDN are named after its first label, under
+	// the same rules
+	pool = newPool(HOSTNAME_DUPLICATES_SUFFIX)
+	lease, err = pool.GetNextLeaseWithParams(mac1, LeaseParams{LeaseTime: time.Hour, FQDN: "Printer.example.com"})
+	require.Nil(t, err)
+	require.Equal(t, "printer-2", lease.Hostname)
+	require.Equal(t, "Printer.example.com", lease.FQDN)
+
+	_, err = ParseHostnameDuplicates("first-wins")
+	require.NotNil(t, err)
+}
+
+func TestReservedHostname(t *testing.T) {
+	host, err := (&HostConf{IP: "10.0.0.5", Mac: "00:00:00:00:00:09", Hostname: "Printer"}).ToHost()
+	require.Nil(t, err)
+	require.Equal(t, "printer", host.Hostname)
+
+	_, err = (&HostConf{IP: "10.0.0.5", Mac: "00:00:00:00:00:09", Hostname: "not valid"}).ToHost()
+	require.NotNil(t, err)
+}
@@ -0,0 +1,364 @@
+// Reading and writing ISC dhcpd's dhcpd.leases format, for migrating to and
+// from isc-dhcp-server
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Times in dhcpd.leases are UTC, after the day of the week
+const iscTimeFormat = "2006/01/02 15:04:05"
+
+// One lease block. Later blocks for an address replace earlier ones, as
+// dhcpd appends to the file rather than rewriting it
+type IscLease struct {
+	IP       FixedV4
+	Starts   time.Time
+	Ends     time.Time
+	State    string
+	Mac      MacAddress
+	HasMac   bool
+	UID      []byte
+	Hostname string
+}
+
+// Split dhcpd.leases into words, quoted strings (unescaped), braces and
+// semicolons, dropping comments
+func iscTokens(r io.Reader) ([]string, error) {
+	var tokens []string
+	br := bufio.NewReader(r)
+	var word strings.Builder
+
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, word.String())
+			word.Reset()
+		}
+	}
+
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			flush()
+			return tokens, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case c == '#':
+			flush()
+			if _, err := br.ReadString('\n'); err != nil && err != io.EOF {
+				return nil, err
+			}
+		case c == '"':
+			flush()
+			s, err := iscString(br)
+			if err != nil {
+				return nil, err
+			}
+			// Mark strings so "{" in a hostname isn't taken for a brace
+			tokens = append(tokens, "\""+s)
+		case c == '{' || c == '}' || c == ';':
+			flush()
+			tokens = append(tokens, string(c))
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			flush()
+		default:
+			word.WriteByte(c)
+		}
+	}
+}
+
+// The rest of a quoted string, with C style and octal escapes
+func iscString(br *bufio.Reader) (string, error) {
+	var s []byte
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return "", errors.New("Unterminated string in leases file")
+		}
+		switch c {
+		case '"':
+			return string(s), nil
+		case '\\':
+			c, err = br.ReadByte()
+			if err != nil {
+				return "", errors.New("Unterminated string in leases file")
+			}
+			if c >= '0' && c <= '7' {
+				digits := []byte{c}
+				for len(digits) < 3 {
+					next, err := br.Peek(1)
+					if err != nil || next[0] < '0' || next[0] > '7' {
+						break
+					}
+					br.ReadByte()
+					digits = append(digits, next[0])
+				}
+				n, _ := strconv.ParseUint(string(digits), 8, 8)
+				s = append(s, byte(n))
+				continue
+			}
+			switch c {
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			case 'r':
+				c = '\r'
+			}
+			s = append(s, c)
+		default:
+			s = append(s, c)
+		}
+	}
+}
+
+// Parse the lease blocks of a dhcpd.leases file, ignoring everything else
+// (eg host declarations, failover state and lease6 blocks)
+func ParseIscLeases(r io.Reader) ([]*IscLease, error) {
+	tokens, err := iscTokens(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var leases []*IscLease
+	for i := 0; i < len(tokens); {
+		// Statements are either "words ;" or "words { ... }"
+		start := i
+		for i < len(tokens) && tokens[i] != ";" && tokens[i] != "{" {
+			i++
+		}
+		if i == len(tokens) {
+			return nil, fmt.Errorf("Unterminated statement '%v'", strings.Join(tokens[start:], " "))
+		}
+		if tokens[i] == ";" {
+			i++
+			continue
+		}
+
+		end, err := iscBlockEnd(tokens, i)
+		if err != nil {
+			return nil, err
+		}
+		if i-start == 2 && tokens[start] == "lease" {
+			lease, err := parseIscLease(tokens[start+1], tokens[i+1:end])
+			if err != nil {
+				return nil, err
+			}
+			leases = append(leases, lease)
+		}
+		i = end + 1
+	}
+	return leases, nil
+}
+
+// Index of the brace closing the block opened at open
+func iscBlockEnd(tokens []string, open int) (int, error) {
+	depth := 0
+	for i := open; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return 0, errors.New("Unterminated block in leases file")
+}
+
+func parseIscLease(address string, body []string) (*IscLease, error) {
+	ip := net.ParseIP(address).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid lease address '%v'", address)
+	}
+	lease := &IscLease{IP: IpToFixedV4(ip)}
+
+	for len(body) > 0 {
+		end := 0
+		for end < len(body) && body[end] != ";" && body[end] != "{" {
+			end++
+		}
+		statement := body[:end]
+		if end < len(body) && body[end] == "{" {
+			// Nested blocks, eg "on commit { ... }", aren't of interest
+			close, err := iscBlockEnd(body, end)
+			if err != nil {
+				return nil, err
+			}
+			body = body[close+1:]
+			continue
+		}
+		if end < len(body) {
+			end++
+		}
+		body = body[end:]
+		if err := lease.apply(statement); err != nil {
+			return nil, fmt.Errorf("Lease %v: %w", address, err)
+		}
+	}
+	return lease, nil
+}
+
+func (l *IscLease) apply(statement []string) error {
+	if len(statement) == 0 {
+		return nil
+	}
+
+	switch {
+	case statement[0] == "starts" || statement[0] == "ends":
+		t, err := parseIscTime(statement[1:])
+		if err != nil {
+			return err
+		}
+		if statement[0] == "starts" {
+			l.Starts = t
+		} else {
+			l.Ends = t
+		}
+
+	case len(statement) == 3 && statement[0] == "binding" && statement[1] == "state":
+		l.State = statement[2]
+
+	case len(statement) == 3 && statement[0] == "hardware" && statement[1] == "ethernet":
+		mac, err := net.ParseMAC(statement[2])
+		if err != nil || len(mac) != 6 {
+			return fmt.Errorf("Invalid hardware address '%v'", statement[2])
+		}
+		copy(l.Mac[:], mac)
+		l.HasMac = true
+
+	case len(statement) == 2 && statement[0] == "uid":
+		l.UID = parseIscData(statement[1])
+
+	case len(statement) == 2 && statement[0] == "client-hostname" && strings.HasPrefix(statement[1], "\""):
+		l.Hostname = statement[1][1:]
+	}
+	return nil
+}
+
+// Times are "never", "epoch <seconds>" or "<weekday> <date> <time>"
+func parseIscTime(fields []string) (time.Time, error) {
+	switch {
+	case len(fields) == 1 && fields[0] == "never":
+		return time.Time{}, nil
+	case len(fields) == 2 && fields[0] == "epoch":
+		seconds, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Invalid epoch time '%v'", fields[1])
+		}
+		return time.Unix(seconds, 0).UTC(), nil
+	case len(fields) == 3:
+		return time.Parse(iscTimeFormat, fields[1]+" "+fields[2])
+	}
+	return time.Time{}, fmt.Errorf("Invalid time '%v'", strings.Join(fields, " "))
+}
+
+// Data is either a quoted string or colon separated hex bytes
+func parseIscData(value string) []byte {
+	if strings.HasPrefix(value, "\"") {
+		return []byte(value[1:])
+	}
+	var data []byte
+	for _, part := range strings.Split(value, ":") {
+		n, err := strconv.ParseUint(part, 16, 8)
+		if err != nil {
+			return nil
+		}
+		data = append(data, byte(n))
+	}
+	return data
+}
+
+// Our lease for an ISC one, if it's an active binding. Leases ending never
+// end at leaseNever, and the uid isn't kept, as we key on MAC
+func (l *IscLease) Lease() (*Lease, bool) {
+	if !l.HasMac || (l.State != "" && l.State != "active") {
+		return nil, false
+	}
+	expiration := l.Ends
+	if expiration.IsZero() {
+		expiration = leaseNever
+	}
+	return &Lease{
+		IP:         l.IP,
+		Mac:        l.Mac,
+		Hostname:   SanitizeHostname(l.Hostname),
+		Expiration: expiration,
+	}, true
+}
+
+// Active bindings in a dhcpd.leases file, the last block for each address
+// winning
+func ReadIscLeases(r io.Reader) ([]*Lease, error) {
+	parsed, err := ParseIscLeases(r)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := map[FixedV4]*IscLease{}
+	for _, lease := range parsed {
+		latest[lease.IP] = lease
+	}
+
+	leases := []*Lease{}
+	for _, isc := range latest {
+		if lease, ok := isc.Lease(); ok {
+			leases = append(leases, lease)
+		}
+	}
+	sortLeases(leases)
+	return leases, nil
+}
+
+func sortLeases(leases []*Lease) {
+	sort.Slice(leases, func(i, j int) bool { return leases[i].IP < leases[j].IP })
+}
+
+// Write leases as dhcpd.leases. We don't record when leases started, so
+// starts is taken to be a lease time before they end
+func WriteIscLeases(w io.Writer, leases []*Lease, params LeaseExportParams) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# The format of this file is documented in the dhcpd.leases(5) manual page.\n")
+	fmt.Fprintf(bw, "# Exported by mygodhcpd\n\n")
+
+	now := time.Now()
+	for _, lease := range leases {
+		state := "active"
+		if lease.Expiration.Before(now) {
+			state = "free"
+		}
+		fmt.Fprintf(bw, "lease %v {\n", lease.IP.String())
+		fmt.Fprintf(bw, "  starts %v;\n", formatIscTime(lease.Expiration.Add(-params.LeaseTime)))
+		if lease.Expiration.Before(leaseNever) {
+			fmt.Fprintf(bw, "  ends %v;\n", formatIscTime(lease.Expiration))
+		} else {
+			fmt.Fprintf(bw, "  ends never;\n")
+		}
+		fmt.Fprintf(bw, "  binding state %v;\n", state)
+		fmt.Fprintf(bw, "  hardware ethernet %v;\n", net.HardwareAddr(lease.Mac[:]).String())
+		if lease.Hostname != "" {
+			fmt.Fprintf(bw, "  client-hostname %v;\n", strconv.Quote(lease.Hostname))
+		}
+		fmt.Fprintf(bw, "}\n")
+	}
+	return bw.Flush()
+}
+
+func formatIscTime(t time.Time) string {
+	t = t.UTC()
+	return strconv.Itoa(int(t.Weekday())) + " " + t.Format(iscTimeFormat)
+}
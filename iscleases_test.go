@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadIscLeases(t *testing.T) {
+	f, err := os.Open("testdata/dhcpd.leases")
+	require.Nil(t, err)
+	defer f.Close()
+
+	leases, err := ReadIscLeases(f)
+	require.Nil(t, err)
+
+	ip := func(s string) FixedV4 { return IpToFixedV4(net.ParseIP(s)) }
+
+	// The free lease is left out, and the later block for .13 wins
+	require.Len(t, leases, 4)
+	require.Equal(t, &Lease{
+		IP:         ip("192.168.1.10"),
+		Mac:        StrToMac("52:54:0:12:34:56"),
+		Hostname:   "laptop",
+		Expiration: time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+	}, leases[1])
+	require.Equal(t, ip("192.168.1.11"), leases[2].IP)
+	require.Equal(t, leaseNever, leases[2].Expiration)
+	require.Equal(t, "printer", leases[3].Hostname)
+	require.Equal(t, time.Unix(1893542400, 0).UTC(), leases[3].Expiration)
+	require.Equal(t, ip("10.0.0.5"), leases[0].IP)
+}
+
+func TestParseIscLeases(t *testing.T) {
+	leases, err := ParseIscLeases(strings.NewReader(`lease 10.0.0.1 {
+  uid "\001RT\000\0224V";
+  hardware ethernet 52:54:00:12:34:56;
+}`))
+	require.Nil(t, err)
+	require.Len(t, leases, 1)
+	require.Equal(t, []byte{1, 'R', 'T', 0, 0x12, '4', 'V'}, leases[0].UID)
+
+	_, err = ParseIscLeases(strings.NewReader("lease 10.0.0.1 {\n  binding state active;\n"))
+	require.NotNil(t, err)
+	_, err = ParseIscLeases(strings.NewReader("lease 10.0.0.1 {\n  hardware ethernet 52:54;\n}"))
+	require.NotNil(t, err)
+}
+
+func TestIscLeasesRoundTrip(t *testing.T) {
+	leases := []*Lease{
+		{
+			IP:         IpToFixedV4(net.ParseIP("10.0.0.1")),
+			Mac:        MacAddress{0x52, 0x54, 0, 0x12, 0x34, 0x56},
+			Hostname:   "laptop",
+			Expiration: time.Now().Add(time.Hour).Truncate(time.Second).UTC(),
+		},
+		{
+			IP:         IpToFixedV4(net.ParseIP("10.0.0.2")),
+			Mac:        MacAddress{0x52, 0x54, 0, 0, 0, 2},
+			Expiration: time.Now().Add(2 * time.Hour).Truncate(time.Second).UTC(),
+		},
+	}
+
+	var buf bytes.Buffer
+	require.Nil(t, WriteIscLeases(&buf, leases, LeaseExportParams{LeaseTime: time.Hour}))
+	require.Contains(t, buf.String(), "hardware ethernet 52:54:00:12:34:56;")
+
+	read, err := ReadIscLeases(&buf)
+	require.Nil(t, err)
+	require.Equal(t, leases, read)
+}
+
+func TestIscLeasesNever(t *testing.T) {
+	leases := []*Lease{{IP: 1, Mac: MacAddress{0, 0, 0, 0, 0, 1}, Expiration: leaseNever}}
+	var buf bytes.Buffer
+	require.Nil(t, WriteIscLeases(&buf, leases, LeaseExportParams{LeaseTime: time.Hour}))
+	require.Contains(t, buf.String(), "ends never;")
+	read, err := ReadIscLeases(&buf)
+	require.Nil(t, err)
+	require.Equal(t, leases, read)
+}
+
+func TestImportLeases(t *testing.T) {
+	pool := NewPool()
+	pool.Name = "lan"
+	pool.Network = net.ParseIP("10.0.0.0")
+	pool.Netmask = net.ParseIP("255.255.255.0")
+
+	now := time.Now()
+	ip := func(s string) FixedV4 { return IpToFixedV4(net.ParseIP(s)) }
+	mac := func(i byte) MacAddress { return MacAddress{0, 0, 0, 0, 0, i} }
+
+	leases := map[FixedV4]*Lease{
+		ip("10.0.0.1"): {IP: ip("10.0.0.1"), Mac: mac(1), Expiration: now.Add(time.Hour)},
+		ip("10.0.0.2"): {IP: ip("10.0.0.2"), Mac: mac(2), Expiration: now.Add(time.Hour)},
+	}
+	added := ImportLeases(pool, leases, []*Lease{
+		// Moves mac 1 to a new address
+		{IP: ip("10.0.0.3"), Mac: mac(1), Expiration: now.Add(time.Hour)},
+		{IP: ip("10.0.0.4"), Mac: mac(4), Expiration: now.Add(-time.Hour)},
+		{IP: ip("10.0.1.5"), Mac: mac(5), Expiration: now.Add(time.Hour)},
+	}, now)
+
+	require.Equal(t, 1, added)
+	require.Len(t, leases, 2)
+	require.Equal(t, mac(1), leases[ip("10.0.0.3")].Mac)
+	require.Equal(t, mac(2), leases[ip("10.0.0.2")].Mac)
+}
+
+func TestImportedLeaseNeverEnds(t *testing.T) {
+	imported, err := ReadIscLeases(strings.NewReader(`lease 10.0.0.10 {
+  starts 4 2024/01/04 10:00:00;
+  ends never;
+  hardware ethernet 00:00:00:00:00:01;
+}
+`))
+	require.Nil(t, err)
+	require.Len(t, imported, 1)
+
+	pool := NewPool()
+	pool.Start = net.ParseIP("10.0.0.10")
+	pool.End = net.ParseIP("10.0.0.20")
+	pool.LeaseTime = time.Hour
+	persistence := NewFilePersistence(filepath.Join(t.TempDir(), "lan.json"))
+	pool.Persistence = persistence
+
+	leases := map[FixedV4]*Lease{}
+	require.Equal(t, 1, ImportLeases(pool, leases, imported, time.Now()))
+
+	// As are leases whose expiration is too far off to count in nanoseconds
+	distant := testLease("10.0.0.11", 2)
+	distant.Expiration = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+	leases[distant.IP] = distant
+	require.Nil(t, persistence.PersistLeases(leases))
+
+	loaded, err := pool.LoadLeases()
+	require.Nil(t, err)
+	require.Equal(t, 2, loaded)
+	require.Zero(t, pool.Reap(time.Now()))
+	require.Zero(t, pool.Reap(time.Now().AddDate(100, 0, 0)))
+	_, ok := pool.TouchLeaseByMac(MacAddress{0, 0, 0, 0, 0, 1})
+	require.True(t, ok)
+}
+
+func TestLeaseCommands(t *testing.T) {
+	dir := t.TempDir()
+	confPath := filepath.Join(dir, "conf.yaml")
+	require.Nil(t, os.WriteFile(confPath, []byte(`leasedir: `+dir+`
+pools:
+  - name: lan
+    myip: 192.168.1.1
+    network: 192.168.1.0
+    mask: 255.255.255.0
+    start: 192.168.1.10
+    end: 192.168.1.100
+    leasetime: 86400
+`), 0644))
+
+	ran, err := runLeaseCommand([]string{"import", "-conf", confPath, "-pool", "lan", "testdata/dhcpd.leases"})
+	require.True(t, ran)
+	require.Nil(t, err)
+
+	leases, err := NewFilePersistence(filepath.Join(dir, "lan.json")).LoadLeases()
+	require.Nil(t, err)
+	require.Len(t, leases, 3)
+	require.Equal(t, "laptop", leases[IpToFixedV4(net.ParseIP("192.168.1.10"))].Hostname)
+
+	exported := filepath.Join(dir, "dhcpd.leases")
+	ran, err = runLeaseCommand([]string{"export", "-conf", confPath, "-pool", "lan", exported})
+	require.True(t, ran)
+	require.Nil(t, err)
+	contents, err := os.ReadFile(exported)
+	require.Nil(t, err)
+	require.Contains(t, string(contents), "lease 192.168.1.13 {")
+	require.Contains(t, string(contents), `client-hostname "printer";`)
+
+	_, err = runLeaseCommand([]string{"export", "-conf", confPath, "-pool", "wan"})
+	require.NotNil(t, err)
+	_, err = runLeaseCommand([]string{"export", "-conf", confPath, "-pool", "lan", "-format", "csv"})
+	require.NotNil(t, err)
+
+	ran, _ = runLeaseCommand([]string{"-conf", confPath})
+	require.False(t, ran)
+}
@@ -0,0 +1,287 @@
+// Lease persistence as a snapshot plus an append-only journal of changes, so
+// each change costs one small append rather than rewriting every lease
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJournalSyncInterval = time.Second
+	defaultJournalCompactAfter = 1000
+)
+
+// Persistence which can record just the leases which changed. Changed maps
+// IPs to their new lease, or nil if their lease was removed
+type IncrementalPersistence interface {
+	Persistence
+	PersistChanges(changed map[FixedV4]*Lease) error
+}
+
+type journalRecord struct {
+	IP string
+
+	// Nil when the IP's lease was removed
+	Lease *FilePersistenceLease `json:",omitempty"`
+}
+
+// Snapshot in the same format as FilePersistence, so the two can be switched
+// between, plus a journal alongside it with one JSON record per line
+type JournalPersistence struct {
+	snapshot    *FilePersistence
+	journalPath string
+
+	// How often appended records are fsynced. Zero syncs every append
+	SyncInterval time.Duration
+
+	// Records after which the journal is folded into a new snapshot
+	CompactAfter int
+
+	m        sync.Mutex
+	journal  *os.File
+	leases   map[string]*FilePersistenceLease
+	records  int
+	unsynced bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	// Length of the journal up to the last complete append
+	size int64
+}
+
+func NewJournalPersistence(path string) *JournalPersistence {
+	return &JournalPersistence{
+		snapshot:     NewFilePersistence(path),
+		journalPath:  path + ".journal",
+		SyncInterval: defaultJournalSyncInterval,
+		CompactAfter: defaultJournalCompactAfter,
+	}
+}
+
+// Load the snapshot, replay the journal over it, then compact the two
+func (p *JournalPersistence) LoadLeases() (map[FixedV4]*Lease, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p.snapshot.decode(p.leases), nil
+}
+
+func (p *JournalPersistence) load() error {
+	leases, err := p.snapshot.LoadLeases()
+	if err != nil {
+		return err
+	}
+	p.leases = p.snapshot.encode(leases)
+
+	replayed, err := p.replay()
+	if err != nil {
+		return err
+	}
+	if replayed > 0 {
+		log.Printf("Replayed %v lease journal records from %v", replayed, p.journalPath)
+	}
+	return p.compact()
+}
+
+func (p *JournalPersistence) replay() (int, error) {
+	f, err := os.Open(p.journalPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var record journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || net.ParseIP(record.IP) == nil {
+			// Most likely a record cut short by a crash, after which there
+			// can't be anything we wrote successfully
+			log.Printf("Ignoring damaged lease journal record %v in %v", count+1, p.journalPath)
+			break
+		}
+		p.apply(record)
+		count++
+	}
+	return count, scanner.Err()
+}
+
+func (p *JournalPersistence) apply(record journalRecord) {
+	if record.Lease == nil {
+		delete(p.leases, record.IP)
+	} else {
+		p.leases[record.IP] = record.Lease
+	}
+}
+
+// Replace every lease, eg on first use
+func (p *JournalPersistence) PersistLeases(leases map[FixedV4]*Lease) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.leases = p.snapshot.encode(leases)
+	return p.compact()
+}
+
+func (p *JournalPersistence) PersistChanges(changed map[FixedV4]*Lease) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.journal == nil {
+		if err := p.load(); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	for ip, lease := range changed {
+		record := journalRecord{IP: ip.String()}
+		if lease != nil {
+			record.Lease = p.snapshot.encode(map[FixedV4]*Lease{ip: lease})[ip.String()]
+		}
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		p.apply(record)
+	}
+
+	if _, err := p.journal.Write(buf.Bytes()); err != nil {
+		log.Printf("Failed appending to lease journal %v: %v", p.journalPath, err)
+		p.discardPartialAppend()
+		return err
+	}
+	p.size += int64(buf.Len())
+	p.records += len(changed)
+	p.unsynced = true
+
+	if p.CompactAfter > 0 && p.records >= p.CompactAfter {
+		return p.compact()
+	}
+	if p.SyncInterval <= 0 {
+		return p.sync()
+	}
+	return nil
+}
+
+// Write our leases as a new snapshot and start an empty journal. Should we
+// crash between the two, replaying the old journal over the new snapshot
+// changes nothing
+func (p *JournalPersistence) compact() error {
+	payload, err := marshalLeaseFile(p.leases)
+	if err != nil {
+		return err
+	}
+	if err := p.snapshot.write(payload); err != nil {
+		log.Printf("Failed writing lease snapshot %v: %v", p.snapshot.path, err)
+		return err
+	}
+
+	if p.journal != nil {
+		p.journal.Close()
+	}
+	p.journal, err = os.OpenFile(p.journalPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	p.size = 0
+	p.records = 0
+	p.unsynced = false
+
+	if p.done == nil && p.SyncInterval > 0 {
+		p.done = make(chan struct{})
+		p.wg.Add(1)
+		go p.syncLoop(p.done)
+	}
+	return nil
+}
+
+// Cut off whatever part of a failed append made it to the journal, as replay
+// stops at the first damaged record and would drop everything after it. If
+// that fails too, the journal is dropped, so the next change reloads and
+// compacts before appending anything more
+func (p *JournalPersistence) discardPartialAppend() {
+	err := p.journal.Truncate(p.size)
+	if err == nil {
+		return
+	}
+	log.Printf("Failed truncating lease journal %v after a failed append: %v", p.journalPath, err)
+	p.journal.Close()
+	p.journal = nil
+	p.unsynced = false
+}
+
+func (p *JournalPersistence) syncLoop(done chan struct{}) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.m.Lock()
+			if err := p.sync(); err != nil {
+				log.Printf("Failed syncing lease journal %v: %v", p.journalPath, err)
+			}
+			p.m.Unlock()
+		case <-done:
+			return
+		}
+	}
+}
+
+// Fsync whatever has been appended since the last sync
+func (p *JournalPersistence) Sync() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.sync()
+}
+
+func (p *JournalPersistence) sync() error {
+	if !p.unsynced || p.journal == nil {
+		return nil
+	}
+	p.unsynced = false
+	return p.journal.Sync()
+}
+
+// Sync anything outstanding and stop the background syncing
+func (p *JournalPersistence) Close() error {
+	p.m.Lock()
+	done := p.done
+	p.done = nil
+	p.m.Unlock()
+
+	if done != nil {
+		close(done)
+		p.wg.Wait()
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.journal == nil {
+		return nil
+	}
+	err := p.sync()
+	if closeErr := p.journal.Close(); err == nil {
+		err = closeErr
+	}
+	p.journal = nil
+	return err
+}
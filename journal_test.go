@@ -0,0 +1,176 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testLease(ip string, mac byte) *Lease {
+	return &Lease{
+		IP:         IpToFixedV4(net.ParseIP(ip)),
+		Mac:        MacAddress{0, 0, 0, 0, 0, mac},
+		Hostname:   "host" + ip,
+		Expiration: time.Now().Add(time.Hour).Round(0).UTC(),
+	}
+}
+
+func TestJournalPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pool.json")
+
+	p := NewJournalPersistence(path)
+	leases, err := p.LoadLeases()
+	require.Nil(t, err)
+	require.Empty(t, leases)
+
+	a, b := testLease("10.0.0.1", 1), testLease("10.0.0.2", 2)
+	require.Nil(t, p.PersistChanges(map[FixedV4]*Lease{a.IP: a, b.IP: b}))
+	require.Nil(t, p.PersistChanges(map[FixedV4]*Lease{a.IP: nil}))
+
+	// Changes are appended, leaving the snapshot alone
+	journal, err := os.ReadFile(path + ".journal")
+	require.Nil(t, err)
+	require.Equal(t, 3, strings.Count(string(journal), "\n"))
+	snapshot, err := NewFilePersistence(path).LoadLeases()
+	require.Nil(t, err)
+	require.Empty(t, snapshot)
+
+	// Even without closing, everything is replayed, and then compacted
+	leases, err = NewJournalPersistence(path).LoadLeases()
+	require.Nil(t, err)
+	require.Equal(t, map[FixedV4]*Lease{b.IP: b}, leases)
+
+	snapshot, err = NewFilePersistence(path).LoadLeases()
+	require.Nil(t, err)
+	require.Equal(t, leases, snapshot)
+	journal, err = os.ReadFile(path + ".journal")
+	require.Nil(t, err)
+	require.Empty(t, journal)
+	require.Nil(t, p.Close())
+}
+
+func TestJournalCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pool.json")
+
+	p := NewJournalPersistence(path)
+	p.CompactAfter = 3
+	p.SyncInterval = 0
+	defer p.Close()
+	_, err := p.LoadLeases()
+	require.Nil(t, err)
+
+	for i := 1; i <= 4; i++ {
+		lease := testLease("10.0.0.1", byte(i))
+		require.Nil(t, p.PersistChanges(map[FixedV4]*Lease{lease.IP: lease}))
+	}
+
+	// Three records went into the snapshot, leaving one in the journal
+	snapshot, err := NewFilePersistence(path).LoadLeases()
+	require.Nil(t, err)
+	require.Equal(t, byte(3), snapshot[IpToFixedV4(net.ParseIP("10.0.0.1"))].Mac[5])
+	journal, err := os.ReadFile(path + ".journal")
+	require.Nil(t, err)
+	require.Equal(t, 1, strings.Count(string(journal), "\n"))
+
+	leases, err := NewJournalPersistence(path).LoadLeases()
+	require.Nil(t, err)
+	require.Equal(t, byte(4), leases[IpToFixedV4(net.ParseIP("10.0.0.1"))].Mac[5])
+}
+
+func TestJournalDamagedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pool.json")
+	journal := `{"IP":"10.0.0.1","Lease":{"Hostname":"a","IP":"10.0.0.1","Mac":"00:00:00:00:00:01","Expiration":"2030-01-01T00:00:00Z"}}
+{"IP":"10.0.0.2","Lease":{"Hostname":"b","IP":"10.0.0.2","Mac":"00:00:00:00:00:02","Expiration":"2030-01-01T00:00:00Z"}}
+{"IP":"10.0.0.1"}
+{"IP":"10.0.0.2","Lea`
+	require.Nil(t, os.WriteFile(path+".journal", []byte(journal), 0644))
+
+	p := NewJournalPersistence(path)
+	defer p.Close()
+	leases, err := p.LoadLeases()
+	require.Nil(t, err)
+	require.Len(t, leases, 1)
+	require.Equal(t, "b", leases[IpToFixedV4(net.ParseIP("10.0.0.2"))].Hostname)
+}
+
+func TestPoolJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pool.json")
+	newPool := func() *Pool {
+		pool := NewPool()
+		pool.Start = net.ParseIP("10.0.0.10")
+		pool.End = net.ParseIP("10.0.0.20")
+		pool.LeaseTime = time.Hour
+		pool.Persistence = NewJournalPersistence(path)
+		_, err := pool.LoadLeases()
+		require.Nil(t, err)
+		return pool
+	}
+
+	pool := newPool()
+	for i := 1; i <= 3; i++ {
+		_, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, byte(i)}, "")
+		require.Nil(t, err)
+	}
+	pool.ReleaseLeaseByMac(MacAddress{0, 0, 0, 0, 0, 2})
+	pool.TouchLeaseByMacWithParams(MacAddress{0, 0, 0, 0, 0, 3}, LeaseParams{LeaseTime: time.Hour, FQDN: "three.example.com"})
+	require.Nil(t, pool.Persistence.(*JournalPersistence).Close())
+
+	pool = newPool()
+	require.Len(t, pool.leaseByIp, 2)
+	lease, ok := pool.TouchLeaseByMac(MacAddress{0, 0, 0, 0, 0, 3})
+	require.True(t, ok)
+	require.Equal(t, "three.example.com", lease.FQDN)
+	_, ok = pool.TouchLeaseByMac(MacAddress{0, 0, 0, 0, 0, 2})
+	require.False(t, ok)
+}
+
+func TestJournalFailedAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pool.json")
+
+	p := NewJournalPersistence(path)
+	p.CompactAfter = 0
+	p.SyncInterval = 0
+	defer p.Close()
+	_, err := p.LoadLeases()
+	require.Nil(t, err)
+
+	a, b, c := testLease("10.0.0.1", 1), testLease("10.0.0.2", 2), testLease("10.0.0.3", 3)
+	require.Nil(t, p.PersistChanges(map[FixedV4]*Lease{a.IP: a}))
+
+	// Half a record made it out before the append failed
+	f, err := os.OpenFile(path+".journal", os.O_WRONLY|os.O_APPEND, 0644)
+	require.Nil(t, err)
+	_, err = f.WriteString(`{"IP":"10.0.0.2","Lea`)
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+	p.m.Lock()
+	p.discardPartialAppend()
+	p.m.Unlock()
+
+	// so it must not hide the records appended after it
+	require.Nil(t, p.PersistChanges(map[FixedV4]*Lease{b.IP: b}))
+	leases, err := NewJournalPersistence(path).LoadLeases()
+	require.Nil(t, err)
+	require.Equal(t, map[FixedV4]*Lease{a.IP: a, b.IP: b}, leases)
+
+	// When the journal can't be written at all, it's dropped and the next
+	// change starts over from what's on disk
+	readOnly, err := os.Open(path + ".journal")
+	require.Nil(t, err)
+	p.m.Lock()
+	p.journal.Close()
+	p.journal = readOnly
+	p.m.Unlock()
+	require.NotNil(t, p.PersistChanges(map[FixedV4]*Lease{c.IP: c}))
+	require.Nil(t, p.journal)
+
+	require.Nil(t, p.PersistChanges(map[FixedV4]*Lease{c.IP: c}))
+	leases, err = NewJournalPersistence(path).LoadLeases()
+	require.Nil(t, err)
+	require.Equal(t, map[FixedV4]*Lease{a.IP: a, b.IP: b, c.IP: c}, leases)
+}
@@ -0,0 +1,155 @@
+// Reading and writing Kea's memfile lease CSV format
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Columns we write, being Kea's DHCPv4 memfile schema 2.0. Later versions
+// of Kea upgrade it as they load it
+var keaColumns = []string{
+	"address", "hwaddr", "client_id", "valid_lifetime", "expire", "subnet_id",
+	"fqdn_fwd", "fqdn_rev", "hostname", "state", "user_context",
+}
+
+// Kea's valid lifetime for leases which never end
+const keaInfiniteLifetime = 0xffffffff
+
+// Kea escapes commas in text fields, as it doesn't quote them
+func keaUnescape(s string) string {
+	return strings.ReplaceAll(s, "&#x2c", ",")
+}
+
+func keaEscape(s string) string {
+	return strings.ReplaceAll(s, ",", "&#x2c")
+}
+
+// Read the leases of a Kea DHCPv4 memfile. The file is appended to, so later
+// rows for an address replace earlier ones, and deleted leases are written
+// with no lifetime. Only leases in the default (assigned) state are kept
+func ReadKeaLeases(r io.Reader) ([]*Lease, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return []*Lease{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range []string{"address", "hwaddr", "valid_lifetime", "expire"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("Kea lease file has no %v column", name)
+		}
+	}
+
+	byIp := map[FixedV4]*Lease{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		field := func(name string) string {
+			i, ok := columns[name]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return record[i]
+		}
+
+		ip := net.ParseIP(field("address")).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("Line %v: invalid address '%v'", line, field("address"))
+		}
+		lifetime, err := strconv.ParseUint(field("valid_lifetime"), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Line %v: invalid valid_lifetime '%v'", line, field("valid_lifetime"))
+		}
+		expire, err := strconv.ParseInt(field("expire"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Line %v: invalid expire '%v'", line, field("expire"))
+		}
+
+		fixed := IpToFixedV4(ip)
+		if lifetime == 0 || (field("state") != "" && field("state") != "0") {
+			delete(byIp, fixed)
+			continue
+		}
+		mac, err := net.ParseMAC(field("hwaddr"))
+		if err != nil || len(mac) != 6 {
+			// Leases of clients without a usable MAC can't be carried over
+			delete(byIp, fixed)
+			continue
+		}
+
+		lease := &Lease{IP: fixed, Expiration: time.Unix(expire, 0).UTC()}
+		copy(lease.Mac[:], mac)
+		if lifetime == keaInfiniteLifetime {
+			lease.Expiration = leaseNever
+		}
+		lease.Hostname, lease.FQDN = importedHostname(keaUnescape(field("hostname")))
+		byIp[fixed] = lease
+	}
+
+	leases := []*Lease{}
+	for _, lease := range byIp {
+		leases = append(leases, lease)
+	}
+	sortLeases(leases)
+	return leases, nil
+}
+
+// Write leases as a Kea DHCPv4 memfile, all in params.SubnetID. Kea only
+// stores hostnames, so DNS updates are recorded as not done
+func WriteKeaLeases(w io.Writer, leases []*Lease, params LeaseExportParams) error {
+	if params.LeaseTime <= 0 {
+		return errors.New("Kea leases need a lease time")
+	}
+	writer := csv.NewWriter(w)
+	if err := writer.Write(keaColumns); err != nil {
+		return err
+	}
+
+	for _, lease := range leases {
+		lifetime := uint64(params.LeaseTime / time.Second)
+		expire := lease.Expiration.Unix()
+		if !lease.Expiration.Before(leaseNever) {
+			lifetime = keaInfiniteLifetime
+		}
+		err := writer.Write([]string{
+			lease.IP.String(),
+			net.HardwareAddr(lease.Mac[:]).String(),
+			"",
+			strconv.FormatUint(lifetime, 10),
+			strconv.FormatInt(expire, 10),
+			strconv.FormatUint(uint64(params.SubnetID), 10),
+			"0",
+			"0",
+			keaEscape(exportedHostname(lease)),
+			"0",
+			"",
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
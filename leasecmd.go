@@ -0,0 +1,308 @@
+// import and export subcommands, for carrying leases over from and to other
+// DHCP servers
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A lease file format, of another server or our own
+type LeaseFormat struct {
+	Read  func(r io.Reader) ([]*Lease, error)
+	Write func(w io.Writer, leases []*Lease, params LeaseExportParams) error
+}
+
+// What some formats record about leases which we don't. LeaseTime is taken
+// to be how long leases ran, to work out when they started, and SubnetID is
+// the Kea subnet they belong to
+type LeaseExportParams struct {
+	LeaseTime time.Duration
+	SubnetID  uint32
+}
+
+// Expiration of imported leases which never end, and exported as such. Well
+// before 2262, past which expirations can't be kept as nanoseconds
+var leaseNever = time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var leaseFormats = map[string]LeaseFormat{
+	"isc":     {ReadIscLeases, WriteIscLeases},
+	"dnsmasq": {ReadDnsmasqLeases, WriteDnsmasqLeases},
+	"kea":     {ReadKeaLeases, WriteKeaLeases},
+	"json":    {ReadJsonLeases, WriteJsonLeases},
+}
+
+// Our own lease file format, as written by FilePersistence
+func ReadJsonLeases(r io.Reader) ([]*Lease, error) {
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	fromFile, err := unmarshalLeaseFile(contents)
+	if err != nil {
+		return nil, err
+	}
+	leases := []*Lease{}
+	for _, lease := range (&FilePersistence{}).decode(fromFile) {
+		leases = append(leases, lease)
+	}
+	sortLeases(leases)
+	return leases, nil
+}
+
+func WriteJsonLeases(w io.Writer, leases []*Lease, params LeaseExportParams) error {
+	byIp := map[FixedV4]*Lease{}
+	for _, lease := range leases {
+		byIp[lease.IP] = lease
+	}
+	payload, err := marshalLeaseFile((&FilePersistence{}).encode(byIp))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(payload, '\n'))
+	return err
+}
+
+func leaseFormatNames() string {
+	names := []string{}
+	for name := range leaseFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Run a subcommand if one is given, returning false if not
+func runLeaseCommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	switch args[0] {
+	case "import":
+		return true, importLeasesCommand(args[1:])
+	case "export":
+		return true, exportLeasesCommand(args[1:])
+	case "convert":
+		return true, convertLeasesCommand(args[1:])
+	}
+	return false, nil
+}
+
+func lookupLeaseFormat(name string) (LeaseFormat, error) {
+	format, ok := leaseFormats[name]
+	if !ok {
+		return LeaseFormat{}, fmt.Errorf("Unknown lease format '%v', expected one of %v", name, leaseFormatNames())
+	}
+	return format, nil
+}
+
+type leaseCommand struct {
+	flags    *flag.FlagSet
+	conf     *string
+	pool     *string
+	format   *string
+	subnetID *uint
+}
+
+func newLeaseCommand(name string) *leaseCommand {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	return &leaseCommand{
+		flags:    flags,
+		conf:     flags.String("conf", "", "Path to configuration yaml file"),
+		pool:     flags.String("pool", "", "Name of the pool"),
+		format:   flags.String("format", "isc", "Lease file format: "+leaseFormatNames()),
+		subnetID: flags.Uint("subnet-id", 1, "Kea subnet ID of exported leases"),
+	}
+}
+
+// Parse arguments, returning the pool's conf and persistence, the format and
+// the file argument, if any
+func (c *leaseCommand) parse(args []string) (*Conf, *Pool, LeaseFormat, string, error) {
+	if err := c.flags.Parse(args); err != nil {
+		return nil, nil, LeaseFormat{}, "", err
+	}
+	if *c.conf == "" || *c.pool == "" {
+		return nil, nil, LeaseFormat{}, "", errors.New("-conf and -pool are required")
+	}
+	if c.flags.NArg() > 1 {
+		return nil, nil, LeaseFormat{}, "", errors.New("Only one lease file may be given")
+	}
+
+	format, err := lookupLeaseFormat(*c.format)
+	if err != nil {
+		return nil, nil, LeaseFormat{}, "", err
+	}
+
+	conf, err := ParseConf(*c.conf)
+	if err != nil {
+		return nil, nil, LeaseFormat{}, "", err
+	}
+	for _, pc := range conf.Pools {
+		if pc.Name != *c.pool {
+			continue
+		}
+		pool, err := pc.ToPool()
+		if err != nil {
+			return nil, nil, LeaseFormat{}, "", err
+		}
+		pool.Persistence, err = NewPersistence(conf, pool.Name)
+		if err != nil {
+			return nil, nil, LeaseFormat{}, "", err
+		}
+		return conf, pool, format, c.flags.Arg(0), nil
+	}
+	return nil, nil, LeaseFormat{}, "", fmt.Errorf("No pool named '%v'", *c.pool)
+}
+
+func closePersistence(p Persistence) {
+	if closer, ok := p.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// Add leases from another server's lease file to a pool's. Imported leases
+// replace any we have for the same address or MAC. The server should be
+// stopped first, as it would otherwise overwrite them
+func importLeasesCommand(args []string) error {
+	_, pool, format, path, err := newLeaseCommand("import").parse(args)
+	if err != nil {
+		return err
+	}
+	defer closePersistence(pool.Persistence)
+
+	imported, err := readLeaseFile(path, format)
+	if err != nil {
+		return err
+	}
+
+	leases, err := pool.Persistence.LoadLeases()
+	if err != nil {
+		return err
+	}
+	added := ImportLeases(pool, leases, imported, time.Now())
+	if err := pool.Persistence.PersistLeases(leases); err != nil {
+		return err
+	}
+	log.Printf("Imported %v of %v leases into pool %v", added, len(imported), pool.Name)
+	return nil
+}
+
+// Merge imported leases into leases, skipping expired ones and those outside
+// the pool's network. Returns how many were added
+func ImportLeases(pool *Pool, leases map[FixedV4]*Lease, imported []*Lease, now time.Time) int {
+	checkNetwork := pool.Network.To4() != nil && pool.Netmask.To4() != nil
+	var network, mask FixedV4
+	if checkNetwork {
+		network, mask = IpToFixedV4(pool.Network), IpToFixedV4(pool.Netmask)
+	}
+
+	added := 0
+	for _, lease := range imported {
+		if !lease.Expiration.After(now) {
+			continue
+		}
+		if checkNetwork && lease.IP&mask != network&mask {
+			log.Printf("Skipping lease for %v as it's outside pool %v", lease.IP.String(), pool.Name)
+			continue
+		}
+		for ip, existing := range leases {
+			if existing.Mac == lease.Mac {
+				delete(leases, ip)
+			}
+		}
+		leases[lease.IP] = lease
+		added++
+	}
+	return added
+}
+
+// Write a pool's leases in another server's format
+func exportLeasesCommand(args []string) error {
+	command := newLeaseCommand("export")
+	_, pool, format, path, err := command.parse(args)
+	if err != nil {
+		return err
+	}
+	defer closePersistence(pool.Persistence)
+
+	leases, err := pool.Persistence.LoadLeases()
+	if err != nil {
+		return err
+	}
+	sorted := []*Lease{}
+	for _, lease := range leases {
+		sorted = append(sorted, lease)
+	}
+	sortLeases(sorted)
+
+	params := LeaseExportParams{LeaseTime: pool.LeaseTime, SubnetID: uint32(*command.subnetID)}
+	return writeLeaseFile(path, format, sorted, params)
+}
+
+// Write leases to path, or stdout if it's empty or -
+func writeLeaseFile(path string, format LeaseFormat, leases []*Lease, params LeaseExportParams) error {
+	if path == "" || path == "-" {
+		return format.Write(os.Stdout, leases, params)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := format.Write(f, leases, params); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Read leases from path, or stdin if it's empty or -
+func readLeaseFile(path string, format LeaseFormat) ([]*Lease, error) {
+	if path == "" || path == "-" {
+		return format.Read(os.Stdin)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return format.Read(f)
+}
+
+// Convert between lease file formats without touching any pool, eg from
+// dnsmasq.leases to our own json lease file
+func convertLeasesCommand(args []string) error {
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	from := flags.String("from", "", "Format to convert from: "+leaseFormatNames())
+	to := flags.String("to", "json", "Format to convert to: "+leaseFormatNames())
+	leaseTime := flags.Duration("leasetime", 24*time.Hour, "Lease time, for formats recording when leases started")
+	subnetID := flags.Uint("subnet-id", 1, "Kea subnet ID of converted leases")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 2 {
+		return errors.New("Expected at most an input and an output file")
+	}
+
+	fromFormat, err := lookupLeaseFormat(*from)
+	if err != nil {
+		return err
+	}
+	toFormat, err := lookupLeaseFormat(*to)
+	if err != nil {
+		return err
+	}
+
+	leases, err := readLeaseFile(flags.Arg(0), fromFormat)
+	if err != nil {
+		return err
+	}
+	params := LeaseExportParams{LeaseTime: *leaseTime, SubnetID: uint32(*subnetID)}
+	return writeLeaseFile(flags.Arg(1), toFormat, leases, params)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Leases common to the dnsmasq and Kea fixtures
+func expectedFixtureLeases() []*Lease {
+	ip := func(s string) FixedV4 { return IpToFixedV4(net.ParseIP(s)) }
+	expiration := time.Unix(1893553445, 0).UTC()
+	return []*Lease{
+		{IP: ip("192.168.1.10"), Mac: StrToMac("52:54:0:12:34:56"), Hostname: "laptop", Expiration: expiration},
+		{IP: ip("192.168.1.11"), Mac: StrToMac("52:54:0:ab:cd:ef"), Expiration: leaseNever},
+		{IP: ip("192.168.1.13"), Mac: StrToMac("52:54:0:0:0:13"), Hostname: "printer", FQDN: "printer.example.com", Expiration: expiration},
+	}
+}
+
+func readFixture(t *testing.T, path string, format LeaseFormat) []*Lease {
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	defer f.Close()
+	leases, err := format.Read(f)
+	require.Nil(t, err)
+	return leases
+}
+
+// Convert leases to our json and back, checking nothing is lost on the way
+func requireRoundTrip(t *testing.T, format LeaseFormat, leases []*Lease) []byte {
+	params := LeaseExportParams{LeaseTime: 24 * time.Hour, SubnetID: 1}
+
+	var out bytes.Buffer
+	require.Nil(t, format.Write(&out, leases, params))
+	written := out.Bytes()
+
+	var json bytes.Buffer
+	read, err := format.Read(bytes.NewReader(written))
+	require.Nil(t, err)
+	require.Equal(t, leases, read)
+	require.Nil(t, WriteJsonLeases(&json, read, params))
+
+	fromJson, err := ReadJsonLeases(&json)
+	require.Nil(t, err)
+	require.Equal(t, leases, fromJson)
+
+	out.Reset()
+	require.Nil(t, format.Write(&out, fromJson, params))
+	require.Equal(t, string(written), out.String())
+	return written
+}
+
+func TestDnsmasqLeases(t *testing.T) {
+	leases := readFixture(t, "testdata/dnsmasq.leases", leaseFormats["dnsmasq"])
+	require.Equal(t, expectedFixtureLeases(), leases)
+
+	written := requireRoundTrip(t, leaseFormats["dnsmasq"], leases)
+	require.Equal(t, `1893553445 52:54:00:12:34:56 192.168.1.10 laptop *
+0 52:54:00:ab:cd:ef 192.168.1.11 * *
+1893553445 52:54:00:00:00:13 192.168.1.13 printer.example.com *
+`, string(written))
+
+	_, err := ReadDnsmasqLeases(strings.NewReader("soon 52:54:00:12:34:56 192.168.1.10 * *\n"))
+	require.NotNil(t, err)
+	_, err = ReadDnsmasqLeases(strings.NewReader("0 52:54:00:12:34:56 192.168.1.10\n"))
+	require.NotNil(t, err)
+}
+
+func TestKeaLeases(t *testing.T) {
+	leases := readFixture(t, "testdata/kea-leases4.csv", leaseFormats["kea"])
+	require.Equal(t, expectedFixtureLeases(), leases)
+
+	written := requireRoundTrip(t, leaseFormats["kea"], leases)
+	lines := strings.Split(string(written), "\n")
+	require.Equal(t, strings.Join(keaColumns, ","), lines[0])
+	require.Equal(t, "192.168.1.10,52:54:00:12:34:56,,86400,1893553445,1,0,0,laptop,0,", lines[1])
+	require.Equal(t, "192.168.1.11,52:54:00:ab:cd:ef,,4294967295,7258118400,1,0,0,,0,", lines[2])
+
+	// Older schemas have fewer columns
+	leases, err := ReadKeaLeases(strings.NewReader("address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev\n" +
+		"10.0.0.1,52:54:00:12:34:56,,3600,1893553445,1,0,0\n"))
+	require.Nil(t, err)
+	require.Len(t, leases, 1)
+
+	var buf bytes.Buffer
+	require.Nil(t, WriteKeaLeases(&buf, []*Lease{{Hostname: "a,b", Expiration: time.Unix(1, 0)}}, LeaseExportParams{LeaseTime: time.Hour}))
+	require.Contains(t, buf.String(), ",a&#x2cb,")
+
+	_, err = ReadKeaLeases(strings.NewReader("address,hwaddr\n10.0.0.1,52:54:00:12:34:56\n"))
+	require.NotNil(t, err)
+}
+
+func TestConvertLeases(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "lan.json")
+	keaPath := filepath.Join(dir, "leases4.csv")
+
+	ran, err := runLeaseCommand([]string{"convert", "-from", "dnsmasq", "testdata/dnsmasq.leases", jsonPath})
+	require.True(t, ran)
+	require.Nil(t, err)
+
+	// The result is a lease file we can load
+	leases, err := NewFilePersistence(jsonPath).LoadLeases()
+	require.Nil(t, err)
+	require.Len(t, leases, 3)
+
+	_, err = runLeaseCommand([]string{"convert", "-from", "json", "-to", "kea", "-leasetime", "1h", jsonPath, keaPath})
+	require.Nil(t, err)
+	require.Equal(t, expectedFixtureLeases(), readFixture(t, keaPath, leaseFormats["kea"]))
+
+	_, err = runLeaseCommand([]string{"convert", "-from", "csv", jsonPath})
+	require.NotNil(t, err)
+}
@@ -0,0 +1,203 @@
+// Background writing of lease changes, so disk latency stays off the packet
+// path. Changes made while the writer sleeps are coalesced into one save
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	defaultPersistInterval = time.Second
+	defaultPersistMaxDirty = 256
+)
+
+type Durability int
+
+const (
+	// Changes are saved by the writer only
+	DURABILITY_ASYNC Durability = iota
+
+	// New bindings are saved before they're acknowledged, while renewals
+	// and everything else are left to the writer
+	DURABILITY_ACK
+
+	// Every change is saved before the pool call making it returns, and
+	// any which failed to save are retried before acknowledging the lease
+	DURABILITY_SYNC
+)
+
+func ParseDurability(name string) (Durability, error) {
+	switch name {
+	case "async":
+		return DURABILITY_ASYNC, nil
+	case "", "ack":
+		return DURABILITY_ACK, nil
+	case "sync":
+		return DURABILITY_SYNC, nil
+	}
+	return 0, fmt.Errorf("Unknown durability '%v'", name)
+}
+
+// Start saving lease changes in the background, every PersistInterval or
+// once PersistMaxDirty leases have changed. Does nothing for synchronous
+// durability
+func (p *Pool) StartWriter() {
+	p.m.Lock()
+	if p.writerDone != nil || p.Durability == DURABILITY_SYNC || p.Persistence == nil {
+		p.m.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	kick := make(chan struct{}, 1)
+	p.writerDone = done
+	p.writerKick = kick
+	interval := p.PersistInterval
+	if interval <= 0 {
+		interval = defaultPersistInterval
+	}
+	p.m.Unlock()
+
+	p.writerWg.Add(1)
+	go func() {
+		defer p.writerWg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-kick:
+			case <-done:
+				return
+			}
+			if err := p.Flush(); err != nil {
+				log.Printf("Failed persisting leases for pool %v: %v", p.Name, err)
+			}
+		}
+	}()
+}
+
+// Stop the writer, saving anything outstanding
+func (p *Pool) StopWriter() error {
+	p.m.Lock()
+	done := p.writerDone
+	p.writerDone = nil
+	p.m.Unlock()
+
+	if done != nil {
+		close(done)
+		p.writerWg.Wait()
+	}
+	return p.Flush()
+}
+
+func (p *Pool) maxDirty() int {
+	if p.PersistMaxDirty > 0 {
+		return p.PersistMaxDirty
+	}
+	return defaultPersistMaxDirty
+}
+
+// Wake the writer without waiting for it. Must be called with the pool
+// locked
+func (p *Pool) kickWriter() {
+	select {
+	case p.writerKick <- struct{}{}:
+	default:
+	}
+}
+
+// Make sure a lease is on disk before acknowledging it, if durability calls
+// for that. Under ack durability that's new bindings, with renewals left to
+// the writer, and under sync durability any change to the lease, in case
+// saving it when it was made failed. Either way, persistence which buffers
+// writes is synced before returning
+func (p *Pool) Commit(lease *Lease) error {
+	if p.Durability == DURABILITY_ASYNC || p.Persistence == nil {
+		return nil
+	}
+
+	p.m.RLock()
+	bound, unsaved := p.changed[lease.IP]
+	p.m.RUnlock()
+
+	switch {
+	case bound, p.Durability == DURABILITY_SYNC && unsaved:
+		if err := p.Flush(); err != nil {
+			return err
+		}
+	case p.Durability == DURABILITY_ACK:
+		return nil
+	}
+
+	if syncer, ok := p.Persistence.(SyncingPersistence); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// Save every outstanding lease change. Must be called without the pool
+// locked, as the save itself happens outside of it
+func (p *Pool) Flush() error {
+	if p.Persistence == nil {
+		return nil
+	}
+
+	p.flushM.Lock()
+	defer p.flushM.Unlock()
+
+	p.m.Lock()
+	changed, save := p.takeChanges()
+	p.m.Unlock()
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	err := save()
+	if err != nil {
+		p.m.Lock()
+		p.requeue(changed)
+		p.m.Unlock()
+	}
+	return err
+}
+
+// Keep changes which failed to save for the next attempt, unless they
+// changed again since. Must be called with the pool locked
+func (p *Pool) requeue(changed map[FixedV4]bool) {
+	for ip, bound := range changed {
+		if _, ok := p.changed[ip]; !ok {
+			p.changed[ip] = bound
+		}
+	}
+}
+
+// Take the outstanding changes, returning them and a function which saves
+// copies of the affected leases, so it can be called after unlocking. Must
+// be called with the pool locked
+func (p *Pool) takeChanges() (map[FixedV4]bool, func() error) {
+	changed := p.changed
+	p.changed = map[FixedV4]bool{}
+
+	if journal, ok := p.Persistence.(IncrementalPersistence); ok {
+		leases := make(map[FixedV4]*Lease, len(changed))
+		for ip := range changed {
+			if lease, ok := p.leaseByIp[ip]; ok {
+				copied := *lease
+				leases[ip] = &copied
+			} else {
+				leases[ip] = nil
+			}
+		}
+		return changed, func() error { return journal.PersistChanges(leases) }
+	}
+
+	leases := make(map[FixedV4]*Lease, len(p.leaseByIp))
+	for ip, lease := range p.leaseByIp {
+		copied := *lease
+		leases[ip] = &copied
+	}
+	return changed, func() error { return p.Persistence.PersistLeases(leases) }
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func newWriterTestPool(durability Durability) (*Pool, *testPersistence) {
+	pool := NewPool()
+	pool.Start = net.ParseIP("10.0.0.10")
+	pool.End = net.ParseIP("10.0.0.20")
+	pool.LeaseTime = time.Hour
+	persistence := &testPersistence{}
+	pool.Persistence = persistence
+	pool.Durability = durability
+	pool.PersistInterval = time.Hour
+	return pool, persistence
+}
+
+func (p *testPersistence) saved() (int, int) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.saves, len(p.leases)
+}
+
+func TestLeaseWriter(t *testing.T) {
+	pool, persistence := newWriterTestPool(DURABILITY_ASYNC)
+	pool.PersistMaxDirty = 3
+	pool.StartWriter()
+
+	// Changes wait for the writer
+	for i := 1; i <= 2; i++ {
+		_, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, byte(i)}, "")
+		require.Nil(t, err)
+	}
+	saves, _ := persistence.saved()
+	require.Zero(t, saves)
+
+	// Until enough pile up, when they're saved together
+	_, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 3}, "")
+	require.Nil(t, err)
+	require.Eventually(t, func() bool {
+		saves, leases := persistence.saved()
+		return saves == 1 && leases == 3
+	}, time.Second*5, time.Millisecond)
+
+	// And stopping saves whatever is left
+	pool.ReleaseLeaseByMac(MacAddress{0, 0, 0, 0, 0, 1})
+	require.Nil(t, pool.StopWriter())
+	saves, leases := persistence.saved()
+	require.Equal(t, 2, saves)
+	require.Equal(t, 2, leases)
+
+	// With nothing outstanding, there's nothing to save
+	require.Nil(t, pool.Flush())
+	saves, _ = persistence.saved()
+	require.Equal(t, 2, saves)
+}
+
+func TestLeaseWriterInterval(t *testing.T) {
+	pool, persistence := newWriterTestPool(DURABILITY_ASYNC)
+	pool.PersistInterval = time.Millisecond * 10
+	pool.StartWriter()
+	defer pool.StopWriter()
+
+	_, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 1}, "")
+	require.Nil(t, err)
+	require.Eventually(t, func() bool {
+		_, leases := persistence.saved()
+		return leases == 1
+	}, time.Second*5, time.Millisecond)
+}
+
+func TestDurability(t *testing.T) {
+	pool, persistence := newWriterTestPool(DURABILITY_ACK)
+	pool.StartWriter()
+	defer pool.StopWriter()
+
+	// New bindings are saved, and synced, before being acknowledged
+	mac := MacAddress{0, 0, 0, 0, 0, 1}
+	lease, err := pool.GetNextLease(mac, "")
+	require.Nil(t, err)
+	require.Nil(t, pool.Commit(lease))
+	saves, leases := persistence.saved()
+	require.Equal(t, 1, saves)
+	require.Equal(t, 1, leases)
+	require.Equal(t, 1, persistence.syncs)
+
+	// But renewals aren't
+	lease, _ = pool.TouchLeaseByMac(mac)
+	require.Nil(t, pool.Commit(lease))
+	saves, _ = persistence.saved()
+	require.Equal(t, 1, saves)
+
+	// Nor anything without ack durability
+	pool.Durability = DURABILITY_ASYNC
+	lease, err = pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 2}, "")
+	require.Nil(t, err)
+	require.Nil(t, pool.Commit(lease))
+	saves, _ = persistence.saved()
+	require.Equal(t, 1, saves)
+
+	// Synchronous pools have no writer and save every change
+	pool, persistence = newWriterTestPool(DURABILITY_SYNC)
+	pool.StartWriter()
+	_, err = pool.GetNextLease(mac, "")
+	require.Nil(t, err)
+	saves, _ = persistence.saved()
+	require.Equal(t, 1, saves)
+}
+
+func TestParseDurability(t *testing.T) {
+	for name, expected := range map[string]Durability{
+		"":      DURABILITY_ACK,
+		"ack":   DURABILITY_ACK,
+		"async": DURABILITY_ASYNC,
+		"sync":  DURABILITY_SYNC,
+	} {
+		durability, err := ParseDurability(name)
+		require.Nil(t, err)
+		require.Equal(t, expected, durability)
+	}
+	_, err := ParseDurability("eventually")
+	require.NotNil(t, err)
+}
+
+func TestDurabilityFailedCommit(t *testing.T) {
+	pool, persistence := newWriterTestPool(DURABILITY_ACK)
+	pool.Netmask = net.ParseIP("255.255.255.0")
+	pool.MyIp = IpToFixedV4(net.ParseIP("10.0.0.254"))
+	persistence.err = errors.New("disk full")
+	pool.StartWriter()
+	defer pool.StopWriter()
+
+	mac := MacAddress{0, 0, 0, 0, 0, 1}
+	lease, err := pool.GetNextLease(mac, "")
+	require.Nil(t, err)
+
+	request := NewDhcpMessage()
+	request.Header.Mac = mac
+	request.Header.ClientAddr = lease.IP
+	request.Options.Set(OPTION_MESSAGE_TYPE, []byte{DHCPREQUEST})
+
+	// A binding we failed to save isn't acknowledged
+	response := NewRequestHandler(request, pool).Handle()
+	require.Equal(t, DHCPNAK, response.Options.GetByte(OPTION_MESSAGE_TYPE))
+
+	// and is once saving works again
+	persistence.m.Lock()
+	persistence.err = nil
+	persistence.m.Unlock()
+	response = NewRequestHandler(request, pool).Handle()
+	require.Equal(t, DHCPACK, response.Options.GetByte(OPTION_MESSAGE_TYPE))
+	_, leases := persistence.saved()
+	require.Equal(t, 1, leases)
+}
+
+func TestSyncDurabilityFailedSave(t *testing.T) {
+	pool, persistence := newWriterTestPool(DURABILITY_SYNC)
+	persistence.err = errors.New("disk full")
+
+	// The save failing when the lease is bound stops it being acknowledged
+	lease, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 1}, "")
+	require.Nil(t, err)
+	require.NotNil(t, pool.Commit(lease))
+
+	// and it's kept for the next attempt rather than lost
+	persistence.m.Lock()
+	persistence.err = nil
+	persistence.m.Unlock()
+	require.Nil(t, pool.Commit(lease))
+	saves, leases := persistence.saved()
+	require.Equal(t, 1, saves)
+	require.Equal(t, 1, leases)
+
+	// Saved changes still get synced before being acknowledged
+	lease, _ = pool.TouchLeaseByMac(lease.Mac)
+	require.Nil(t, pool.Commit(lease))
+	saves, _ = persistence.saved()
+	require.Equal(t, 2, saves)
+	require.Equal(t, 2, persistence.syncs)
+}
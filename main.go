@@ -4,6 +4,9 @@ import (
 	"flag"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -16,6 +19,13 @@ func getConfPath() string {
 func main() {
 	var err error
 
+	if ran, err := runLeaseCommand(os.Args[1:]); ran {
+		if err != nil {
+			log.Fatalf("%v failed: %v", os.Args[1], err)
+		}
+		return
+	}
+
 	confPath := getConfPath()
 
 	if confPath == "" {
@@ -35,6 +45,35 @@ func main() {
 		log.Fatalf("Failed initializing: %v", err)
 	}
 
+	// Save outstanding lease changes before exiting
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, shutting down", sig)
+		app.Shutdown()
+		os.Exit(0)
+	}()
+
+	if conf.Tftp.Enabled {
+		tftp, err := NewTftpServer(conf.Tftp.Root)
+		if err != nil {
+			log.Fatalf("Failed initializing tftp: %v", err)
+		}
+		go func() {
+			log.Fatalf("TFTP server failed: %v", tftp.ListenAndServe(conf.Tftp.Listen))
+		}()
+	}
+
+	if conf.DnsServer.Enabled {
+		dns := NewDnsServer(app.Pools, conf.DnsServer.Domain, conf.DnsServer.Upstreams)
+		dns.TTL = conf.DnsServer.TTL
+		dns.MaxConcurrentQueries = conf.DnsServer.MaxConcurrentQueries
+		go func() {
+			log.Fatalf("DNS server failed: %v", dns.ListenAndServe(conf.DnsServer.Listen))
+		}()
+	}
+
 	addr := net.UDPAddr{
 		Port: 67,
 		IP:   net.ParseIP("0.0.0.0"),
@@ -0,0 +1,205 @@
+// Helpers for encoding arbitrary options sourced from configuration
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Arbitrary option, as it appears in yaml. Either Name (from nameToOption)
+// or Code must be given. Type decides how Value gets encoded:
+//
+//	ip, ips        one or a list of IPv4 addresses
+//	string         raw string
+//	uint8, uint16, uint32, int32
+//	bool           single byte 0 or 1
+//	hex            raw bytes, eg "01:02:ff" or "0102ff"
+//	suboptions     nested SubOptions, given by code, instead of Value
+type OptionConf struct {
+	Name       string       `yaml:"name"`
+	Code       int          `yaml:"code"`
+	Type       string       `yaml:"type"`
+	Value      interface{}  `yaml:"value"`
+	SubOptions []OptionConf `yaml:"suboptions"`
+}
+
+// Option ready to be set on a response
+type ConfiguredOption struct {
+	Code byte
+	Data []byte
+}
+
+func (oc OptionConf) ToOption() (ConfiguredOption, error) {
+	var result ConfiguredOption
+
+	code, err := oc.code()
+	if err != nil {
+		return result, err
+	}
+
+	var data []byte
+	if oc.Type == "suboptions" {
+		data, err = encodeSubOptionConfs(oc.SubOptions)
+	} else {
+		data, err = encodeOptionValue(oc.Type, oc.Value)
+	}
+	if err != nil {
+		return result, fmt.Errorf("Option %v: %v", code, err)
+	}
+
+	if len(data) > 255 {
+		return result, fmt.Errorf("Option %v: value too long", code)
+	}
+
+	result.Code = code
+	result.Data = data
+	return result, nil
+}
+
+func (oc OptionConf) code() (byte, error) {
+	if oc.Name != "" {
+		code, ok := nameToOption[oc.Name]
+		if !ok {
+			return 0, fmt.Errorf("Unknown option name %v", oc.Name)
+		}
+		return code, nil
+	}
+	if oc.Code <= int(OPTION_PADDING) || oc.Code >= int(OPTION_SENTINEL) {
+		return 0, fmt.Errorf("Invalid option code %v", oc.Code)
+	}
+	return byte(oc.Code), nil
+}
+
+func ToOptions(confs []OptionConf) ([]ConfiguredOption, error) {
+	result := make([]ConfiguredOption, 0, len(confs))
+	for _, oc := range confs {
+		option, err := oc.ToOption()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, option)
+	}
+	return result, nil
+}
+
+// Encode a single yaml value according to its type name
+func encodeOptionValue(kind string, value interface{}) ([]byte, error) {
+	switch kind {
+	case "ip", "ips":
+		data := []byte{}
+		for _, str := range valueToStrings(value) {
+			ip := net.ParseIP(str)
+			if ip == nil || ip.To4() == nil {
+				return nil, fmt.Errorf("Invalid IPv4 address %v", str)
+			}
+			data = append(data, IpToFixedV4(ip).Bytes()...)
+		}
+		if len(data) == 0 {
+			return nil, fmt.Errorf("Missing IP value")
+		}
+		return data, nil
+
+	case "string":
+		return []byte(fmt.Sprint(value)), nil
+
+	case "bool":
+		b, err := strconv.ParseBool(fmt.Sprint(value))
+		if err != nil {
+			return nil, err
+		}
+		if b {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+
+	case "uint8", "uint16", "uint32":
+		bits, _ := strconv.Atoi(strings.TrimPrefix(kind, "uint"))
+		n, err := strconv.ParseUint(fmt.Sprint(value), 10, bits)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, uint32(n))
+		return data[4-bits/8:], nil
+
+	case "int32":
+		n, err := strconv.ParseInt(fmt.Sprint(value), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		return long2bytes(uint32(int32(n))), nil
+
+	case "hex":
+		str := strings.ReplaceAll(fmt.Sprint(value), ":", "")
+		return hex.DecodeString(str)
+	}
+
+	return nil, fmt.Errorf("Unknown option type '%v'", kind)
+}
+
+// yaml gives us either a scalar or a list
+func valueToStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			result = append(result, fmt.Sprint(item))
+		}
+		return result
+	case []string:
+		return v
+	}
+	return []string{fmt.Sprint(value)}
+}
+
+// Vendor specific information (option 43) for clients whose vendor class
+// (option 60) starts with Vendor. Sub-options must be given by code.
+type VendorOptionConf struct {
+	Vendor     string       `yaml:"vendor"`
+	SubOptions []OptionConf `yaml:"suboptions"`
+}
+
+// Encoded option 43 payload for a vendor
+type VendorOptions struct {
+	Vendor string
+	Data   []byte
+}
+
+func (vc VendorOptionConf) ToVendorOptions() (*VendorOptions, error) {
+	if vc.Vendor == "" {
+		return nil, fmt.Errorf("Vendor options need a vendor class to match")
+	}
+
+	data, err := encodeSubOptionConfs(vc.SubOptions)
+	if err != nil {
+		return nil, fmt.Errorf("Vendor %v: %v", vc.Vendor, err)
+	}
+	if len(data) > 255 {
+		return nil, fmt.Errorf("Vendor %v sub-options too long", vc.Vendor)
+	}
+
+	return &VendorOptions{vc.Vendor, data}, nil
+}
+
+// Encode sub-options, which are only addressable by code, as the value of an
+// encapsulating option
+func encodeSubOptionConfs(confs []OptionConf) ([]byte, error) {
+	subOptions := make([]ConfiguredOption, 0, len(confs))
+	for _, oc := range confs {
+		if oc.Name != "" {
+			return nil, fmt.Errorf("Sub-options must use codes rather than names")
+		}
+		sub, err := oc.ToOption()
+		if err != nil {
+			return nil, err
+		}
+		subOptions = append(subOptions, sub)
+	}
+	return EncodeSubOptions(subOptions)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"net"
+	"testing"
+)
+
+func TestOptionConfEncoding(t *testing.T) {
+	cases := []struct {
+		conf     OptionConf
+		code     byte
+		expected []byte
+	}{
+		{OptionConf{Name: "ntp_server", Type: "ips", Value: []interface{}{"10.0.0.1", "10.0.0.2"}}, OPTION_NTP_SERVER, []byte{10, 0, 0, 1, 10, 0, 0, 2}},
+		{OptionConf{Name: "tftp_server", Type: "ip", Value: "10.0.0.5"}, OPTION_TFTP_SERVER, []byte{10, 0, 0, 5}},
+		{OptionConf{Name: "domain_name", Type: "string", Value: "example.com"}, OPTION_DOMAIN_NAME, []byte("example.com")},
+		{OptionConf{Name: "mtu", Type: "uint16", Value: 9000}, OPTION_MTU, []byte{0x23, 0x28}},
+		{OptionConf{Name: "ip_ttl", Type: "uint8", Value: 64}, OPTION_IP_TTL, []byte{64}},
+		{OptionConf{Name: "time_offset", Type: "int32", Value: -3600}, OPTION_TIME_OFFSET, []byte{0xff, 0xff, 0xf1, 0xf0}},
+		{OptionConf{Code: 19, Type: "bool", Value: true}, 19, []byte{1}},
+		{OptionConf{Code: 224, Type: "hex", Value: "de:ad:be:ef"}, 224, []byte{0xde, 0xad, 0xbe, 0xef}},
+	}
+
+	for _, c := range cases {
+		option, err := c.conf.ToOption()
+		require.Nil(t, err)
+		require.Equal(t, c.code, option.Code)
+		require.Equal(t, c.expected, option.Data)
+	}
+
+	invalid := []OptionConf{
+		{Name: "nonsense", Type: "string", Value: "x"},
+		{Code: 0, Type: "string", Value: "x"},
+		{Code: 300, Type: "string", Value: "x"},
+		{Code: 10, Type: "nonsense", Value: "x"},
+		{Code: 10, Type: "ip", Value: "not an ip"},
+		{Code: 10, Type: "uint8", Value: 256},
+		{Code: 10, Type: "hex", Value: "zz"},
+	}
+
+	for _, oc := range invalid {
+		_, err := oc.ToOption()
+		require.NotNil(t, err, oc)
+	}
+}
+
+func TestVendorOptions(t *testing.T) {
+	ubnt, err := VendorOptionConf{
+		Vendor: "ubnt",
+		SubOptions: []OptionConf{
+			{Code: 1, Type: "ip", Value: "10.0.0.2"},
+		},
+	}.ToVendorOptions()
+	require.Nil(t, err)
+	require.Equal(t, []byte{1, 4, 10, 0, 0, 2}, ubnt.Data)
+
+	aruba, err := VendorOptionConf{
+		Vendor: "ArubaAP",
+		SubOptions: []OptionConf{
+			{Code: 1, Type: "string", Value: "10.0.0.3"},
+			{Code: 2, Type: "uint16", Value: 4343},
+		},
+	}.ToVendorOptions()
+	require.Nil(t, err)
+
+	subOptions, err := ParseSubOptions(aruba.Data)
+	require.Nil(t, err)
+	require.Equal(t, map[byte][]byte{1: []byte("10.0.0.3"), 2: {0x10, 0xf7}}, subOptions)
+
+	pool := NewPool()
+	pool.Start = net.ParseIP("10.0.0.10")
+	pool.End = net.ParseIP("10.0.0.20")
+	pool.Netmask = net.ParseIP("255.255.255.0")
+	pool.VendorOptions = []*VendorOptions{ubnt, aruba}
+
+	offer := func(mac MacAddress, vendorClass string) *DHCPMessage {
+		message := NewDhcpMessage()
+		message.Header.Mac = mac
+		message.Options.Set(OPTION_MESSAGE_TYPE, []byte{DHCPDISCOVER})
+		message.Options.Set(OPTION_VENDOR, []byte(vendorClass))
+		return NewRequestHandler(message, pool).Handle()
+	}
+
+	response := offer(MacAddress{0, 0, 0, 0, 0, 1}, "ArubaAP")
+	opt, ok := response.Options.Get(OPTION_VENDOR_INFO)
+	require.True(t, ok)
+	require.Equal(t, aruba.Data, opt.Data)
+
+	response = offer(MacAddress{0, 0, 0, 0, 0, 2}, "ubnt")
+	opt, ok = response.Options.Get(OPTION_VENDOR_INFO)
+	require.True(t, ok)
+	require.Equal(t, ubnt.Data, opt.Data)
+
+	response = offer(MacAddress{0, 0, 0, 0, 0, 3}, "MSFT 5.0")
+	_, ok = response.Options.Get(OPTION_VENDOR_INFO)
+	require.False(t, ok)
+
+	// Sub-options are only addressable by code
+	_, err = VendorOptionConf{
+		Vendor:     "ubnt",
+		SubOptions: []OptionConf{{Name: "router", Type: "ip", Value: "10.0.0.1"}},
+	}.ToVendorOptions()
+	require.NotNil(t, err)
+
+	// Truncated sub-options fail to parse
+	_, err = ParseSubOptions([]byte{1, 4, 10, 0})
+	require.NotNil(t, err)
+}
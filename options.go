@@ -8,6 +8,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"sort"
 )
 
 // Represent a single DHCP option
@@ -29,7 +30,8 @@ func (o *Option) CalculateLength() error {
 }
 
 //
-// Easily handle lists of options. Each can only appear once.
+// Easily handle lists of options. Each can only appear once, though values
+// longer than 255 bytes are split across several instances per RFC 3396.
 //
 
 type Options struct {
@@ -52,9 +54,43 @@ func (o *Options) Dump() {
 	for _, key := range o.order {
 		option := o.data[key]
 		log.Printf("%v = %v (%+v)", key, optionNames[key], option.Data)
+
+		// Also show the contents of encapsulating options
+		if key == OPTION_VIVSO {
+			blocks, err := ParseEnterpriseData(option.Data)
+			if err != nil {
+				log.Printf("  (not valid enterprise data: %v)", err)
+				continue
+			}
+			for _, block := range blocks {
+				subOptions, err := ParseSubOptions(block.Data)
+				if err != nil {
+					log.Printf("  enterprise %v: (not valid sub-options: %v)", block.Enterprise, err)
+					continue
+				}
+				for _, sub := range sortedSubOptionCodes(subOptions) {
+					log.Printf("  enterprise %v: %v = %+v (%q)", block.Enterprise, sub, subOptions[sub], subOptions[sub])
+				}
+			}
+		} else if _, ok := encapsulatingOptions[key]; ok {
+			subOptions, err := ParseSubOptions(option.Data)
+			if err != nil {
+				log.Printf("  (not valid sub-options: %v)", err)
+				continue
+			}
+			for _, sub := range sortedSubOptionCodes(subOptions) {
+				log.Printf("  %v.%v = %+v (%q)", key, sub, subOptions[sub], subOptions[sub])
+			}
+		}
 	}
 }
 
+// Options whose values are themselves code/length/data sub-options
+var encapsulatingOptions = map[byte]struct{}{
+	OPTION_VENDOR_INFO: {},
+	OPTION_RELAY_INFO:  {},
+}
+
 // Abstract away boilerplate for common getting operations
 func (o *Options) Get(code byte) (Option, bool) {
 	option, ok := o.data[code]
@@ -127,6 +163,42 @@ func (o *Options) Set(code byte, data []byte) {
 	o.data[code] = option
 }
 
+// Set a single option which may be longer than 255 bytes. Only options which
+// clients know to concatenate (RFC 3396) should be set this way.
+func (o *Options) SetLong(code byte, data []byte) {
+	if len(data) <= 255 {
+		o.Set(code, data)
+		return
+	}
+	if _, ok := o.data[code]; ok {
+		log.Printf("Not setting option %v more than once", code)
+		return
+	}
+	option := Option{
+		Data: data,
+	}
+	option.Header.Code = code
+	option.Header.Length = 255
+	o.order = append(o.order, code)
+	o.data[code] = option
+}
+
+// Concatenate repeated instances of an option while parsing, per RFC 3396
+func (o *Options) appendData(code byte, data []byte) {
+	option, ok := o.data[code]
+	if !ok {
+		o.Set(code, data)
+		return
+	}
+	option.Data = append(option.Data, data...)
+	if len(option.Data) > 255 {
+		option.Header.Length = 255
+	} else {
+		option.Header.Length = byte(len(option.Data))
+	}
+	o.data[code] = option
+}
+
 // Encode all options, including sentinel, to buf
 func (o *Options) Encode(buf *bytes.Buffer) error {
 	// Need the sentinel value at the end
@@ -144,17 +216,31 @@ func (o *Options) Encode(buf *bytes.Buffer) error {
 		// FIXME: why does the following fail to serialize?
 		// binary.Write(buf, binary.LittleEndian, option)
 
-		if err := buf.WriteByte(option.Header.Code); err != nil {
-			return fmt.Errorf("Failed writing option code to buf: %v", err)
-		}
+		// Long options get split into several instances
+		data := option.Data
+		for {
+			chunk := data
+			if len(chunk) > 255 {
+				chunk = chunk[:255]
+			}
+			data = data[len(chunk):]
 
-		// If any of the following fail, we may generate badly corrupted data
-		if err := buf.WriteByte(option.Header.Length); err != nil {
-			return fmt.Errorf("Failed writing option length to buf: %v", err)
-		}
-		if len(option.Data) > 0 {
-			if _, err := buf.Write(option.Data); err != nil {
-				return fmt.Errorf("Failed writing option data to buf: %v", err)
+			if err := buf.WriteByte(option.Header.Code); err != nil {
+				return fmt.Errorf("Failed writing option code to buf: %v", err)
+			}
+
+			// If any of the following fail, we may generate badly corrupted data
+			if err := buf.WriteByte(byte(len(chunk))); err != nil {
+				return fmt.Errorf("Failed writing option length to buf: %v", err)
+			}
+			if len(chunk) > 0 {
+				if _, err := buf.Write(chunk); err != nil {
+					return fmt.Errorf("Failed writing option data to buf: %v", err)
+				}
+			}
+
+			if len(data) == 0 {
+				break
 			}
 		}
 	}
@@ -190,8 +276,56 @@ func ParseOptions(reader *bytes.Reader) *Options {
 			log.Printf("Did not read as much as expected. %v != %v", count, option.Header.Length)
 			break
 		}
-		options.Set(option.Header.Code, option.Data)
+		options.appendData(option.Header.Code, option.Data)
 	}
 
 	return options
 }
+
+// Parse the code/length/data encoding used within encapsulating options,
+// such as option 82 and option 43
+func ParseSubOptions(data []byte) (map[byte][]byte, error) {
+	result := map[byte][]byte{}
+	for i := 0; i < len(data); {
+		code := data[i]
+		if code == OPTION_PADDING {
+			i++
+			continue
+		}
+		if code == OPTION_SENTINEL {
+			break
+		}
+		if i+1 >= len(data) {
+			return nil, fmt.Errorf("Truncated sub-option %v", code)
+		}
+		length := int(data[i+1])
+		if i+2+length > len(data) {
+			return nil, fmt.Errorf("Sub-option %v length %v overflows", code, length)
+		}
+		result[code] = data[i+2 : i+2+length]
+		i += 2 + length
+	}
+	return result, nil
+}
+
+func sortedSubOptionCodes(subOptions map[byte][]byte) []byte {
+	codes := make([]byte, 0, len(subOptions))
+	for code := range subOptions {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	return codes
+}
+
+// Encode sub-options in order, for use as the value of an encapsulating option
+func EncodeSubOptions(subOptions []ConfiguredOption) ([]byte, error) {
+	buf := []byte{}
+	for _, sub := range subOptions {
+		if len(sub.Data) > 255 {
+			return nil, fmt.Errorf("Sub-option %v value too long", sub.Code)
+		}
+		buf = append(buf, sub.Code, byte(len(sub.Data)))
+		buf = append(buf, sub.Data...)
+	}
+	return buf, nil
+}
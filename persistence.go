@@ -3,10 +3,12 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"fmt"
+	"io/fs"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -15,19 +17,150 @@ type Persistence interface {
 	PersistLeases(map[FixedV4]*Lease) error
 }
 
+// Persistence shared with other servers, which must agree to a client
+// taking an address before we hand it out. Claims succeed if the address is
+// free, expired, or already the client's. Failed claims return when the
+// other server's lease ends
+type LeaseClaimer interface {
+	ClaimLease(ip FixedV4, mac MacAddress, expiration time.Time) (bool, time.Time, error)
+}
+
+// Persistence which buffers what it writes, and can be made to flush that
+// to disk before a change is acknowledged
+type SyncingPersistence interface {
+	Sync() error
+}
+
+// Persistence for a pool as configured: file (the default), rewriting every
+// lease on each change, journal or sqlite, stored in the lease directory
+// under the pool's name, or postgres or redis, shared through
+// conf.Database, with postgres rows marked as conf.ServerId's. Files keep conf.LeaseBackups previous generations as
+// backups, and journals are fsynced every conf.JournalSyncIntervalMs, or on
+// every append if it's negative
+func NewPersistence(conf *Conf, pool string) (Persistence, error) {
+	base := filepath.Join(conf.Leasedir, pool)
+	switch conf.Persistence {
+	case "", "file":
+		p := NewFilePersistence(base + ".json")
+		p.Backups = conf.LeaseBackups
+		return p, nil
+	case "journal":
+		p := NewJournalPersistence(base + ".json")
+		p.snapshot.Backups = conf.LeaseBackups
+		if conf.JournalSyncIntervalMs > 0 {
+			p.SyncInterval = time.Duration(conf.JournalSyncIntervalMs) * time.Millisecond
+		} else if conf.JournalSyncIntervalMs < 0 {
+			p.SyncInterval = 0
+		}
+		return p, nil
+	case "sqlite":
+		return newSqlitePersistence(base + ".db")
+	case "postgres":
+		if conf.Database == "" {
+			return nil, errors.New("postgres lease storage needs a database to be configured")
+		}
+		return newPostgresPersistence(conf.Database, pool, conf.ServerId)
+	case "redis":
+		if conf.Database == "" {
+			return nil, errors.New("redis lease storage needs a database to be configured")
+		}
+		return NewRedisPersistence(conf.Database, pool)
+	}
+	return nil, fmt.Errorf("Unknown lease persistence '%v'", conf.Persistence)
+}
+
 type FilePersistenceLease struct {
 	Hostname   string
+	FQDN       string `json:",omitempty"`
 	IP         string
 	Mac        string
 	Expiration time.Time
 }
 
+const defaultLeaseBackups = 3
+
+// Version of the lease file format we write. Files from before it was
+// versioned are version 0, a bare map of leases by IP
+const leaseFileVersion = 1
+
+var ErrLeaseFileTooNew = errors.New("Lease file is from a newer version")
+
+type leaseFile struct {
+	Version int
+	Leases  map[string]*FilePersistenceLease
+}
+
+// Upgrades from each version of the lease file to the next, by index.
+// Append to this when changing the format, and add a fixture for the new
+// version to testdata
+var leaseFileMigrations = []func(contents []byte) ([]byte, error){
+	// 0 to 1: wrap the bare map of leases in a versioned envelope
+	func(contents []byte) ([]byte, error) {
+		var leases map[string]json.RawMessage
+		if err := json.Unmarshal(contents, &leases); err != nil {
+			return nil, err
+		}
+		return json.Marshal(map[string]interface{}{"Version": 1, "Leases": leases})
+	},
+}
+
+func leaseFileVersionOf(contents []byte) (int, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(contents, &fields); err != nil {
+		return 0, err
+	}
+	raw, ok := fields["Version"]
+	if !ok {
+		return 0, nil
+	}
+	var version int
+	err := json.Unmarshal(raw, &version)
+	return version, err
+}
+
+// Parse a lease file of any version we know, migrating it to the current
+func unmarshalLeaseFile(contents []byte) (map[string]*FilePersistenceLease, error) {
+	version, err := leaseFileVersionOf(contents)
+	if err != nil {
+		return nil, err
+	}
+	if version > leaseFileVersion {
+		return nil, fmt.Errorf("%w: version %v, but we support up to %v", ErrLeaseFileTooNew, version, leaseFileVersion)
+	}
+
+	for from := version; from < leaseFileVersion; from++ {
+		if contents, err = leaseFileMigrations[from](contents); err != nil {
+			return nil, fmt.Errorf("Failed migrating lease file from version %v: %w", from, err)
+		}
+	}
+	if version < leaseFileVersion {
+		log.Printf("Upgrading lease file from version %v to %v", version, leaseFileVersion)
+	}
+
+	var file leaseFile
+	if err := json.Unmarshal(contents, &file); err != nil {
+		return nil, err
+	}
+	if file.Leases == nil {
+		file.Leases = map[string]*FilePersistenceLease{}
+	}
+	return file.Leases, nil
+}
+
+func marshalLeaseFile(leases map[string]*FilePersistenceLease) ([]byte, error) {
+	return json.MarshalIndent(leaseFile{leaseFileVersion, leases}, "", "   ")
+}
+
 type FilePersistence struct {
 	path string
+
+	// Previous generations of the file kept as backups, named path.1 (the
+	// newest) to path.N
+	Backups int
 }
 
 func NewFilePersistence(path string) *FilePersistence {
-	return &FilePersistence{path}
+	return &FilePersistence{path: path, Backups: defaultLeaseBackups}
 }
 
 // Load on-disk json leases into our in-memory format
@@ -37,6 +170,7 @@ func (p *FilePersistence) decode(orig map[string]*FilePersistenceLease) map[Fixe
 		result[IpToFixedV4(net.ParseIP(lease.IP))] = &Lease{
 			Mac:        StrToMac(lease.Mac),
 			Hostname:   lease.Hostname,
+			FQDN:       lease.FQDN,
 			IP:         IpToFixedV4(net.ParseIP(lease.IP)),
 			Expiration: lease.Expiration,
 		}
@@ -51,6 +185,7 @@ func (p *FilePersistence) encode(leases map[FixedV4]*Lease) map[string]*FilePers
 		result[lease.IP.String()] = &FilePersistenceLease{
 			Mac:        lease.Mac.String(),
 			Hostname:   lease.Hostname,
+			FQDN:       lease.FQDN,
 			IP:         lease.IP.String(),
 			Expiration: lease.Expiration,
 		}
@@ -58,23 +193,44 @@ func (p *FilePersistence) encode(leases map[FixedV4]*Lease) map[string]*FilePers
 	return result
 }
 
+// Load our leases, falling back to the newest backup which can be read if
+// the file itself is damaged
 func (p *FilePersistence) LoadLeases() (map[FixedV4]*Lease, error) {
-	leases := map[FixedV4]*Lease{}
+	leases, err := p.load(p.path)
+	if err == nil {
+		return leases, nil
+	}
+	// If file doesn't exist, don't surface it as an error,
+	// and instead just return an empty list
+	if errors.Is(err, os.ErrNotExist) {
+		return map[FixedV4]*Lease{}, nil
+	}
+	// Falling back to an older backup would lose a newer version's leases
+	if errors.Is(err, ErrLeaseFileTooNew) {
+		return nil, fmt.Errorf("%v: %w", p.path, err)
+	}
 
-	contents, err := ioutil.ReadFile(p.path)
-	if err != nil {
-		// If file doesn't exist, don't surface it as an error,
-		// and instead just return an empty list
-		if errors.Is(err, os.ErrNotExist) {
+	for i := 1; i <= p.Backups; i++ {
+		backup := p.backupPath(i)
+		leases, backupErr := p.load(backup)
+		if backupErr == nil {
+			log.Printf("WARNING: Failed loading leases from %v (%v); using backup %v instead. Leases since it was written are lost", p.path, err, backup)
 			return leases, nil
 		}
-		return nil, err
+		if !errors.Is(backupErr, os.ErrNotExist) {
+			log.Printf("WARNING: Failed loading lease backup %v: %v", backup, backupErr)
+		}
 	}
+	return nil, err
+}
 
-	fromFile := map[string]*FilePersistenceLease{}
-
-	err = json.Unmarshal(contents, &fromFile)
+func (p *FilePersistence) load(path string) (map[FixedV4]*Lease, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
 
+	fromFile, err := unmarshalLeaseFile(contents)
 	if err != nil {
 		return nil, err
 	}
@@ -83,14 +239,72 @@ func (p *FilePersistence) LoadLeases() (map[FixedV4]*Lease, error) {
 }
 
 func (p *FilePersistence) PersistLeases(leases map[FixedV4]*Lease) error {
-	encoded := p.encode(leases)
-	payload, err := json.MarshalIndent(encoded, "", "   ")
+	payload, err := marshalLeaseFile(p.encode(leases))
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(p.path, payload, 0644)
+	err = p.write(payload)
 	if err != nil {
 		log.Printf("Failed persisting leases to %v: %v", p.path, err)
 	}
 	return err
 }
+
+func (p *FilePersistence) backupPath(generation int) string {
+	return fmt.Sprintf("%v.%v", p.path, generation)
+}
+
+// Replace our file atomically, first shifting it and its backups down a
+// generation. The current file is hard linked into place as the newest
+// backup, so there is never a moment without it
+func (p *FilePersistence) write(payload []byte) error {
+	if p.Backups > 0 {
+		for i := p.Backups - 1; i >= 1; i-- {
+			if err := os.Rename(p.backupPath(i), p.backupPath(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("Failed rotating lease backup %v: %v", p.backupPath(i), err)
+			}
+		}
+		os.Remove(p.backupPath(1))
+		if err := os.Link(p.path, p.backupPath(1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed backing up %v: %v", p.path, err)
+		}
+	}
+	return writeFileAtomic(p.path, payload, 0644)
+}
+
+// Write a file by way of a temporary file alongside it, so readers see
+// either the old contents or the new, never a partial write. The directory
+// is synced too, so the rename itself survives a crash
+func writeFileAtomic(path string, data []byte, perm fs.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
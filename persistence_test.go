@@ -0,0 +1,162 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFilePersistenceBackups(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pool.json")
+	p := NewFilePersistence(path)
+	p.Backups = 2
+
+	leases := map[FixedV4]*Lease{}
+	for i := 1; i <= 4; i++ {
+		lease := testLease("10.0.0.1", byte(i))
+		leases[lease.IP] = lease
+		require.Nil(t, p.PersistLeases(leases))
+	}
+
+	// The two previous generations are kept, and no temporary files
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, entries, 3)
+
+	ip := IpToFixedV4(net.ParseIP("10.0.0.1"))
+	for generation, mac := range map[string]byte{path: 4, path + ".1": 3, path + ".2": 2} {
+		loaded, err := p.load(generation)
+		require.Nil(t, err)
+		require.Equal(t, mac, loaded[ip].Mac[5], generation)
+	}
+
+	// A damaged file falls back to the newest readable backup
+	require.Nil(t, os.WriteFile(path, []byte(`{"10.0.0.1": {"Hostn`), 0644))
+	loaded, err := p.LoadLeases()
+	require.Nil(t, err)
+	require.Equal(t, byte(3), loaded[ip].Mac[5])
+
+	require.Nil(t, os.WriteFile(path+".1", nil, 0644))
+	loaded, err = p.LoadLeases()
+	require.Nil(t, err)
+	require.Equal(t, byte(2), loaded[ip].Mac[5])
+
+	// And only once nothing is readable do we fail
+	require.Nil(t, os.Remove(path+".2"))
+	_, err = p.LoadLeases()
+	require.NotNil(t, err)
+}
+
+func TestFilePersistenceMissing(t *testing.T) {
+	leases, err := NewFilePersistence(filepath.Join(t.TempDir(), "pool.json")).LoadLeases()
+	require.Nil(t, err)
+	require.Empty(t, leases)
+}
+
+func TestFilePersistenceFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pool.json")
+	p := NewFilePersistence(path)
+
+	lease := testLease("10.0.0.1", 1)
+	require.Nil(t, p.PersistLeases(map[FixedV4]*Lease{lease.IP: lease}))
+
+	// Failing to write leaves the existing file alone
+	require.Nil(t, os.Chmod(dir, 0500))
+	defer os.Chmod(dir, 0700)
+	if f, err := os.CreateTemp(dir, "probe"); err == nil {
+		f.Close()
+		t.Skip("Directory permissions aren't enforced, eg running as root")
+	}
+	require.NotNil(t, p.PersistLeases(map[FixedV4]*Lease{}))
+
+	loaded, err := p.LoadLeases()
+	require.Nil(t, err)
+	require.Len(t, loaded, 1)
+}
+
+func TestNewPersistence(t *testing.T) {
+	conf := &Conf{Leasedir: "/var/lib/leases", LeaseBackups: 2}
+	p, err := NewPersistence(conf, "lan")
+	require.Nil(t, err)
+	require.IsType(t, &FilePersistence{}, p)
+	require.Equal(t, "/var/lib/leases/lan.json", p.(*FilePersistence).path)
+	require.Equal(t, 2, p.(*FilePersistence).Backups)
+
+	conf.Persistence = "journal"
+	p, err = NewPersistence(conf, "lan")
+	require.Nil(t, err)
+	require.IsType(t, &JournalPersistence{}, p)
+	require.Equal(t, time.Second, p.(*JournalPersistence).SyncInterval)
+
+	conf.JournalSyncIntervalMs = 250
+	p, err = NewPersistence(conf, "lan")
+	require.Nil(t, err)
+	require.Equal(t, time.Millisecond*250, p.(*JournalPersistence).SyncInterval)
+	conf.JournalSyncIntervalMs = -1
+	p, err = NewPersistence(conf, "lan")
+	require.Nil(t, err)
+	require.Zero(t, p.(*JournalPersistence).SyncInterval)
+
+	conf.Persistence = "postgres"
+	_, err = NewPersistence(conf, "lan")
+	require.NotNil(t, err)
+
+	conf.Persistence = "tape"
+	_, err = NewPersistence(conf, "lan")
+	require.NotNil(t, err)
+}
+
+func TestLeaseFileVersions(t *testing.T) {
+	laptop := IpToFixedV4(net.ParseIP("192.168.1.10"))
+	other := IpToFixedV4(net.ParseIP("192.168.1.11"))
+
+	// Every format we've ever written still loads
+	for fixture, fqdn := range map[string]string{
+		"leases-v0.json":      "",
+		"leases-v0-fqdn.json": "laptop.example.com",
+		"leases-v1.json":      "laptop.example.com",
+	} {
+		path := filepath.Join(t.TempDir(), "pool.json")
+		contents, err := os.ReadFile(filepath.Join("testdata", fixture))
+		require.Nil(t, err)
+		require.Nil(t, os.WriteFile(path, contents, 0644))
+
+		p := NewFilePersistence(path)
+		leases, err := p.LoadLeases()
+		require.Nil(t, err, fixture)
+		require.Len(t, leases, 2, fixture)
+		require.Equal(t, "laptop", leases[laptop].Hostname, fixture)
+		require.Equal(t, fqdn, leases[laptop].FQDN, fixture)
+		require.Equal(t, MacAddress{0x52, 0x54, 0, 0x12, 0x34, 0x56}, leases[laptop].Mac, fixture)
+		require.Equal(t, int64(1893553445123456789), leases[laptop].Expiration.UnixNano(), fixture)
+		require.Equal(t, MacAddress{0x52, 0x54, 0, 0xab, 0xcd, 0xef}, leases[other].Mac, fixture)
+
+		// And is written back as the current version
+		require.Nil(t, p.PersistLeases(leases))
+		contents, err = os.ReadFile(path)
+		require.Nil(t, err)
+		version, err := leaseFileVersionOf(contents)
+		require.Nil(t, err)
+		require.Equal(t, leaseFileVersion, version)
+	}
+	require.Len(t, leaseFileMigrations, leaseFileVersion)
+}
+
+func TestLeaseFileTooNew(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pool.json")
+	p := NewFilePersistence(path)
+
+	// Even with a backup to fall back to, newer files are refused outright
+	require.Nil(t, p.PersistLeases(map[FixedV4]*Lease{}))
+	require.Nil(t, p.PersistLeases(map[FixedV4]*Lease{}))
+	require.Nil(t, os.WriteFile(path, []byte(`{"Version": 99, "Leases": {}, "Clients": {}}`), 0644))
+
+	_, err := p.LoadLeases()
+	require.ErrorIs(t, err, ErrLeaseFileTooNew)
+}
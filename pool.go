@@ -3,7 +3,12 @@ package main
 import (
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand/v2"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -11,12 +16,33 @@ import (
 var ErrNoIps = errors.New("No free IPs")
 
 type Lease struct {
-	Mac        MacAddress
-	Hostname   string
-	IP         FixedV4
+	Mac      MacAddress
+	Hostname string
+	FQDN     string
+	IP       FixedV4
+
+	// Once the lease is in a pool, prefer changing this through
+	// SetLeaseExpiration or a renewal, which keep the pool's index of expiry
+	// times in step. Changes made directly are only noticed once the pool
+	// runs out of free addresses, so the lease isn't reaped until then
 	Expiration time.Time
 }
 
+// Client supplied details, and those derived from its classes, used when
+// handing out or renewing leases
+type LeaseParams struct {
+	LeaseTime time.Duration
+	Hostname  string
+	FQDN      string
+
+	// Interface the request arrived on, if not relayed, for conflict probes
+	Interface *net.Interface
+
+	// Client identifier (option 61), if the client sent one
+	ClientID []byte
+}
+
+// Extend a lease which isn't in a pool yet. See Expiration
 func (l *Lease) BumpExpiry(d time.Duration) {
 	l.Expiration = time.Now().Add(d)
 }
@@ -25,10 +51,116 @@ func (l *Lease) Expired() bool {
 	return time.Now().After(l.Expiration)
 }
 
+// Changes to leases which other subsystems (eg DDNS) may want to act on
+type LeaseEventType int
+
+const (
+	LEASE_BOUND LeaseEventType = iota
+	LEASE_RELEASED
+	LEASE_EXPIRED
+
+	// The lease's hostname changed, eg as another client took it over. The
+	// event carries the lease as it was before, with its old name
+	LEASE_RENAMED
+)
+
+type LeaseEvent struct {
+	Type LeaseEventType
+
+	// Copy of the lease at the time of the event
+	Lease Lease
+
+	// Whether the server should maintain the lease's A record, as negotiated
+	// through the client FQDN option
+	UpdateForward bool
+}
+
+// Listeners are called synchronously, potentially with the pool locked, so
+// they must not block or call back into the pool
+type LeaseListener func(pool *Pool, event LeaseEvent)
+
+// Strategy for picking a client's new address from the free and expired
+// addresses in a range. Once nothing is free, allocators should fall back to
+// rangeIndex.reclaim so addresses held for previous clients go last. Called
+// with the pool locked. clientID is the client identifier option, or the
+// client's MAC if it sent none
+type Allocator interface {
+	Allocate(index *rangeIndex, clientID []byte, now time.Time) (FixedV4, bool)
+}
+
+// Lowest free address, then the lowest expired one
+type LowestAllocator struct{}
+
+func (LowestAllocator) Allocate(index *rangeIndex, clientID []byte, now time.Time) (FixedV4, bool) {
+	if ip, ok := index.firstFree(now); ok {
+		return ip, true
+	}
+	return index.reclaim(now, index.firstExpired)
+}
+
+// Free address after a random point in the range, so addresses are hard to
+// predict
+type RandomAllocator struct{}
+
+func (RandomAllocator) Allocate(index *rangeIndex, clientID []byte, now time.Time) (FixedV4, bool) {
+	if index.size() == 0 {
+		return 0, false
+	}
+	return allocateFrom(index, rand.IntN(index.size()), now)
+}
+
+// Free address after a point derived from the client's identity, so clients
+// keep their address even if the lease database is lost
+type HashAllocator struct{}
+
+func (HashAllocator) Allocate(index *rangeIndex, clientID []byte, now time.Time) (FixedV4, bool) {
+	if index.size() == 0 {
+		return 0, false
+	}
+	h := fnv.New64a()
+	h.Write(clientID)
+	return allocateFrom(index, int(h.Sum64()%uint64(index.size())), now)
+}
+
+func allocateFrom(index *rangeIndex, offset int, now time.Time) (FixedV4, bool) {
+	if ip, ok := index.firstFreeFrom(offset, now); ok {
+		return ip, true
+	}
+	return index.reclaim(now, func(before time.Time) (FixedV4, bool) {
+		return index.firstExpiredFrom(offset, before)
+	})
+}
+
+// Address which has been free the longest, preferring never used ones, then
+// the longest expired, so addresses go as long as possible before reuse
+type LruAllocator struct{}
+
+func (LruAllocator) Allocate(index *rangeIndex, clientID []byte, now time.Time) (FixedV4, bool) {
+	if ip, ok := index.leastRecentlyFreed(now); ok {
+		return ip, true
+	}
+	return index.reclaim(now, index.earliestExpired)
+}
+
+func ParseAllocator(name string) (Allocator, error) {
+	switch name {
+	case "", "lowest":
+		return LowestAllocator{}, nil
+	case "random":
+		return RandomAllocator{}, nil
+	case "hash":
+		return HashAllocator{}, nil
+	case "lru":
+		return LruAllocator{}, nil
+	}
+	return nil, fmt.Errorf("Unknown allocation strategy '%v'", name)
+}
+
 type ReservedHost struct {
 	Mac      MacAddress
 	Hostname string
 	IP       FixedV4
+	Boot     *BootConfig
 }
 
 type Pool struct {
@@ -41,92 +173,425 @@ type Pool struct {
 	MyIp        FixedV4
 	Router      []net.IP
 	Dns         []net.IP
-	LeaseTime   time.Duration
-	Persistence Persistence
-	Verbose     bool
+	Routes      []StaticRoute
+	Domain      string
+	Search      []string
+	DdnsUpdates DdnsUpdates
+	DdnsUpdater *DdnsUpdater
+
+	// Strategy for picking new addresses. Nil means lowest free first
+	Allocator Allocator
+
+	// Optional probing of new addresses before handing them out. Addresses
+	// found in use are skipped for AbandonTime
+	ConflictDetector *ConflictDetector
+	AbandonTime      time.Duration
+
+	// How long addresses stay held for their previous client after its lease
+	// is released or expires. Held addresses are only given to others once
+	// nothing else is free. Which addresses are held is only kept in memory,
+	// so is forgotten on restart
+	AffinityTime time.Duration
+
+	// Longest the reaper sleeps between looking for expired leases
+	ReapInterval time.Duration
+
+	// When lease changes are written, once the writer is started, and how
+	// often and after how many changes it writes them
+	Durability      Durability
+	PersistInterval time.Duration
+	PersistMaxDirty int
+
+	// Names for clients sending none, and what to do about duplicates
+	HostnameTemplate   HostnameTemplate
+	HostnameDuplicates HostnameDuplicates
+	LeaseTime          time.Duration
+	Persistence        Persistence
+	Verbose            bool
+	Boot               *BootConfig
+
+	// Option 43 payloads by vendor class, in configured order
+	VendorOptions []*VendorOptions
+
+	// Option 125 blocks, sent to clients by enterprise number
+	VendorIdentifyingOptions []EnterpriseData
+
+	// All configured client classes, and the names of those this pool
+	// is restricted to or from
+	Classes      []*ClientClass
+	AllowClasses []string
+	DenyClasses  []string
+
+	listeners []LeaseListener
 
 	// Internal lease database
 	leasesByMac map[MacAddress]*Lease
 	leaseByIp   map[FixedV4]*Lease
 
+	// Leases by lower case hostname. Expired leases keep their names, so
+	// several may share one
+	leasesByHostname map[string]map[FixedV4]*Lease
+
 	// Internal database of fixed mac addresses to IPs for hosts,
 	// sourced from configuration
-	reservedByMac map[MacAddress]*ReservedHost
-	reservedByIp  map[FixedV4]*ReservedHost
+	reservedByMac      map[MacAddress]*ReservedHost
+	reservedByIp       map[FixedV4]*ReservedHost
+	reservedByHostname map[string]*ReservedHost
+
+	// Addresses found in use by something else, until when to skip them
+	abandoned map[FixedV4]time.Time
+
+	// Addresses other servers sharing our persistence hold, until when
+	// their leases end
+	heldElsewhere map[FixedV4]time.Time
+
+	// When addresses were last freed, for least recently used allocation
+	released map[FixedV4]time.Time
+
+	// Address each client last had, for handing it back on return. Records
+	// older than AffinityTime are pruned by Reap
+	affinity map[MacAddress]affinityRecord
+
+	// Free address and expiry lookups over our range
+	index *rangeIndex
+
+	// IPs whose lease changed since we last persisted, and whether it was
+	// bound or removed rather than just renewed or edited
+	changed map[FixedV4]bool
+
+	reaperDone chan struct{}
+	reaperWg   sync.WaitGroup
+
+	writerDone chan struct{}
+	writerKick chan struct{}
+	writerWg   sync.WaitGroup
+
+	// Serializes saves, so they reach the disk in the order taken
+	flushM sync.Mutex
 
 	m sync.RWMutex
 }
 
+type affinityRecord struct {
+	IP       FixedV4
+	Released time.Time
+}
+
 func NewPool() *Pool {
-	p := &Pool{}
+	p := &Pool{
+		abandoned:     map[FixedV4]time.Time{},
+		heldElsewhere: map[FixedV4]time.Time{},
+		released:      map[FixedV4]time.Time{},
+		affinity:      map[MacAddress]affinityRecord{},
+		AbandonTime:   time.Hour,
+	}
 	p.clearLeases()
 	p.clearReservedHosts()
 	return p
 }
 
-// Hacky, terrible, naive impl. I want an ordered int set!
-func (p *Pool) getFreeIp(mac MacAddress) (FixedV4, error) {
+// Reserved IP for the mac if there is one, then the IP it last had if that's
+// still free, otherwise whichever free or expired IP our allocator picks
+func (p *Pool) getFreeIp(mac MacAddress, clientID []byte) (FixedV4, error) {
 
 	// If there is a reserved IP for this mac address, use that
 	if host, ok := p.reservedByMac[mac]; ok {
 		return host.IP, nil
 	}
 
-	// Try to find the next free IP within our range, while keeping
-	// track of the first expired lease we found, in case we have no
-	// otherwise free IPs
-	start := IpToFixedV4(p.Start)
-	end := IpToFixedV4(p.End)
+	// Clients whose lease expired but is still around get it back
+	if lease, ok := p.leasesByMac[mac]; ok && p.rangeIndex().contains(lease.IP) {
+		return lease.IP, nil
+	}
+
+	if ip, ok := p.previousIp(mac); ok {
+		return ip, nil
+	}
+
+	allocator := p.Allocator
+	if allocator == nil {
+		allocator = LowestAllocator{}
+	}
+
+	if len(clientID) == 0 {
+		clientID = mac[:]
+	}
+
+	rescanned := false
+	for {
+		now := time.Now()
+		ip, ok := allocator.Allocate(p.rangeIndex(), clientID, now)
+		if !ok {
+			// Leases expired by setting their Expiration directly only show
+			// up in the index once corrected, which is only worth looking
+			// for once we'd otherwise be out of addresses
+			if rescanned || !p.reindexExpired(now) {
+				return 0, ErrNoIps
+			}
+			rescanned = true
+			continue
+		}
 
-	var foundExpired *Lease = nil
+		lease, ok := p.leaseByIp[ip]
+		if !ok {
+			return ip, nil
+		}
 
-	for ipLong := start; ipLong <= end; ipLong++ {
-		// Skip over any IPs in our range which are reserved
-		if _, ok := p.reservedByIp[ipLong]; ok {
+		// A lease whose expiry was changed behind the index's back isn't
+		// ours to take. Correcting the index means it won't be picked again
+		if !now.After(lease.Expiration) {
+			p.reindex(ip)
 			continue
 		}
-		if lease, ok := p.leaseByIp[ipLong]; !ok {
-			return ipLong, nil
-		} else {
-			if foundExpired == nil && lease.Expired() {
-				foundExpired = lease
+
+		// We have a recovered expired lease. Delete it
+		// and return its free IP
+		p.deleteLease(lease)
+		return ip, nil
+	}
+}
+
+// Correct the index for every lease which expired before now, returning
+// whether there were any. Must be called with the pool locked
+func (p *Pool) reindexExpired(now time.Time) bool {
+	found := false
+	for ip, lease := range p.leaseByIp {
+		if now.After(lease.Expiration) && p.rangeIndex().contains(ip) {
+			p.reindex(ip)
+			found = true
+		}
+	}
+	return found
+}
+
+// The address a returning client last had, if nobody has taken it since.
+// Must be called with the pool locked
+func (p *Pool) previousIp(mac MacAddress) (FixedV4, bool) {
+	record, ok := p.affinity[mac]
+	if !ok || p.AffinityTime <= 0 {
+		return 0, false
+	}
+	if !p.released[record.IP].Equal(record.Released) || !p.rangeIndex().isUnleased(record.IP, time.Now()) {
+		delete(p.affinity, mac)
+		return 0, false
+	}
+	return record.IP, true
+}
+
+// Index of our range, built on first use and rebuilt if the range changes.
+// Must be called with the pool locked
+func (p *Pool) rangeIndex() *rangeIndex {
+	start := IpToFixedV4(p.Start)
+	end := IpToFixedV4(p.End)
+
+	if p.index != nil && p.index.start == start && p.index.end == end {
+		return p.index
+	}
+
+	p.index = newRangeIndex(start, end)
+	p.index.affinity = p.AffinityTime
+	for ip := range p.released {
+		p.reindex(ip)
+	}
+	for ip := range p.abandoned {
+		p.reindex(ip)
+	}
+	for ip := range p.heldElsewhere {
+		p.reindex(ip)
+	}
+	for ip := range p.leaseByIp {
+		p.reindex(ip)
+	}
+	for ip := range p.reservedByIp {
+		p.reindex(ip)
+	}
+	return p.index
+}
+
+// Bring the index up to date with the state of an IP. Must be called with
+// the pool locked after any change to leases, reservations or abandonment
+func (p *Pool) reindex(ip FixedV4) {
+	if p.index == nil {
+		return
+	}
+	if _, ok := p.reservedByIp[ip]; ok {
+		p.index.block(ip)
+	} else if lease, ok := p.leaseByIp[ip]; ok {
+		p.index.setLease(ip, lease.Expiration)
+	} else if until, ok := p.abandoned[ip]; ok {
+		p.index.abandon(ip, until)
+	} else if until, ok := p.heldElsewhere[ip]; ok && time.Now().Before(until) {
+		p.index.abandon(ip, until)
+	} else {
+		delete(p.heldElsewhere, ip)
+		p.index.clearLease(ip, p.released[ip], p.AffinityTime)
+	}
+}
+
+// Decide the hostname for a client's lease. Reserved hostnames always win,
+// then the client's sanitized hostname, then our template. Must be called
+// with the pool locked
+func (p *Pool) resolveHostname(mac MacAddress, ip FixedV4, requested string) string {
+	if host, ok := p.reservedByMac[mac]; ok && host.Hostname != "" {
+		return host.Hostname
+	}
+
+	name := SanitizeHostname(requested)
+	if name == "" {
+		return p.HostnameTemplate.Expand(ip, mac)
+	}
+
+	owner, reserved := p.hostnameOwner(name, mac)
+	if owner == nil && !reserved {
+		return name
+	}
+
+	switch {
+	case p.HostnameDuplicates == HOSTNAME_DUPLICATES_LAST_WINS && !reserved:
+		log.Printf("Hostname %v moves from %v to %v", name, owner.Mac.String(), mac.String())
+		p.renameLease(owner, "")
+		return name
+
+	case p.HostnameDuplicates == HOSTNAME_DUPLICATES_SUFFIX:
+		for i := 2; ; i++ {
+			suffix := "-" + strconv.Itoa(i)
+			candidate := name
+			if len(candidate)+len(suffix) > 63 {
+				candidate = strings.TrimRight(candidate[:63-len(suffix)], "-")
+			}
+			candidate += suffix
+			if owner, reserved := p.hostnameOwner(candidate, mac); owner == nil && !reserved {
+				return candidate
 			}
 		}
 	}
 
-	// We have a recovered expired lease. Delete it
-	// and return its free IP
-	if foundExpired != nil {
-		p.deleteLease(foundExpired)
-		return foundExpired.IP, nil
+	log.Printf("Hostname %v requested by %v is already in use", name, mac.String())
+	return p.HostnameTemplate.Expand(ip, mac)
+}
+
+// Another client's unexpired lease with a hostname, or whether a reservation
+// for another client has it
+func (p *Pool) hostnameOwner(name string, mac MacAddress) (*Lease, bool) {
+	name = strings.ToLower(name)
+	if host, ok := p.reservedByHostname[name]; ok && host.Mac != mac {
+		return nil, true
+	}
+	for _, lease := range p.leasesByHostname[name] {
+		if lease.Mac != mac && !lease.Expired() {
+			return lease, false
+		}
 	}
+	return nil, false
+}
+
+// Hostname a client asked for: its host name option, or failing that the
+// first label of its FQDN, either of which goes through resolveHostname
+func requestedHostname(params LeaseParams) string {
+	if params.Hostname != "" || params.FQDN == "" {
+		return params.Hostname
+	}
+	label, _, _ := strings.Cut(params.FQDN, ".")
+	return label
+}
+
+// Change a lease's hostname, letting listeners know so they can drop records
+// for the old one. Must be called with the pool locked
+func (p *Pool) renameLease(lease *Lease, name string) {
+	previous := *lease
+	p.unindexHostname(lease)
+	lease.Hostname = name
+	p.indexHostname(lease)
+	p.touched(lease.IP)
+	if previous.Hostname != "" {
+		p.notify(LeaseEvent{Type: LEASE_RENAMED, Lease: previous})
+	}
+}
+
+func (p *Pool) indexHostname(lease *Lease) {
+	if lease.Hostname == "" {
+		return
+	}
+	name := strings.ToLower(lease.Hostname)
+	leases, ok := p.leasesByHostname[name]
+	if !ok {
+		leases = map[FixedV4]*Lease{}
+		p.leasesByHostname[name] = leases
+	}
+	leases[lease.IP] = lease
+}
+
+func (p *Pool) unindexHostname(lease *Lease) {
+	name := strings.ToLower(lease.Hostname)
+	if leases, ok := p.leasesByHostname[name]; ok && leases[lease.IP] == lease {
+		delete(leases, lease.IP)
+		if len(leases) == 0 {
+			delete(p.leasesByHostname, name)
+		}
+	}
+}
 
-	return 0, ErrNoIps
+func (p *Pool) isAbandoned(ip FixedV4) bool {
+	until, ok := p.abandoned[ip]
+	if ok && time.Now().After(until) {
+		delete(p.abandoned, ip)
+		return false
+	}
+	return ok
 }
 
 func (p *Pool) clearLeases() {
 	p.leasesByMac = map[MacAddress]*Lease{}
 	p.leaseByIp = map[FixedV4]*Lease{}
+	p.leasesByHostname = map[string]map[FixedV4]*Lease{}
+	p.changed = map[FixedV4]bool{}
+	p.index = nil
 }
 
 func (p *Pool) insertLease(lease *Lease) {
 	p.leasesByMac[lease.Mac] = lease
 	p.leaseByIp[lease.IP] = lease
+	p.indexHostname(lease)
+	p.changed[lease.IP] = true
+	delete(p.affinity, lease.Mac)
+	p.reindex(lease.IP)
 }
 
 func (p *Pool) deleteLease(lease *Lease) {
 	delete(p.leasesByMac, lease.Mac)
 	delete(p.leaseByIp, lease.IP)
+	p.unindexHostname(lease)
+	p.changed[lease.IP] = true
+	now := time.Now()
+	p.released[lease.IP] = now
+	p.affinity[lease.Mac] = affinityRecord{lease.IP, now}
+	p.reindex(lease.IP)
+}
+
+// Change when a lease expires, keeping the index in step
+func (p *Pool) SetLeaseExpiration(lease *Lease, expiration time.Time) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	lease.Expiration = expiration
+	p.reindex(lease.IP)
+	p.touched(lease.IP)
 }
 
 func (p *Pool) clearReservedHosts() {
 	p.reservedByMac = map[MacAddress]*ReservedHost{}
 	p.reservedByIp = map[FixedV4]*ReservedHost{}
+	p.reservedByHostname = map[string]*ReservedHost{}
+	p.index = nil
 }
 
 func (p *Pool) insertReservedHost(host *ReservedHost) {
 	p.reservedByMac[host.Mac] = host
 	p.reservedByIp[host.IP] = host
+	if host.Hostname != "" {
+		p.reservedByHostname[strings.ToLower(host.Hostname)] = host
+	}
+	p.reindex(host.IP)
 }
 
 func (p *Pool) AddReservedHost(host *ReservedHost) error {
@@ -140,35 +605,326 @@ func (p *Pool) AddReservedHost(host *ReservedHost) error {
 	return nil
 }
 
+func (p *Pool) GetReservedHost(mac MacAddress) (*ReservedHost, bool) {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	host, ok := p.reservedByMac[mac]
+	return host, ok
+}
+
+func (p *Pool) AddListener(listener LeaseListener) {
+	p.listeners = append(p.listeners, listener)
+}
+
+func (p *Pool) notify(event LeaseEvent) {
+	for _, listener := range p.listeners {
+		listener(p, event)
+	}
+}
+
+// Let listeners know a lease was acknowledged to its client
+func (p *Pool) LeaseBound(lease *Lease, updateForward bool) {
+	p.m.RLock()
+	event := LeaseEvent{Type: LEASE_BOUND, Lease: *lease, UpdateForward: updateForward}
+	p.m.RUnlock()
+
+	p.notify(event)
+}
+
+// Boot settings for a mac, preferring those scoped to its reserved host
+func (p *Pool) BootConfigFor(mac MacAddress) *BootConfig {
+	if host, ok := p.GetReservedHost(mac); ok && host.Boot != nil {
+		return host.Boot
+	}
+	return p.Boot
+}
+
+// Option 43 payload for the first configured vendor class prefixing the
+// client's
+func (p *Pool) VendorOptionsFor(vendorClass string) ([]byte, bool) {
+	for _, vendorOptions := range p.VendorOptions {
+		if strings.HasPrefix(vendorClass, vendorOptions.Vendor) {
+			return vendorOptions.Data, true
+		}
+	}
+	return nil, false
+}
+
+// Whether clients in the given classes may get leases from this pool
+func (p *Pool) Permits(classes []*ClientClass) bool {
+	inClass := func(name string) bool {
+		for _, class := range classes {
+			if class.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, name := range p.DenyClasses {
+		if inClass(name) {
+			return false
+		}
+	}
+
+	if len(p.AllowClasses) == 0 {
+		return true
+	}
+
+	for _, name := range p.AllowClasses {
+		if inClass(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Domain names of leases and reservations are in: ours, or defaultDomain if
+// we have none
+func (p *Pool) dnsDomain(defaultDomain string) string {
+	if p.Domain != "" {
+		return strings.TrimSuffix(p.Domain, ".")
+	}
+	return strings.TrimSuffix(defaultDomain, ".")
+}
+
+// Name a lease or reservation answers to in DNS: its hostname within our
+// domain. Client FQDNs aren't used, as only hostnames are sanitized and kept
+// unique, though a client sending just an FQDN gets its first label
+func (p *Pool) dnsName(hostname, defaultDomain string) string {
+	domain := p.dnsDomain(defaultDomain)
+	if hostname == "" || domain == "" {
+		return hostname
+	}
+	return hostname + "." + domain
+}
+
+// Find the address of a reserved host or unexpired lease by DNS name
+func (p *Pool) LookupName(name, defaultDomain string) (FixedV4, bool) {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	hostname := strings.ToLower(strings.TrimSuffix(name, "."))
+	if domain := p.dnsDomain(defaultDomain); domain != "" {
+		var ok bool
+		hostname, ok = strings.CutSuffix(hostname, "."+strings.ToLower(domain))
+		if !ok {
+			return 0, false
+		}
+	}
+	if hostname == "" || strings.Contains(hostname, ".") {
+		return 0, false
+	}
+
+	if host, ok := p.reservedByHostname[hostname]; ok {
+		return host.IP, true
+	}
+
+	for _, lease := range p.leasesByHostname[hostname] {
+		if !lease.Expired() {
+			return lease.IP, true
+		}
+	}
+
+	return 0, false
+}
+
+// Find the DNS name of a reserved host or unexpired lease by address
+func (p *Pool) LookupAddr(ip FixedV4, defaultDomain string) (string, bool) {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	if host, ok := p.reservedByIp[ip]; ok && host.Hostname != "" {
+		return p.dnsName(host.Hostname, defaultDomain), true
+	}
+
+	if lease, ok := p.leaseByIp[ip]; ok && !lease.Expired() {
+		if name := p.dnsName(lease.Hostname, defaultDomain); name != "" {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// Whether our range overlaps with another pool's
+func (p *Pool) Overlaps(other *Pool) bool {
+	return ip2long(p.Start) <= ip2long(other.End) && ip2long(other.Start) <= ip2long(p.End)
+}
+
 func (p *Pool) TouchLeaseByMac(mac MacAddress) (*Lease, bool) {
+	return p.TouchLeaseByMacWithParams(mac, LeaseParams{LeaseTime: p.LeaseTime})
+}
+
+// Renew a lease. The FQDN is only updated if the client sent one. With
+// shared persistence the address is claimed again first, dropping the lease
+// if another server took it over in the meantime
+func (p *Pool) TouchLeaseByMacWithParams(mac MacAddress, params LeaseParams) (*Lease, bool) {
+	ip, claimed, heldUntil, err := p.claimRenewal(mac, params.LeaseTime)
+	if err != nil {
+		log.Printf("Failed claiming %v in pool %v for renewal: %v", ip, p.Name, err)
+		return nil, false
+	}
+
 	p.m.Lock()
 	defer p.m.Unlock()
 
 	if lease, ok := p.leasesByMac[mac]; ok {
-		lease.BumpExpiry(p.LeaseTime)
+		if !claimed && lease.IP == ip {
+			log.Printf("Dropping lease on %v in pool %v for %v, as another server took it over", ip, p.Name, mac.String())
+			p.deleteLease(lease)
+			p.holdElsewhere(ip, heldUntil)
+			delete(p.affinity, mac)
+			p.persistLeases()
+			p.notify(LeaseEvent{Type: LEASE_EXPIRED, Lease: *lease})
+			return nil, false
+		}
+		lease.BumpExpiry(params.LeaseTime)
+		p.reindex(lease.IP)
+		p.touched(lease.IP)
+		if params.FQDN != "" {
+			lease.FQDN = params.FQDN
+		}
+		if requested := requestedHostname(params); requested != "" && SanitizeHostname(requested) != lease.Hostname {
+			if name := p.resolveHostname(mac, lease.IP, requested); name != lease.Hostname {
+				p.renameLease(lease, name)
+			}
+		}
 		p.persistLeases()
 		return lease, true
 	}
 	return nil, false
 }
 
+// Claim a client's address again before renewing it, returning the address,
+// whether the claim succeeded, and if not when the other server's lease
+// ends. Reserved addresses, and pools without shared persistence, need no
+// claim
+func (p *Pool) claimRenewal(mac MacAddress, leaseTime time.Duration) (FixedV4, bool, time.Time, error) {
+	claimer, ok := p.Persistence.(LeaseClaimer)
+	if !ok {
+		return 0, true, time.Time{}, nil
+	}
+
+	p.m.RLock()
+	lease, ok := p.leasesByMac[mac]
+	_, reserved := p.reservedByMac[mac]
+	var ip FixedV4
+	if ok {
+		ip = lease.IP
+	}
+	p.m.RUnlock()
+
+	if !ok || reserved {
+		return ip, true, time.Time{}, nil
+	}
+	claimed, heldUntil, err := claimer.ClaimLease(ip, mac, time.Now().Add(leaseTime))
+	return ip, claimed, heldUntil, err
+}
+
 func (p *Pool) GetNextLease(mac MacAddress, hostname string) (*Lease, error) {
+	return p.GetNextLeaseWithParams(mac, LeaseParams{LeaseTime: p.LeaseTime, Hostname: hostname})
+}
+
+// Hand out a new lease. With conflict detection, candidate addresses are
+// probed without holding the pool lock, and ones in use are abandoned. With
+// shared persistence, ones another server holds are skipped until its lease
+// ends
+func (p *Pool) GetNextLeaseWithParams(mac MacAddress, params LeaseParams) (*Lease, error) {
+	for {
+		ip, reserved, err := p.nextCandidate(mac, params.ClientID)
+		if err != nil {
+			return nil, err
+		}
+
+		// Reserved addresses are the client's regardless, so aren't probed
+		// or claimed
+		if !reserved && p.ConflictDetector != nil && p.ConflictDetector.InUse(ip, params.Interface) {
+			p.abandon(ip)
+			continue
+		}
+
+		if claimer, ok := p.Persistence.(LeaseClaimer); ok && !reserved {
+			claimed, heldUntil, err := claimer.ClaimLease(ip, mac, time.Now().Add(params.LeaseTime))
+			if err != nil {
+				return nil, err
+			}
+			if !claimed {
+				p.m.Lock()
+				p.holdElsewhere(ip, heldUntil)
+				p.m.Unlock()
+				continue
+			}
+		}
+
+		if lease, ok := p.bindLease(mac, ip, params); ok {
+			return lease, nil
+		}
+	}
+}
+
+// Next free address for a client, and whether it's reserved for it
+func (p *Pool) nextCandidate(mac MacAddress, clientID []byte) (FixedV4, bool, error) {
 	p.m.Lock()
 	defer p.m.Unlock()
 
-	ip, err := p.getFreeIp(mac)
+	ip, err := p.getFreeIp(mac, clientID)
 	if err != nil {
-		return nil, err
+		return 0, false, err
 	}
+	_, reserved := p.reservedByMac[mac]
+	return ip, reserved, nil
+}
+
+func (p *Pool) abandon(ip FixedV4) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	log.Printf("Abandoning %v in pool %v as something already uses it", ip, p.Name)
+	p.abandoned[ip] = time.Now().Add(p.AbandonTime)
+	p.reindex(ip)
+}
+
+// Skip an address another server holds until its lease there ends. Must be
+// called with the pool locked
+func (p *Pool) holdElsewhere(ip FixedV4, until time.Time) {
+	p.heldElsewhere[ip] = until
+	p.reindex(ip)
+}
+
+// Create a lease, unless another request took the address while we probed
+func (p *Pool) bindLease(mac MacAddress, ip FixedV4, params LeaseParams) (*Lease, bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	// Reserved addresses are always the client's to take
+	_, reserved := p.reservedByMac[mac]
+	if !reserved && p.isAbandoned(ip) {
+		return nil, false
+	}
+	if existing, ok := p.leaseByIp[ip]; ok {
+		if !reserved && existing.Mac != mac && !existing.Expired() {
+			return nil, false
+		}
+		p.deleteLease(existing)
+	}
+	if existing, ok := p.leasesByMac[mac]; ok {
+		p.deleteLease(existing)
+	}
+	delete(p.heldElsewhere, ip)
+
 	lease := &Lease{
 		IP:       ip,
-		Hostname: hostname,
+		Hostname: p.resolveHostname(mac, ip, requestedHostname(params)),
+		FQDN:     params.FQDN,
 		Mac:      mac,
 	}
-	lease.BumpExpiry(p.LeaseTime)
+	lease.BumpExpiry(params.LeaseTime)
 	p.insertLease(lease)
 	p.persistLeases()
-	return lease, nil
+	return lease, true
 }
 
 func (p *Pool) ReleaseLeaseByMac(mac MacAddress) (*Lease, bool) {
@@ -178,6 +934,7 @@ func (p *Pool) ReleaseLeaseByMac(mac MacAddress) (*Lease, bool) {
 	if lease, ok := p.leasesByMac[mac]; ok {
 		p.deleteLease(lease)
 		p.persistLeases()
+		p.notify(LeaseEvent{Type: LEASE_RELEASED, Lease: *lease})
 		return lease, true
 	}
 
@@ -201,13 +958,35 @@ func (p *Pool) LoadLeases() (int, error) {
 	for _, lease := range leases {
 		p.insertLease(lease)
 	}
+	clear(p.changed)
 	return len(leases), nil
 }
 
+// Save changed leases, or leave them to the writer if it's running. Must be
+// called with the pool locked
 func (p *Pool) persistLeases() error {
 	if p.Persistence == nil {
 		return nil
 	}
 
-	return p.Persistence.PersistLeases(p.leaseByIp)
+	if p.writerDone != nil {
+		if len(p.changed) >= p.maxDirty() {
+			p.kickWriter()
+		}
+		return nil
+	}
+
+	changed, save := p.takeChanges()
+	if err := save(); err != nil {
+		p.requeue(changed)
+		return err
+	}
+	return nil
+}
+
+// Mark a lease as changed, without it counting as a new binding
+func (p *Pool) touched(ip FixedV4) {
+	if _, ok := p.changed[ip]; !ok {
+		p.changed[ip] = false
+	}
 }
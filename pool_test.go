@@ -93,3 +93,263 @@ func TestIpReservedAllocation(t *testing.T) {
 	require.Equal(t, "host2", lease2.Hostname)
 	require.False(t, lease2.Expired())
 }
+
+func newAllocatorTestPool(allocator Allocator) *Pool {
+	pool := NewPool()
+	pool.Start = net.ParseIP("10.0.0.0")
+	pool.End = net.ParseIP("10.0.0.99")
+	pool.LeaseTime = time.Hour
+	pool.Allocator = allocator
+	return pool
+}
+
+func TestLowestAllocator(t *testing.T) {
+	pool := newAllocatorTestPool(LowestAllocator{})
+	for i := 0; i < 3; i++ {
+		lease, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, byte(i)}, "")
+		require.Nil(t, err)
+		require.Equal(t, IpToFixedV4(net.ParseIP("10.0.0.0"))+FixedV4(i), lease.IP)
+	}
+}
+
+func TestRandomAllocator(t *testing.T) {
+	pool := newAllocatorTestPool(RandomAllocator{})
+
+	// Every address still gets handed out exactly once
+	seen := map[FixedV4]bool{}
+	for i := 0; i < 100; i++ {
+		lease, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, byte(i)}, "")
+		require.Nil(t, err)
+		require.False(t, seen[lease.IP])
+		seen[lease.IP] = true
+	}
+	_, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 1, 0}, "")
+	require.ErrorIs(t, err, ErrNoIps)
+
+	// But not in order
+	pool = newAllocatorTestPool(RandomAllocator{})
+	ordered := true
+	for i := 0; i < 10; i++ {
+		lease, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, byte(i)}, "")
+		require.Nil(t, err)
+		if lease.IP != IpToFixedV4(pool.Start)+FixedV4(i) {
+			ordered = false
+		}
+	}
+	require.False(t, ordered)
+}
+
+func TestHashAllocator(t *testing.T) {
+	clientID := []byte{1, 0, 0x1c, 0x42, 0xb4, 0x6e, 0x1d}
+	params := LeaseParams{LeaseTime: time.Hour, ClientID: clientID}
+
+	pool := newAllocatorTestPool(HashAllocator{})
+	lease, err := pool.GetNextLeaseWithParams(MacAddress{0, 0, 0, 0, 0, 1}, params)
+	require.Nil(t, err)
+	ip := lease.IP
+
+	// The same client gets the same address from a fresh lease database,
+	// even from another NIC, as the client ID is what counts
+	pool = newAllocatorTestPool(HashAllocator{})
+	lease, err = pool.GetNextLeaseWithParams(MacAddress{0, 0, 0, 0, 0, 2}, params)
+	require.Nil(t, err)
+	require.Equal(t, ip, lease.IP)
+
+	// Without a client ID the MAC is used
+	pool = newAllocatorTestPool(HashAllocator{})
+	lease1, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 3}, "")
+	require.Nil(t, err)
+	pool = newAllocatorTestPool(HashAllocator{})
+	lease2, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 3}, "")
+	require.Nil(t, err)
+	require.Equal(t, lease1.IP, lease2.IP)
+
+	// Collisions move on to the next free address, wrapping around
+	pool = newAllocatorTestPool(HashAllocator{})
+	pool.End = pool.Start
+	_, err = pool.GetNextLeaseWithParams(MacAddress{0, 0, 0, 0, 0, 1}, params)
+	require.Nil(t, err)
+	_, err = pool.GetNextLeaseWithParams(MacAddress{0, 0, 0, 0, 0, 2}, params)
+	require.ErrorIs(t, err, ErrNoIps)
+}
+
+func TestLruAllocator(t *testing.T) {
+	pool := newAllocatorTestPool(LruAllocator{})
+	pool.End = net.ParseIP("10.0.0.2")
+
+	mac := func(i int) MacAddress { return MacAddress{0, 0, 0, 0, 0, byte(i)} }
+	ip := func(s string) FixedV4 { return IpToFixedV4(net.ParseIP(s)) }
+
+	// Never used addresses come first
+	for i := 0; i < 3; i++ {
+		_, err := pool.GetNextLease(mac(i), "")
+		require.Nil(t, err)
+	}
+
+	// Then the least recently released
+	pool.ReleaseLeaseByMac(mac(2))
+	time.Sleep(time.Millisecond)
+	pool.ReleaseLeaseByMac(mac(0))
+
+	lease, err := pool.GetNextLease(mac(3), "")
+	require.Nil(t, err)
+	require.Equal(t, ip("10.0.0.2"), lease.IP)
+	lease, err = pool.GetNextLease(mac(4), "")
+	require.Nil(t, err)
+	require.Equal(t, ip("10.0.0.0"), lease.IP)
+
+	// Then the longest expired
+	pool.SetLeaseExpiration(lease, time.Now().Add(-time.Minute))
+	old, _ := pool.TouchLeaseByMac(mac(1))
+	pool.SetLeaseExpiration(old, time.Now().Add(-time.Hour))
+	lease, err = pool.GetNextLease(mac(5), "")
+	require.Nil(t, err)
+	require.Equal(t, ip("10.0.0.1"), lease.IP)
+}
+
+func TestAffinity(t *testing.T) {
+	pool := newAllocatorTestPool(LowestAllocator{})
+	pool.End = net.ParseIP("10.0.0.3")
+	pool.AffinityTime = time.Hour
+
+	mac := func(i int) MacAddress { return MacAddress{0, 0, 0, 0, 0, byte(i)} }
+	ip := func(s string) FixedV4 { return IpToFixedV4(net.ParseIP(s)) }
+
+	for i := 0; i < 3; i++ {
+		_, err := pool.GetNextLease(mac(i), "")
+		require.Nil(t, err)
+	}
+
+	// Released and expired addresses are held while anything else is free
+	pool.ReleaseLeaseByMac(mac(0))
+	expired, _ := pool.TouchLeaseByMac(mac(1))
+	pool.SetLeaseExpiration(expired, time.Now().Add(-time.Minute))
+	lease, err := pool.GetNextLease(mac(3), "")
+	require.Nil(t, err)
+	require.Equal(t, ip("10.0.0.3"), lease.IP)
+
+	// Returning clients get their address back
+	lease, err = pool.GetNextLease(mac(0), "")
+	require.Nil(t, err)
+	require.Equal(t, ip("10.0.0.0"), lease.IP)
+	lease, err = pool.GetNextLease(mac(1), "")
+	require.Nil(t, err)
+	require.Equal(t, ip("10.0.0.1"), lease.IP)
+
+	// Once full, released addresses go before leases which are still held,
+	// and those which expired longer ago than affinity lasts go first
+	pool.ReleaseLeaseByMac(mac(0))
+	pool.SetLeaseExpiration(lease, time.Now().Add(-time.Minute))
+	lease, err = pool.GetNextLease(mac(4), "")
+	require.Nil(t, err)
+	require.Equal(t, ip("10.0.0.0"), lease.IP)
+	lease, err = pool.GetNextLease(mac(5), "")
+	require.Nil(t, err)
+	require.Equal(t, ip("10.0.0.1"), lease.IP)
+
+	old, _ := pool.TouchLeaseByMac(mac(3))
+	pool.SetLeaseExpiration(old, time.Now().Add(-2*time.Hour))
+	held, _ := pool.TouchLeaseByMac(mac(2))
+	pool.SetLeaseExpiration(held, time.Now().Add(-time.Minute))
+	lease, err = pool.GetNextLease(mac(6), "")
+	require.Nil(t, err)
+	require.Equal(t, ip("10.0.0.3"), lease.IP)
+
+	// Whoever took it, the address is no longer the old client's
+	lease, err = pool.GetNextLease(mac(0), "")
+	require.Nil(t, err)
+	require.Equal(t, ip("10.0.0.2"), lease.IP)
+}
+
+// Shared persistence where another server holds some addresses, until the
+// times given
+type claimingPersistence struct {
+	testPersistence
+	heldElsewhere map[FixedV4]time.Time
+}
+
+func (p *claimingPersistence) ClaimLease(ip FixedV4, mac MacAddress, expiration time.Time) (bool, time.Time, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	until, held := p.heldElsewhere[ip]
+	if held && time.Now().Before(until) {
+		return false, until, nil
+	}
+	return true, time.Time{}, nil
+}
+
+func TestRenewalClaim(t *testing.T) {
+	pool := NewPool()
+	pool.Start = net.ParseIP("10.0.0.10")
+	pool.End = net.ParseIP("10.0.0.20")
+	pool.LeaseTime = time.Hour
+	persistence := &claimingPersistence{heldElsewhere: map[FixedV4]time.Time{}}
+	pool.Persistence = persistence
+	var events []LeaseEvent
+	pool.AddListener(func(pool *Pool, event LeaseEvent) {
+		events = append(events, event)
+	})
+
+	mac := MacAddress{0, 0, 0, 0, 0, 1}
+	lease, err := pool.GetNextLease(mac, "")
+	require.Nil(t, err)
+	_, ok := pool.TouchLeaseByMac(mac)
+	require.True(t, ok)
+
+	// Once another server has taken the address over, the lease is dropped
+	// rather than renewed
+	persistence.m.Lock()
+	persistence.heldElsewhere[lease.IP] = time.Now().Add(time.Hour)
+	persistence.m.Unlock()
+	_, ok = pool.TouchLeaseByMac(mac)
+	require.False(t, ok)
+	_, ok = pool.TouchLeaseByMac(mac)
+	require.False(t, ok)
+	require.Equal(t, LEASE_EXPIRED, events[len(events)-1].Type)
+	require.Equal(t, lease.IP, events[len(events)-1].Lease.IP)
+
+	// and the client moves elsewhere
+	lease, err = pool.GetNextLease(mac, "")
+	require.Nil(t, err)
+	require.Equal(t, IpToFixedV4(net.ParseIP("10.0.0.11")), lease.IP)
+}
+
+func TestClaimHeldElsewhere(t *testing.T) {
+	pool := NewPool()
+	pool.Start = net.ParseIP("10.0.0.10")
+	pool.End = net.ParseIP("10.0.0.20")
+	pool.LeaseTime = time.Hour
+	pool.AbandonTime = time.Hour
+	persistence := &claimingPersistence{heldElsewhere: map[FixedV4]time.Time{}}
+	pool.Persistence = persistence
+
+	// An address another server holds is skipped, without abandoning it
+	first := IpToFixedV4(net.ParseIP("10.0.0.10"))
+	persistence.heldElsewhere[first] = time.Now().Add(time.Millisecond * 50)
+	lease, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 1}, "")
+	require.Nil(t, err)
+	require.Equal(t, IpToFixedV4(net.ParseIP("10.0.0.11")), lease.IP)
+	require.False(t, pool.isAbandoned(first))
+
+	// and handed out once the other server's lease ends
+	time.Sleep(time.Millisecond * 60)
+	lease, err = pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 2}, "")
+	require.Nil(t, err)
+	require.Equal(t, first, lease.IP)
+}
+
+func TestParseAllocator(t *testing.T) {
+	for name, expected := range map[string]Allocator{
+		"":       LowestAllocator{},
+		"lowest": LowestAllocator{},
+		"random": RandomAllocator{},
+		"hash":   HashAllocator{},
+		"lru":    LruAllocator{},
+	} {
+		allocator, err := ParseAllocator(name)
+		require.Nil(t, err)
+		require.Equal(t, expected, allocator)
+	}
+	_, err := ParseAllocator("highest")
+	require.NotNil(t, err)
+}
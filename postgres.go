@@ -0,0 +1,317 @@
+//go:build postgres
+
+// Lease persistence in a PostgreSQL database shared by several servers.
+// Servers claim addresses in the database before handing them out or
+// renewing them, so two can't bind the same one, and only update or remove
+// leases they hold
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// Arbitrary key for the advisory lock serializing migrations across servers
+const postgresMigrationLock = 0x6d79676f64686370
+
+// Schema changes, applied in order. Append to this and never edit existing
+// entries
+var postgresMigrations = []string{
+	`CREATE TABLE leases (
+		pool TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		mac TEXT NOT NULL,
+		hostname TEXT NOT NULL DEFAULT '',
+		fqdn TEXT NOT NULL DEFAULT '',
+		expiration TIMESTAMPTZ NOT NULL,
+		version BIGINT NOT NULL DEFAULT 1,
+		server TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (pool, ip)
+	);
+	CREATE INDEX leases_mac ON leases (pool, mac);
+	CREATE INDEX leases_hostname ON leases (hostname);
+	CREATE INDEX leases_expiration ON leases (expiration);`,
+	`ALTER TABLE leases DROP COLUMN version;`,
+}
+
+// Insert a lease, or take over an existing row for the address only if it's
+// the same client's or has expired
+const postgresUpsert = `INSERT INTO leases (pool, ip, mac, hostname, fqdn, expiration, server)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	ON CONFLICT (pool, ip) DO UPDATE SET mac = excluded.mac, hostname = excluded.hostname,
+		fqdn = excluded.fqdn, expiration = excluded.expiration, server = excluded.server
+	WHERE leases.mac = excluded.mac OR leases.expiration < now()`
+
+type PostgresPersistence struct {
+	db     *sql.DB
+	pool   string
+	server string
+
+	// Attempts at each operation when the connection is lost, and how long
+	// to wait before the first retry, doubling each time
+	Retries       int
+	RetryInterval time.Duration
+
+	// Which client holds each address we know of, so we only ever remove
+	// our own leases
+	m     sync.Mutex
+	owned map[FixedV4]MacAddress
+}
+
+func newPostgresPersistence(dsn, pool, server string) (Persistence, error) {
+	return NewPostgresPersistence(dsn, pool, server)
+}
+
+// Persistence for a pool in the database at dsn. Rows are marked as ours
+// with server, or our hostname if that's empty, so it must differ between
+// the servers sharing the database
+func NewPostgresPersistence(dsn, pool, server string) (*PostgresPersistence, error) {
+	if server == "" {
+		var err error
+		if server, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("Failed naming this server for the lease database: %w", err)
+		}
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetConnMaxIdleTime(time.Minute * 5)
+
+	p := &PostgresPersistence{
+		db:            db,
+		pool:          pool,
+		server:        server,
+		Retries:       3,
+		RetryInterval: time.Millisecond * 250,
+		owned:         map[FixedV4]MacAddress{},
+	}
+	if err := p.retry(p.migrate); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed migrating lease database: %w", err)
+	}
+	return p, nil
+}
+
+// Whether an error means the connection went away, rather than the
+// database rejecting what we asked
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// Run an operation, retrying with backoff if the connection is lost. Our
+// operations are idempotent, so retrying one which may have been applied is
+// safe
+func (p *PostgresPersistence) retry(op func() error) error {
+	wait := p.RetryInterval
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || !isConnectionError(err) || attempt >= p.Retries {
+			return err
+		}
+		log.Printf("Lost connection to lease database (%v); retrying in %v", err, wait)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func (p *PostgresPersistence) migrate() error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", postgresMigrationLock); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS mygodhcpd_schema (version INTEGER NOT NULL)"); err != nil {
+		return err
+	}
+
+	var version int
+	err = tx.QueryRow("SELECT version FROM mygodhcpd_schema").Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = tx.Exec("INSERT INTO mygodhcpd_schema (version) VALUES (0)")
+	}
+	if err != nil {
+		return err
+	}
+	if version > len(postgresMigrations) {
+		return fmt.Errorf("Schema version %v is newer than we support (%v)", version, len(postgresMigrations))
+	}
+
+	for i := version; i < len(postgresMigrations); i++ {
+		if _, err := tx.Exec(postgresMigrations[i]); err != nil {
+			return err
+		}
+		log.Printf("Migrating lease database to schema version %v", i+1)
+	}
+	if _, err := tx.Exec("UPDATE mygodhcpd_schema SET version = $1", len(postgresMigrations)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Every lease in our pool, including those other servers hold, though only
+// our own count as ours to remove
+func (p *PostgresPersistence) LoadLeases() (map[FixedV4]*Lease, error) {
+	var leases map[FixedV4]*Lease
+	var owned map[FixedV4]MacAddress
+	err := p.retry(func() error {
+		leases = map[FixedV4]*Lease{}
+		owned = map[FixedV4]MacAddress{}
+		rows, err := p.db.Query("SELECT ip, mac, hostname, fqdn, expiration, server FROM leases WHERE pool = $1", p.pool)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var ip, mac, server string
+			lease := &Lease{}
+			if err := rows.Scan(&ip, &mac, &lease.Hostname, &lease.FQDN, &lease.Expiration, &server); err != nil {
+				return err
+			}
+			lease.IP = IpToFixedV4(net.ParseIP(ip))
+			lease.Mac = StrToMac(mac)
+			leases[lease.IP] = lease
+			if server == p.server {
+				owned[lease.IP] = lease.Mac
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p.m.Lock()
+	p.owned = owned
+	p.m.Unlock()
+	return leases, nil
+}
+
+func (p *PostgresPersistence) ClaimLease(ip FixedV4, mac MacAddress, expiration time.Time) (bool, time.Time, error) {
+	var claimed bool
+	var heldUntil time.Time
+	err := p.retry(func() error {
+		result, err := p.db.Exec(postgresUpsert, p.pool, ip.String(), mac.String(), "", "", expiration, p.server)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		claimed = rows > 0
+		if claimed {
+			return nil
+		}
+
+		// The holder may have let it go since, leaving nothing to wait for
+		err = p.db.QueryRow("SELECT expiration FROM leases WHERE pool = $1 AND ip = $2",
+			p.pool, ip.String()).Scan(&heldUntil)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	p.m.Lock()
+	if claimed {
+		p.owned[ip] = mac
+	} else {
+		delete(p.owned, ip)
+		log.Printf("%v in pool %v is held by another server", ip.String(), p.pool)
+	}
+	p.m.Unlock()
+	return claimed, heldUntil, nil
+}
+
+// Replace our leases, removing any others we hold
+func (p *PostgresPersistence) PersistLeases(leases map[FixedV4]*Lease) error {
+	changed := map[FixedV4]*Lease{}
+	p.m.Lock()
+	for ip := range p.owned {
+		changed[ip] = nil
+	}
+	p.m.Unlock()
+	for ip, lease := range leases {
+		changed[ip] = lease
+	}
+	return p.PersistChanges(changed)
+}
+
+func (p *PostgresPersistence) PersistChanges(changed map[FixedV4]*Lease) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	return p.retry(func() error {
+		tx, err := p.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		lost := []FixedV4{}
+		for ip, lease := range changed {
+			if lease == nil {
+				mac, ok := p.owned[ip]
+				if !ok {
+					continue
+				}
+				if _, err := tx.Exec("DELETE FROM leases WHERE pool = $1 AND ip = $2 AND mac = $3", p.pool, ip.String(), mac.String()); err != nil {
+					return err
+				}
+				continue
+			}
+
+			result, err := tx.Exec(postgresUpsert, p.pool, ip.String(), lease.Mac.String(), lease.Hostname, lease.FQDN, lease.Expiration, p.server)
+			if err != nil {
+				return err
+			}
+			if rows, err := result.RowsAffected(); err != nil {
+				return err
+			} else if rows == 0 {
+				lost = append(lost, ip)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		for ip, lease := range changed {
+			if lease == nil {
+				delete(p.owned, ip)
+			} else {
+				p.owned[ip] = lease.Mac
+			}
+		}
+		for _, ip := range lost {
+			log.Printf("Lease on %v in pool %v was taken over by another server", ip.String(), p.pool)
+			delete(p.owned, ip)
+		}
+		return nil
+	})
+}
+
+func (p *PostgresPersistence) Close() error {
+	return p.db.Close()
+}
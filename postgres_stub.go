@@ -0,0 +1,13 @@
+//go:build !postgres
+
+package main
+
+import (
+	"errors"
+)
+
+// newPostgresPersistence is a stub for builds without the postgres tag,
+// which keeps the PostgreSQL driver out of the default binary
+func newPostgresPersistence(dsn, pool, server string) (Persistence, error) {
+	return nil, errors.New("PostgreSQL lease storage requires building with -tags postgres")
+}
@@ -0,0 +1,119 @@
+//go:build postgres
+
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// Tests run against the database in MYGODHCPD_POSTGRES_DSN, eg
+// postgres://postgres@localhost/mygodhcpd?sslmode=disable
+func newTestPostgres(t *testing.T, pool, server string) *PostgresPersistence {
+	dsn := os.Getenv("MYGODHCPD_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("MYGODHCPD_POSTGRES_DSN not set")
+	}
+	p, err := NewPostgresPersistence(dsn, pool, server)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		p.db.Exec("DELETE FROM leases WHERE pool = $1", pool)
+		p.Close()
+	})
+	return p
+}
+
+func TestPostgresPersistence(t *testing.T) {
+	pool := fmt.Sprintf("test-%v", time.Now().UnixNano())
+	server1 := newTestPostgres(t, pool, "server1")
+	server2 := newTestPostgres(t, pool, "server2")
+
+	ip := IpToFixedV4(net.ParseIP("10.0.0.1"))
+	mac1 := MacAddress{0, 0, 0, 0, 0, 1}
+	mac2 := MacAddress{0, 0, 0, 0, 0, 2}
+
+	// Only one server can claim an address for different clients
+	expiration := time.Now().Add(time.Hour)
+	claimed, _, err := server1.ClaimLease(ip, mac1, expiration)
+	require.Nil(t, err)
+	require.True(t, claimed)
+	claimed, heldUntil, err := server2.ClaimLease(ip, mac2, time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	require.False(t, claimed)
+	require.WithinDuration(t, expiration, heldUntil, time.Millisecond)
+
+	// Though the same client can renew through either
+	claimed, _, err = server2.ClaimLease(ip, mac1, time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	require.True(t, claimed)
+
+	lease := &Lease{IP: ip, Mac: mac1, Hostname: "one", Expiration: time.Now().Add(time.Hour)}
+	require.Nil(t, server1.PersistChanges(map[FixedV4]*Lease{ip: lease}))
+
+	leases, err := server2.LoadLeases()
+	require.Nil(t, err)
+	require.Len(t, leases, 1)
+	require.Equal(t, "one", leases[ip].Hostname)
+	require.Equal(t, mac1, leases[ip].Mac)
+
+	// Writes for another client's address are refused
+	stolen := &Lease{IP: ip, Mac: mac2, Expiration: time.Now().Add(time.Hour)}
+	require.Nil(t, server2.PersistChanges(map[FixedV4]*Lease{ip: stolen}))
+	leases, err = server1.LoadLeases()
+	require.Nil(t, err)
+	require.Equal(t, mac1, leases[ip].Mac)
+
+	// Once expired, it's anybody's
+	expired := *lease
+	expired.Expiration = time.Now().Add(-time.Minute)
+	require.Nil(t, server1.PersistChanges(map[FixedV4]*Lease{ip: &expired}))
+	claimed, _, err = server2.ClaimLease(ip, mac2, time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	require.True(t, claimed)
+
+	// And the old holder removing its lease leaves the new one alone
+	require.Nil(t, server1.PersistChanges(map[FixedV4]*Lease{ip: nil}))
+	leases, err = server1.LoadLeases()
+	require.Nil(t, err)
+	require.Equal(t, mac2, leases[ip].Mac)
+
+	require.Nil(t, server2.PersistChanges(map[FixedV4]*Lease{ip: nil}))
+	leases, err = server1.LoadLeases()
+	require.Nil(t, err)
+	require.Empty(t, leases)
+}
+
+func TestPostgresSharedPool(t *testing.T) {
+	name := fmt.Sprintf("test-%v", time.Now().UnixNano())
+	newPool := func(server string) *Pool {
+		pool := NewPool()
+		pool.Start = net.ParseIP("10.0.0.10")
+		pool.End = net.ParseIP("10.0.0.11")
+		pool.LeaseTime = time.Hour
+		pool.Persistence = newTestPostgres(t, name, server)
+		return pool
+	}
+	pool1, pool2 := newPool("server1"), newPool("server2")
+
+	// Each server skips addresses the other has handed out
+	lease, err := pool1.GetNextLease(MacAddress{0, 0, 0, 0, 0, 1}, "")
+	require.Nil(t, err)
+	require.Equal(t, IpToFixedV4(net.ParseIP("10.0.0.10")), lease.IP)
+
+	lease, err = pool2.GetNextLease(MacAddress{0, 0, 0, 0, 0, 2}, "")
+	require.Nil(t, err)
+	require.Equal(t, IpToFixedV4(net.ParseIP("10.0.0.11")), lease.IP)
+
+	_, err = pool1.GetNextLease(MacAddress{0, 0, 0, 0, 0, 3}, "")
+	require.ErrorIs(t, err, ErrNoIps)
+}
+
+func TestIsConnectionError(t *testing.T) {
+	require.True(t, isConnectionError(&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}))
+	require.False(t, isConnectionError(fmt.Errorf("syntax error")))
+}
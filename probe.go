@@ -0,0 +1,244 @@
+// Address conflict detection: before offering an address, check nothing
+// (eg a statically configured device) is already using it
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// Checks whether an address is in use. iface is the interface the request
+// arrived on, or nil for relayed requests
+type Prober interface {
+	Probe(ip FixedV4, iface *net.Interface, timeout time.Duration) (bool, error)
+}
+
+// Probes with ICMP echo requests, preferring raw sockets and falling back to
+// unprivileged ping sockets
+type IcmpProber struct{}
+
+func (IcmpProber) Probe(ip FixedV4, iface *net.Interface, timeout time.Duration) (bool, error) {
+	network := "ip4:icmp"
+	conn, err := icmp.ListenPacket(network, "0.0.0.0")
+	if errors.Is(err, os.ErrPermission) {
+		network = "udp4"
+		conn, err = icmp.ListenPacket(network, "0.0.0.0")
+	}
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	// Ping sockets overwrite our ID, so replies are matched on sequence
+	id := os.Getpid() & 0xffff
+	seq := rand.Intn(0xffff)
+	request := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("mygodhcpd probe")},
+	}
+	b, err := request.Marshal(nil)
+	if err != nil {
+		return false, err
+	}
+
+	var dst net.Addr = &net.IPAddr{IP: ip.NetIp()}
+	if network == "udp4" {
+		dst = &net.UDPAddr{IP: ip.NetIp()}
+	}
+	if _, err := conn.WriteTo(b, dst); err != nil {
+		return false, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return false, nil
+			}
+			return false, err
+		}
+
+		var peerIp net.IP
+		switch addr := peer.(type) {
+		case *net.IPAddr:
+			peerIp = addr.IP
+		case *net.UDPAddr:
+			peerIp = addr.IP
+		}
+		if !peerIp.Equal(ip.NetIp()) {
+			continue
+		}
+
+		reply, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.Seq == seq {
+			return true, nil
+		}
+	}
+}
+
+// Probes using ARP, per RFC 5227, on the receiving interface. Addresses
+// behind relays can't be probed this way
+type ArpProber struct{}
+
+func (ArpProber) Probe(ip FixedV4, iface *net.Interface, timeout time.Duration) (bool, error) {
+	if iface == nil || len(iface.HardwareAddr) != 6 {
+		return false, nil
+	}
+	return arpProbe(ip, iface, timeout)
+}
+
+// ARP probe request with a zero sender IP, so we don't pollute other hosts'
+// caches
+func arpProbePacket(ip FixedV4, hardwareAddr net.HardwareAddr) []byte {
+	packet := []byte{
+		0, 1, // Ethernet
+		8, 0, // IPv4
+		6, 4, // Address lengths
+		0, 1, // Request
+	}
+	packet = append(packet, hardwareAddr...)
+	packet = append(packet, 0, 0, 0, 0)
+	packet = append(packet, 0, 0, 0, 0, 0, 0)
+	return append(packet, ip.Bytes()...)
+}
+
+// Whether an ARP packet is a reply from ip
+func isArpReplyFrom(packet []byte, ip FixedV4) bool {
+	if len(packet) < 28 || packet[6] != 0 || packet[7] != 2 {
+		return false
+	}
+	sender, err := BytesToFixedV4(packet[14:18])
+	return err == nil && sender == ip
+}
+
+// Runs the configured probers concurrently, caching their verdicts.
+// Concurrent checks of the same address share a single probe
+type ConflictDetector struct {
+	Probers []Prober
+	Timeout time.Duration
+
+	// How long verdicts are remembered for
+	CacheTime time.Duration
+
+	m       sync.Mutex
+	cache   map[FixedV4]probeResult
+	pending map[FixedV4]*pendingProbe
+}
+
+type probeResult struct {
+	inUse bool
+	at    time.Time
+}
+
+// A probe in flight, whose verdict is set before done is closed
+type pendingProbe struct {
+	done  chan struct{}
+	inUse bool
+}
+
+func NewConflictDetector(probers []Prober) *ConflictDetector {
+	return &ConflictDetector{
+		Probers:   probers,
+		Timeout:   time.Millisecond * 500,
+		CacheTime: time.Minute,
+		cache:     map[FixedV4]probeResult{},
+		pending:   map[FixedV4]*pendingProbe{},
+	}
+}
+
+func (d *ConflictDetector) InUse(ip FixedV4, iface *net.Interface) bool {
+	d.m.Lock()
+	if result, ok := d.cache[ip]; ok && time.Since(result.at) < d.CacheTime {
+		d.m.Unlock()
+		return result.inUse
+	}
+	if probe, ok := d.pending[ip]; ok {
+		d.m.Unlock()
+		<-probe.done
+		return probe.inUse
+	}
+	probe := &pendingProbe{done: make(chan struct{})}
+	d.pending[ip] = probe
+	d.m.Unlock()
+
+	results := make(chan bool, len(d.Probers))
+	for _, prober := range d.Probers {
+		go func(prober Prober) {
+			inUse, err := prober.Probe(ip, iface, d.Timeout)
+			if err != nil {
+				log.Printf("Failed probing %v: %v", ip, err)
+			}
+			results <- inUse
+		}(prober)
+	}
+
+	inUse := false
+	for range d.Probers {
+		if <-results {
+			inUse = true
+		}
+	}
+
+	d.m.Lock()
+	d.cache[ip] = probeResult{inUse, time.Now()}
+	for cached, result := range d.cache {
+		if time.Since(result.at) >= d.CacheTime {
+			delete(d.cache, cached)
+		}
+	}
+	delete(d.pending, ip)
+	d.m.Unlock()
+
+	probe.inUse = inUse
+	close(probe.done)
+	return inUse
+}
+
+// Conflict detection settings for a pool. Methods are icmp and/or arp
+type ProbeConf struct {
+	Methods        []string `yaml:"methods"`
+	TimeoutMs      int      `yaml:"timeout_ms"`
+	CacheSeconds   int      `yaml:"cache_seconds"`
+	AbandonSeconds int      `yaml:"abandon_seconds"`
+}
+
+func (pc ProbeConf) ToConflictDetector() (*ConflictDetector, error) {
+	if len(pc.Methods) == 0 {
+		return nil, nil
+	}
+
+	probers := []Prober{}
+	for _, method := range pc.Methods {
+		switch method {
+		case "icmp":
+			probers = append(probers, IcmpProber{})
+		case "arp":
+			probers = append(probers, ArpProber{})
+		default:
+			return nil, fmt.Errorf("Unknown probe method '%v'", method)
+		}
+	}
+
+	detector := NewConflictDetector(probers)
+	if pc.TimeoutMs > 0 {
+		detector.Timeout = time.Millisecond * time.Duration(pc.TimeoutMs)
+	}
+	if pc.CacheSeconds > 0 {
+		detector.CacheTime = time.Second * time.Duration(pc.CacheSeconds)
+	}
+	return detector, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeProber struct {
+	m      sync.Mutex
+	inUse  map[FixedV4]bool
+	probed []FixedV4
+
+	// Called during each probe, to check the pool isn't locked
+	during func()
+}
+
+func (f *fakeProber) Probe(ip FixedV4, iface *net.Interface, timeout time.Duration) (bool, error) {
+	if f.during != nil {
+		f.during()
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.probed = append(f.probed, ip)
+	return f.inUse[ip], nil
+}
+
+func TestConflictDetection(t *testing.T) {
+	pool := NewPool()
+	pool.Start = net.ParseIP("10.0.0.10")
+	pool.End = net.ParseIP("10.0.0.13")
+	pool.LeaseTime = time.Hour
+
+	ip := func(s string) FixedV4 { return IpToFixedV4(net.ParseIP(s)) }
+
+	prober := &fakeProber{inUse: map[FixedV4]bool{ip("10.0.0.10"): true, ip("10.0.0.11"): true}}
+	prober.during = func() {
+		locked := make(chan struct{})
+		go func() {
+			pool.GetReservedHost(MacAddress{})
+			close(locked)
+		}()
+		select {
+		case <-locked:
+		case <-time.After(time.Second):
+			t.Error("Pool was locked while probing")
+		}
+	}
+	pool.ConflictDetector = NewConflictDetector([]Prober{prober})
+
+	require.Nil(t, pool.AddReservedHost(&ReservedHost{Mac: MacAddress{0, 0, 0, 0, 0, 9}, IP: ip("10.0.0.5")}))
+
+	// Addresses in use are abandoned and skipped
+	lease, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 1}, "")
+	require.Nil(t, err)
+	require.Equal(t, ip("10.0.0.12"), lease.IP)
+	require.Equal(t, []FixedV4{ip("10.0.0.10"), ip("10.0.0.11"), ip("10.0.0.12")}, prober.probed)
+
+	// And not probed again while abandoned
+	lease, err = pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 2}, "")
+	require.Nil(t, err)
+	require.Equal(t, ip("10.0.0.13"), lease.IP)
+	require.Len(t, prober.probed, 4)
+
+	_, err = pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 3}, "")
+	require.ErrorIs(t, err, ErrNoIps)
+
+	// Reservations aren't probed
+	lease, err = pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 9}, "")
+	require.Nil(t, err)
+	require.Equal(t, ip("10.0.0.5"), lease.IP)
+	require.Len(t, prober.probed, 4)
+
+	// Abandoned addresses come back eventually
+	pool.m.Lock()
+	pool.abandoned[ip("10.0.0.10")] = time.Now().Add(-time.Second)
+	pool.reindex(ip("10.0.0.10"))
+	pool.m.Unlock()
+	prober.inUse = map[FixedV4]bool{}
+	pool.ConflictDetector.CacheTime = 0
+	lease, err = pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 3}, "")
+	require.Nil(t, err)
+	require.Equal(t, ip("10.0.0.10"), lease.IP)
+}
+
+func TestConflictDetectorCache(t *testing.T) {
+	ip := IpToFixedV4(net.ParseIP("10.0.0.10"))
+	prober := &fakeProber{inUse: map[FixedV4]bool{}}
+	busy := &fakeProber{inUse: map[FixedV4]bool{ip: true}}
+
+	detector := NewConflictDetector([]Prober{prober, busy})
+	require.True(t, detector.InUse(ip, nil))
+	require.True(t, detector.InUse(ip, nil))
+	require.Len(t, prober.probed, 1)
+	require.Len(t, busy.probed, 1)
+
+	detector.CacheTime = 0
+	require.True(t, detector.InUse(ip, nil))
+	require.Len(t, prober.probed, 2)
+}
+
+func TestConflictDetectorCoalesces(t *testing.T) {
+	ip := IpToFixedV4(net.ParseIP("10.0.0.10"))
+	release := make(chan struct{})
+	prober := &fakeProber{inUse: map[FixedV4]bool{ip: true}}
+	prober.during = func() { <-release }
+
+	detector := NewConflictDetector([]Prober{prober})
+	detector.CacheTime = 0
+
+	// Checks of an address already being probed wait for that probe
+	results := make(chan bool, 3)
+	for i := 0; i < 3; i++ {
+		go func() { results <- detector.InUse(ip, nil) }()
+	}
+	require.Eventually(t, func() bool {
+		detector.m.Lock()
+		defer detector.m.Unlock()
+		return detector.pending[ip] != nil
+	}, time.Second, time.Millisecond)
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+
+	for i := 0; i < 3; i++ {
+		require.True(t, <-results)
+	}
+	require.Len(t, prober.probed, 1)
+	require.Empty(t, detector.pending)
+}
+
+func TestArpPackets(t *testing.T) {
+	ip := IpToFixedV4(net.ParseIP("10.0.0.10"))
+	hw := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+
+	packet := arpProbePacket(ip, hw)
+	require.Len(t, packet, 28)
+	require.Equal(t, []byte{0, 1, 8, 0, 6, 4, 0, 1}, packet[:8])
+	require.Equal(t, []byte(hw), packet[8:14])
+	require.Equal(t, []byte{0, 0, 0, 0}, packet[14:18])
+	require.Equal(t, []byte{10, 0, 0, 10}, packet[24:28])
+
+	// Requests aren't replies
+	require.False(t, isArpReplyFrom(packet, ip))
+
+	reply := append([]byte{}, packet...)
+	reply[7] = 2
+	copy(reply[14:18], []byte{10, 0, 0, 10})
+	require.True(t, isArpReplyFrom(reply, ip))
+	require.False(t, isArpReplyFrom(reply, IpToFixedV4(net.ParseIP("10.0.0.11"))))
+	require.False(t, isArpReplyFrom(reply[:20], ip))
+}
+
+func TestProbeConf(t *testing.T) {
+	detector, err := ProbeConf{}.ToConflictDetector()
+	require.Nil(t, err)
+	require.Nil(t, detector)
+
+	detector, err = ProbeConf{Methods: []string{"icmp", "arp"}, TimeoutMs: 200, CacheSeconds: 5}.ToConflictDetector()
+	require.Nil(t, err)
+	require.Len(t, detector.Probers, 2)
+	require.Equal(t, time.Millisecond*200, detector.Timeout)
+	require.Equal(t, time.Second*5, detector.CacheTime)
+
+	_, err = ProbeConf{Methods: []string{"telepathy"}}.ToConflictDetector()
+	require.NotNil(t, err)
+}
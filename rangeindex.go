@@ -0,0 +1,322 @@
+// Index over a pool's address range, so finding the lowest free address or
+// the lowest expired lease doesn't mean walking the whole range
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const neverAvailable = math.MaxInt64
+
+// Segment tree keeping the minimum of its leaves, with lookups for the lowest
+// leaf below a threshold in O(log n). Nodes are only allocated along the
+// paths to leaves which have been set, so huge ranges with few leases stay
+// small: a missing subtree has every leaf at the initial value
+type minTree struct {
+	leaves  int
+	size    int
+	initial int64
+	root    *minNode
+}
+
+type minNode struct {
+	min         int64
+	left, right *minNode
+}
+
+func newMinTree(n int, initial int64) *minTree {
+	leaves := 1
+	for leaves < n {
+		leaves *= 2
+	}
+	return &minTree{leaves: leaves, size: n, initial: initial}
+}
+
+// Minimum of the leaves lo to hi under node. Padding leaves past the end
+// are never available
+func (t *minTree) nodeMin(node *minNode, lo int) int64 {
+	if node != nil {
+		return node.min
+	}
+	if lo >= t.size {
+		return neverAvailable
+	}
+	return t.initial
+}
+
+func (t *minTree) Set(i int, value int64) {
+	t.root = t.set(t.root, 0, t.leaves, i, value)
+}
+
+func (t *minTree) set(node *minNode, lo, hi, i int, value int64) *minNode {
+	if node == nil {
+		node = &minNode{}
+	}
+	if hi-lo == 1 {
+		node.min = value
+		return node
+	}
+	mid := (lo + hi) / 2
+	if i < mid {
+		node.left = t.set(node.left, lo, mid, i, value)
+	} else {
+		node.right = t.set(node.right, mid, hi, i, value)
+	}
+	node.min = min(t.nodeMin(node.left, lo), t.nodeMin(node.right, mid))
+	return node
+}
+
+func (t *minTree) Get(i int) int64 {
+	node, lo, hi := t.root, 0, t.leaves
+	for node != nil && hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if i < mid {
+			node, hi = node.left, mid
+		} else {
+			node, lo = node.right, mid
+		}
+	}
+	return t.nodeMin(node, i)
+}
+
+func (t *minTree) Min() int64 {
+	return t.nodeMin(t.root, 0)
+}
+
+// Lowest leaf with a value below threshold
+func (t *minTree) FirstBelow(threshold int64) (int, bool) {
+	return t.FirstBelowFrom(0, threshold)
+}
+
+// Lowest leaf at or after from with a value below threshold
+func (t *minTree) FirstBelowFrom(from int, threshold int64) (int, bool) {
+	return t.firstBelowFrom(t.root, 0, t.leaves, from, threshold)
+}
+
+func (t *minTree) firstBelowFrom(node *minNode, lo, hi, from int, threshold int64) (int, bool) {
+	if hi <= from || t.nodeMin(node, lo) >= threshold {
+		return 0, false
+	}
+	if node == nil {
+		// Every leaf here is at the initial value, up to the end
+		i := max(lo, from)
+		return i, i < t.size
+	}
+	if hi-lo == 1 {
+		return lo, true
+	}
+	mid := (lo + hi) / 2
+	if i, ok := t.firstBelowFrom(node.left, lo, mid, from, threshold); ok {
+		return i, true
+	}
+	return t.firstBelowFrom(node.right, mid, hi, from, threshold)
+}
+
+// Leaf holding the minimum value, the lowest if several do
+func (t *minTree) ArgMin() int {
+	node, lo, hi := t.root, 0, t.leaves
+	for node != nil && hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if t.nodeMin(node.left, lo) == node.min {
+			node, hi = node.left, mid
+		} else {
+			node, lo = node.right, mid
+		}
+	}
+	return lo
+}
+
+// Tracks three things for every address in a range, as unix nanoseconds:
+//
+//	available  when it became free for anyone to take: 0 when never leased,
+//	           the end of its abandonment or of its previous client's
+//	           affinity, or never while leased or reserved
+//	held       when it was released, while free, so addresses still held for
+//	           their previous client can be handed out longest released first
+//	expiry     when its lease expires, or never without one
+//
+// Allocators try available addresses first, then held ones, then expired
+// leases
+type rangeIndex struct {
+	start, end FixedV4
+	available  *minTree
+	held       *minTree
+	expiry     *minTree
+
+	// How long expired leases stay held for their client
+	affinity time.Duration
+}
+
+func newRangeIndex(start, end FixedV4) *rangeIndex {
+	size := 0
+	if end >= start {
+		size = int(end-start) + 1
+	}
+	return &rangeIndex{
+		start:     start,
+		end:       end,
+		available: newMinTree(size, 0),
+		held:      newMinTree(size, neverAvailable),
+		expiry:    newMinTree(size, neverAvailable),
+	}
+}
+
+func (r *rangeIndex) offset(ip FixedV4) (int, bool) {
+	if ip < r.start || ip > r.end {
+		return 0, false
+	}
+	return int(ip - r.start), true
+}
+
+func (r *rangeIndex) contains(ip FixedV4) bool {
+	_, ok := r.offset(ip)
+	return ok
+}
+
+func (r *rangeIndex) setLease(ip FixedV4, expiration time.Time) {
+	if i, ok := r.offset(ip); ok {
+		r.available.Set(i, neverAvailable)
+		r.held.Set(i, neverAvailable)
+		r.expiry.Set(i, unixNanos(expiration))
+	}
+}
+
+// Nanoseconds since the epoch, saturating for times UnixNano can't
+// represent rather than wrapping around, so a lease ending far in the
+// future doesn't look long expired
+func unixNanos(t time.Time) int64 {
+	if t.After(time.Unix(0, math.MaxInt64)) {
+		return math.MaxInt64
+	}
+	if t.Before(time.Unix(0, math.MinInt64)) {
+		return math.MinInt64
+	}
+	return t.UnixNano()
+}
+
+// Free an address, which stays held for its previous client for affinity
+// after being released
+func (r *rangeIndex) clearLease(ip FixedV4, released time.Time, affinity time.Duration) {
+	i, ok := r.offset(ip)
+	if !ok {
+		return
+	}
+	if released.IsZero() {
+		r.available.Set(i, 0)
+		r.held.Set(i, neverAvailable)
+	} else {
+		r.available.Set(i, unixNanos(released.Add(affinity)))
+		r.held.Set(i, unixNanos(released))
+	}
+	r.expiry.Set(i, neverAvailable)
+}
+
+func (r *rangeIndex) size() int {
+	if r.end < r.start {
+		return 0
+	}
+	return int(r.end-r.start) + 1
+}
+
+// Take an address out of circulation entirely, eg for a reservation
+func (r *rangeIndex) block(ip FixedV4) {
+	if i, ok := r.offset(ip); ok {
+		r.available.Set(i, neverAvailable)
+		r.held.Set(i, neverAvailable)
+		r.expiry.Set(i, neverAvailable)
+	}
+}
+
+func (r *rangeIndex) abandon(ip FixedV4, until time.Time) {
+	if i, ok := r.offset(ip); ok {
+		r.available.Set(i, unixNanos(until))
+		r.held.Set(i, neverAvailable)
+		r.expiry.Set(i, neverAvailable)
+	}
+}
+
+// Lowest address which is free as of now
+func (r *rangeIndex) firstFree(now time.Time) (FixedV4, bool) {
+	return r.firstFreeFrom(0, now)
+}
+
+// First address free as of now at or after offset, wrapping around
+func (r *rangeIndex) firstFreeFrom(offset int, now time.Time) (FixedV4, bool) {
+	threshold := unixNanos(now)
+	if threshold < math.MaxInt64 {
+		threshold++
+	}
+	return r.firstBelowFrom(r.available, offset, threshold)
+}
+
+// Lowest address whose lease expired before now
+func (r *rangeIndex) firstExpired(now time.Time) (FixedV4, bool) {
+	return r.firstExpiredFrom(0, now)
+}
+
+// First address whose lease expired before now at or after offset, wrapping
+// around
+func (r *rangeIndex) firstExpiredFrom(offset int, now time.Time) (FixedV4, bool) {
+	return r.firstBelowFrom(r.expiry, offset, unixNanos(now))
+}
+
+func (r *rangeIndex) firstBelowFrom(tree *minTree, offset int, threshold int64) (FixedV4, bool) {
+	i, ok := tree.FirstBelowFrom(offset, threshold)
+	if !ok && offset > 0 {
+		i, ok = tree.FirstBelow(threshold)
+	}
+	return r.start + FixedV4(i), ok
+}
+
+// Free address which has been free the longest
+func (r *rangeIndex) leastRecentlyFreed(now time.Time) (FixedV4, bool) {
+	if r.available.Min() > unixNanos(now) {
+		return 0, false
+	}
+	return r.start + FixedV4(r.available.ArgMin()), true
+}
+
+// Free address still held for its previous client, which was released the
+// longest ago
+func (r *rangeIndex) longestHeld() (FixedV4, bool) {
+	if r.held.Min() == neverAvailable {
+		return 0, false
+	}
+	return r.start + FixedV4(r.held.ArgMin()), true
+}
+
+// Whether an address is free, even if held for a previous client
+func (r *rangeIndex) isUnleased(ip FixedV4, now time.Time) bool {
+	i, ok := r.offset(ip)
+	return ok && (r.available.Get(i) <= unixNanos(now) || r.held.Get(i) != neverAvailable)
+}
+
+// Once nothing is free, take leases which expired longer ago than affinity
+// lasts, then released addresses still held for their previous client, then
+// leases still held. expired finds a lease which expired before a given time
+func (r *rangeIndex) reclaim(now time.Time, expired func(time.Time) (FixedV4, bool)) (FixedV4, bool) {
+	if ip, ok := expired(now.Add(-r.affinity)); ok {
+		return ip, true
+	}
+	if ip, ok := r.longestHeld(); ok {
+		return ip, true
+	}
+	return expired(now)
+}
+
+// Address whose lease expired the longest ago
+func (r *rangeIndex) earliestExpired(now time.Time) (FixedV4, bool) {
+	if r.expiry.Min() >= unixNanos(now) {
+		return 0, false
+	}
+	return r.start + FixedV4(r.expiry.ArgMin()), true
+}
+
+// When the next lease expires, if any
+func (r *rangeIndex) nextExpiry() (time.Time, bool) {
+	if r.expiry.Min() == neverAvailable {
+		return time.Time{}, false
+	}
+	return time.Unix(0, r.expiry.Min()), true
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"math"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// The original linear scan, kept as a reference for what the index must
+// agree with
+func naiveFreeIp(p *Pool, mac MacAddress) (FixedV4, bool) {
+	if host, ok := p.reservedByMac[mac]; ok {
+		return host.IP, true
+	}
+
+	var foundExpired *Lease
+	for ip := IpToFixedV4(p.Start); ip <= IpToFixedV4(p.End); ip++ {
+		if _, ok := p.reservedByIp[ip]; ok {
+			continue
+		}
+		if until, ok := p.abandoned[ip]; ok && !time.Now().After(until) {
+			continue
+		}
+		if lease, ok := p.leaseByIp[ip]; !ok {
+			return ip, true
+		} else if foundExpired == nil && lease.Expired() {
+			foundExpired = lease
+		}
+	}
+	if foundExpired != nil {
+		return foundExpired.IP, true
+	}
+	return 0, false
+}
+
+func TestMinTree(t *testing.T) {
+	tree := newMinTree(5, 10)
+	require.Equal(t, int64(10), tree.Min())
+
+	_, ok := tree.FirstBelow(10)
+	require.False(t, ok)
+	i, ok := tree.FirstBelow(11)
+	require.True(t, ok)
+	require.Equal(t, 0, i)
+
+	tree.Set(3, 5)
+	tree.Set(4, 1)
+	require.Equal(t, int64(1), tree.Min())
+	i, _ = tree.FirstBelow(6)
+	require.Equal(t, 3, i)
+	i, _ = tree.FirstBelow(2)
+	require.Equal(t, 4, i)
+	require.Equal(t, int64(5), tree.Get(3))
+	require.Equal(t, 4, tree.ArgMin())
+
+	i, ok = tree.FirstBelowFrom(1, 11)
+	require.True(t, ok)
+	require.Equal(t, 1, i)
+	i, ok = tree.FirstBelowFrom(4, 6)
+	require.True(t, ok)
+	require.Equal(t, 4, i)
+	_, ok = tree.FirstBelowFrom(5, 11)
+	require.False(t, ok)
+
+	// Padding leaves past the end never match
+	empty := newMinTree(0, 0)
+	_, ok = empty.FirstBelow(neverAvailable)
+	require.False(t, ok)
+	_, ok = newMinTree(5, 0).FirstBelowFrom(5, neverAvailable)
+	require.False(t, ok)
+}
+
+func TestRangeIndexLargeRange(t *testing.T) {
+	// A /8 only costs memory for the addresses in use
+	start := IpToFixedV4(net.ParseIP("10.0.0.0"))
+	index := newRangeIndex(start, start+1<<24-1)
+	now := time.Now()
+
+	for i := 0; i < 1000; i++ {
+		ip, ok := index.firstFree(now)
+		require.True(t, ok)
+		require.Equal(t, start+FixedV4(i), ip)
+		index.setLease(ip, now.Add(time.Duration(1000-i)*time.Second))
+	}
+	last := start + 1<<24 - 1
+	index.setLease(last, now.Add(-time.Second))
+
+	ip, ok := index.firstFreeFrom(1<<24-1, now)
+	require.True(t, ok)
+	require.Equal(t, start+1000, ip)
+	ip, ok = index.earliestExpired(now)
+	require.True(t, ok)
+	require.Equal(t, last, ip)
+	next, ok := index.nextExpiry()
+	require.True(t, ok)
+	require.Equal(t, now.Add(-time.Second).UnixNano(), next.UnixNano())
+}
+
+func TestRangeIndexDistantTimes(t *testing.T) {
+	start := IpToFixedV4(net.ParseIP("10.0.0.0"))
+	index := newRangeIndex(start, start+2)
+	now := time.Now()
+
+	// Times past 2262 stay in the future rather than wrapping around
+	index.setLease(start, leaseNever.Add(time.Hour*24*365*100))
+	index.clearLease(start+1, now, math.MaxInt64)
+	index.abandon(start+2, time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	_, ok := index.earliestExpired(now)
+	require.False(t, ok)
+	_, ok = index.firstFree(now)
+	require.False(t, ok)
+	ip, ok := index.longestHeld()
+	require.True(t, ok)
+	require.Equal(t, start+1, ip)
+}
+
+func TestRangeIndexMatchesLinearScan(t *testing.T) {
+	for seed := int64(1); seed <= 20; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+
+		pool := NewPool()
+		pool.Start = net.ParseIP("10.0.0.10")
+		pool.End = net.ParseIP("10.0.0.40")
+		pool.LeaseTime = time.Hour
+
+		start := IpToFixedV4(pool.Start)
+		randomMac := func() MacAddress { return MacAddress{0, 0, 0, 0, 0, byte(rng.Intn(48))} }
+
+		// Some reservations inside and outside the range
+		for i := 0; i < 4; i++ {
+			pool.AddReservedHost(&ReservedHost{
+				Mac: MacAddress{0, 0, 0, 0, 1, byte(i)},
+				IP:  start + FixedV4(rng.Intn(40)) - 5,
+			})
+		}
+
+		for step := 0; step < 500; step++ {
+			switch op := rng.Intn(10); {
+			case op < 5:
+				mac := randomMac()
+				if rng.Intn(8) == 0 {
+					mac = MacAddress{0, 0, 0, 0, 1, byte(rng.Intn(4))}
+				}
+				if _, ok := pool.leasesByMac[mac]; ok {
+					continue
+				}
+				expected, ok := naiveFreeIp(pool, mac)
+				lease, err := pool.GetNextLease(mac, "")
+				if !ok {
+					require.ErrorIs(t, err, ErrNoIps, "seed %v step %v", seed, step)
+					continue
+				}
+				require.Nil(t, err)
+				require.Equal(t, expected, lease.IP, "seed %v step %v", seed, step)
+
+			case op < 7:
+				pool.ReleaseLeaseByMac(randomMac())
+
+			case op < 9:
+				if lease, ok := pool.leasesByMac[randomMac()]; ok {
+					offset := time.Duration(rng.Intn(120)-60) * time.Minute
+					pool.SetLeaseExpiration(lease, time.Now().Add(offset))
+				}
+
+			default:
+				ip := start + FixedV4(rng.Intn(31))
+				if _, ok := pool.leaseByIp[ip]; !ok {
+					pool.abandon(ip)
+					if rng.Intn(2) == 0 {
+						pool.abandoned[ip] = time.Now().Add(-time.Second)
+						pool.reindex(ip)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestRangeIndexRebuild(t *testing.T) {
+	pool := NewPool()
+	pool.Start = net.ParseIP("10.0.0.10")
+	pool.End = net.ParseIP("10.0.0.11")
+	pool.LeaseTime = time.Hour
+
+	lease, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 1}, "")
+	require.Nil(t, err)
+	require.Equal(t, IpToFixedV4(net.ParseIP("10.0.0.10")), lease.IP)
+
+	next, ok := pool.index.nextExpiry()
+	require.True(t, ok)
+	require.Equal(t, lease.Expiration.UnixNano(), next.UnixNano())
+
+	// Widening the range keeps existing leases
+	pool.Start = net.ParseIP("10.0.0.9")
+	lease, err = pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 2}, "")
+	require.Nil(t, err)
+	require.Equal(t, IpToFixedV4(net.ParseIP("10.0.0.9")), lease.IP)
+	lease, err = pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 3}, "")
+	require.Nil(t, err)
+	require.Equal(t, IpToFixedV4(net.ParseIP("10.0.0.11")), lease.IP)
+}
+
+// /16 pool, nearly full, cycling a lease in and out
+func BenchmarkGetNextLease(b *testing.B) {
+	pool := NewPool()
+	pool.Start = net.ParseIP("10.0.0.1")
+	pool.End = net.ParseIP("10.0.255.254")
+	pool.LeaseTime = time.Hour
+
+	for i := 0; i < 65000; i++ {
+		mac := MacAddress{0, 0, 0, byte(i >> 16), byte(i >> 8), byte(i)}
+		if _, err := pool.GetNextLease(mac, ""); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	mac := MacAddress{1, 0, 0, 0, 0, 0}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := pool.GetNextLease(mac, ""); err != nil {
+			b.Fatal(err)
+		}
+		pool.ReleaseLeaseByMac(mac)
+	}
+}
+
+// The same, but with every address leased and only the last one expired
+func BenchmarkReclaimExpired(b *testing.B) {
+	pool := NewPool()
+	pool.Start = net.ParseIP("10.0.0.1")
+	pool.End = net.ParseIP("10.0.255.254")
+	pool.LeaseTime = time.Hour
+
+	var last *Lease
+	for i := 0; i < 65534; i++ {
+		mac := MacAddress{0, 0, 0, byte(i >> 16), byte(i >> 8), byte(i)}
+		lease, err := pool.GetNextLease(mac, "")
+		if err != nil {
+			b.Fatal(err)
+		}
+		last = lease
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pool.SetLeaseExpiration(last, time.Now().Add(-time.Minute))
+		mac := MacAddress{1, 0, 0, 0, byte(i >> 8), byte(i)}
+		lease, err := pool.GetNextLease(mac, "")
+		if err != nil {
+			b.Fatal(err)
+		}
+		last = lease
+	}
+}
+
+func BenchmarkMinTreeSet(b *testing.B) {
+	tree := newMinTree(1<<16, 0)
+	for i := 0; i < b.N; i++ {
+		tree.Set(i&0xffff, int64(i))
+	}
+}
@@ -0,0 +1,138 @@
+// Background expiry of leases, so stale bindings don't linger in the lease
+// database until their address happens to be reused
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const defaultReapInterval = time.Minute
+
+// Start reaping expired leases in the background, waking when the next lease
+// expires or every ReapInterval, whichever comes first
+func (p *Pool) StartReaper() {
+	p.m.Lock()
+	if p.reaperDone != nil {
+		p.m.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	p.reaperDone = done
+	p.m.Unlock()
+
+	p.reaperWg.Add(1)
+	go func() {
+		defer p.reaperWg.Done()
+		timer := time.NewTimer(p.nextReap(time.Now()))
+		defer timer.Stop()
+		for {
+			select {
+			case now := <-timer.C:
+				p.Reap(now)
+				timer.Reset(p.nextReap(time.Now()))
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+func (p *Pool) StopReaper() {
+	p.m.Lock()
+	done := p.reaperDone
+	p.reaperDone = nil
+	p.m.Unlock()
+
+	if done != nil {
+		close(done)
+		p.reaperWg.Wait()
+	}
+}
+
+// How long to sleep until the next reap
+func (p *Pool) nextReap(now time.Time) time.Duration {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	wait := p.ReapInterval
+	if wait <= 0 {
+		wait = defaultReapInterval
+	}
+	if next, ok := p.rangeIndex().nextExpiry(); ok {
+		// Expiry is only once now is strictly after the expiration
+		wait = min(wait, next.Sub(now)+time.Millisecond)
+	}
+	return max(wait, 0)
+}
+
+// Remove every lease which expired before now, freeing its address (which
+// stays held for the client for AffinityTime) and emitting LEASE_EXPIRED.
+// Returns how many were removed
+func (p *Pool) Reap(now time.Time) int {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	var expired []*Lease
+
+	// Leases in our range are found through the index, and reserved hosts'
+	// leases, which it doesn't track, directly. Leases left outside the range
+	// by a configuration change are reused or dropped as usual
+	index := p.rangeIndex()
+	reindexed := map[FixedV4]bool{}
+	for {
+		ip, ok := index.earliestExpired(now)
+		if !ok {
+			break
+		}
+		// The index may be stale if a lease's expiry was changed directly,
+		// in which case correcting it moves the address out of the way. If
+		// it doesn't, carrying on would never end
+		lease, ok := p.leaseByIp[ip]
+		if !ok || !now.After(lease.Expiration) {
+			if reindexed[ip] {
+				log.Printf("Lease index for pool %v still has %v as expired; reaping no further", p.Name, ip)
+				break
+			}
+			reindexed[ip] = true
+			p.reindex(ip)
+			continue
+		}
+		p.deleteLease(lease)
+		expired = append(expired, lease)
+	}
+	for ip := range p.reservedByIp {
+		if lease, ok := p.leaseByIp[ip]; ok && now.After(lease.Expiration) {
+			p.deleteLease(lease)
+			expired = append(expired, lease)
+		}
+	}
+
+	p.pruneAffinity(now)
+
+	if len(expired) == 0 {
+		return 0
+	}
+
+	if err := p.persistLeases(); err != nil {
+		log.Printf("Failed persisting leases for pool %v after expiry: %v", p.Name, err)
+	}
+	for _, lease := range expired {
+		if p.Verbose {
+			log.Printf("Lease for %v on %v expired", lease.Mac.String(), lease.IP.String())
+		}
+		p.notify(LeaseEvent{Type: LEASE_EXPIRED, Lease: *lease})
+	}
+	return len(expired)
+}
+
+// Forget which address clients last had once affinity for it has run out,
+// so clients which never return (eg with randomized MACs) don't build up.
+// Must be called with the pool locked
+func (p *Pool) pruneAffinity(now time.Time) {
+	for mac, record := range p.affinity {
+		if now.Sub(record.Released) > p.AffinityTime {
+			delete(p.affinity, mac)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testPersistence struct {
+	m      sync.Mutex
+	saves  int
+	leases map[FixedV4]*Lease
+	err    error
+	syncs  int
+}
+
+func (p *testPersistence) Sync() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.syncs++
+	return nil
+}
+
+func (p *testPersistence) LoadLeases() (map[FixedV4]*Lease, error) {
+	return map[FixedV4]*Lease{}, nil
+}
+
+func (p *testPersistence) PersistLeases(leases map[FixedV4]*Lease) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.saves++
+	p.leases = map[FixedV4]*Lease{}
+	for ip, lease := range leases {
+		p.leases[ip] = lease
+	}
+	return nil
+}
+
+func TestReap(t *testing.T) {
+	pool := NewPool()
+	pool.Start = net.ParseIP("10.0.0.10")
+	pool.End = net.ParseIP("10.0.0.20")
+	pool.LeaseTime = time.Hour
+	pool.AffinityTime = time.Hour
+	persistence := &testPersistence{}
+	pool.Persistence = persistence
+
+	var events []LeaseEvent
+	pool.AddListener(func(pool *Pool, event LeaseEvent) {
+		events = append(events, event)
+	})
+
+	mac := func(i int) MacAddress { return MacAddress{0, 0, 0, 0, 0, byte(i)} }
+	require.Nil(t, pool.AddReservedHost(&ReservedHost{Mac: mac(9), IP: IpToFixedV4(net.ParseIP("10.0.0.5"))}))
+
+	var leases []*Lease
+	for _, i := range []int{1, 2, 3, 9} {
+		lease, err := pool.GetNextLease(mac(i), "")
+		require.Nil(t, err)
+		leases = append(leases, lease)
+	}
+	events = nil
+
+	require.Zero(t, pool.Reap(time.Now()))
+
+	pool.SetLeaseExpiration(leases[0], time.Now().Add(-time.Minute))
+	pool.SetLeaseExpiration(leases[2], time.Now().Add(-time.Hour))
+	pool.SetLeaseExpiration(leases[3], time.Now().Add(-time.Second))
+	saves := persistence.saves
+
+	require.Equal(t, 3, pool.Reap(time.Now()))
+	require.Len(t, events, 3)
+	for _, event := range events {
+		require.Equal(t, LEASE_EXPIRED, event.Type)
+	}
+	require.Equal(t, leases[2].IP, events[0].Lease.IP)
+
+	// Persisted once, with only the live lease left
+	require.Equal(t, saves+1, persistence.saves)
+	require.Len(t, persistence.leases, 1)
+	require.Contains(t, persistence.leases, leases[1].IP)
+
+	_, ok := pool.TouchLeaseByMac(mac(1))
+	require.False(t, ok)
+
+	// The freed address is still held for its client
+	lease, err := pool.GetNextLease(mac(4), "")
+	require.Nil(t, err)
+	require.Equal(t, IpToFixedV4(net.ParseIP("10.0.0.13")), lease.IP)
+	lease, err = pool.GetNextLease(mac(1), "")
+	require.Nil(t, err)
+	require.Equal(t, leases[0].IP, lease.IP)
+}
+
+func TestReaper(t *testing.T) {
+	pool := NewPool()
+	pool.Start = net.ParseIP("10.0.0.10")
+	pool.End = net.ParseIP("10.0.0.20")
+	pool.LeaseTime = time.Millisecond * 50
+
+	expired := make(chan Lease, 1)
+	pool.AddListener(func(pool *Pool, event LeaseEvent) {
+		if event.Type == LEASE_EXPIRED {
+			expired <- event.Lease
+		}
+	})
+
+	// Leases bound while the reaper sleeps are caught when it next wakes
+	pool.ReapInterval = time.Millisecond * 20
+	pool.StartReaper()
+	defer pool.StopReaper()
+
+	lease, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 1}, "")
+	require.Nil(t, err)
+
+	select {
+	case event := <-expired:
+		require.Equal(t, lease.IP, event.IP)
+	case <-time.After(time.Second * 5):
+		t.Fatal("Lease was never reaped")
+	}
+}
+
+func TestReapStaleIndex(t *testing.T) {
+	pool := NewPool()
+	pool.Start = net.ParseIP("10.0.0.10")
+	pool.End = net.ParseIP("10.0.0.11")
+	pool.LeaseTime = time.Hour
+
+	lease, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 1}, "")
+	require.Nil(t, err)
+	pool.SetLeaseExpiration(lease, time.Now().Add(-time.Minute))
+
+	// Renewed behind the pool's back: neither reaped nor handed out
+	lease.Expiration = time.Now().Add(time.Hour)
+	require.Zero(t, pool.Reap(time.Now()))
+	_, err = pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 2}, "")
+	require.Nil(t, err)
+	_, err = pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, 3}, "")
+	require.ErrorIs(t, err, ErrNoIps)
+	found, ok := pool.TouchLeaseByMac(MacAddress{0, 0, 0, 0, 0, 1})
+	require.True(t, ok)
+	require.Equal(t, lease.IP, found.IP)
+}
+
+func TestReapPrunesAffinity(t *testing.T) {
+	pool := NewPool()
+	pool.Start = net.ParseIP("10.0.0.10")
+	pool.End = net.ParseIP("10.0.0.20")
+	pool.LeaseTime = time.Hour
+	pool.AffinityTime = time.Hour
+
+	for i := 1; i <= 3; i++ {
+		mac := MacAddress{0, 0, 0, 0, 0, byte(i)}
+		_, err := pool.GetNextLease(mac, "")
+		require.Nil(t, err)
+		pool.ReleaseLeaseByMac(mac)
+	}
+	require.Len(t, pool.affinity, 3)
+
+	pool.Reap(time.Now().Add(30 * time.Minute))
+	require.Len(t, pool.affinity, 3)
+	pool.Reap(time.Now().Add(2 * time.Hour))
+	require.Empty(t, pool.affinity)
+}
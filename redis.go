@@ -0,0 +1,354 @@
+// Lease persistence in Redis, with a key per lease expiring along with it,
+// so stateless replicas can share leases. Changes are made in transactions
+// watching the leases they touch, so a replica never overwrites or removes
+// a lease another has since given to a different client
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Attempts at a transaction before giving up, should other replicas keep
+// changing the leases it watches
+const redisTxAttempts = 5
+
+type RedisPersistence struct {
+	client *redis.Client
+
+	// Keys are prefixed with this and the pool name
+	prefix string
+
+	// How long each operation may take, including any reconnecting
+	Timeout time.Duration
+
+	// Which client holds each address we know of, so we only ever remove
+	// our own leases
+	m     sync.Mutex
+	owned map[FixedV4]MacAddress
+}
+
+// Persistence for a pool in the Redis at a URL like
+// redis://:password@host:6379/0
+func NewRedisPersistence(rawUrl, pool string) (*RedisPersistence, error) {
+	opts, err := redis.ParseURL(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisPersistence{
+		client:  redis.NewClient(opts),
+		prefix:  "mygodhcpd:" + pool + ":",
+		Timeout: time.Second * 5,
+		owned:   map[FixedV4]MacAddress{},
+	}, nil
+}
+
+func (p *RedisPersistence) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), p.Timeout)
+}
+
+// Run a transaction watching keys, starting over should another replica
+// change any of them before it commits
+func (p *RedisPersistence) watch(ctx context.Context, txn func(*redis.Tx) error, keys ...string) error {
+	for attempt := 1; ; attempt++ {
+		err := p.client.Watch(ctx, txn, keys...)
+		if !errors.Is(err, redis.TxFailedErr) || attempt >= redisTxAttempts {
+			return err
+		}
+	}
+}
+
+func (p *RedisPersistence) leaseKey(ip string) string {
+	return p.prefix + "lease:" + ip
+}
+
+func (p *RedisPersistence) macKey(mac string) string {
+	return p.prefix + "mac:" + mac
+}
+
+func (p *RedisPersistence) hostnameKey(hostname string) string {
+	return p.prefix + "hostname:" + strings.ToLower(hostname)
+}
+
+// Set of every IP we've stored a lease for. Leases expire without us, so
+// it may name some which are gone
+func (p *RedisPersistence) indexKey() string {
+	return p.prefix + "leases"
+}
+
+// The lease stored for each address, nil where there's none
+func (p *RedisPersistence) stored(ctx context.Context, c redis.Cmdable, ips []string) ([]*Lease, error) {
+	keys := make([]string, len(ips))
+	for i, ip := range ips {
+		keys[i] = p.leaseKey(ip)
+	}
+	values, err := c.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	leases := make([]*Lease, len(values))
+	for i, value := range values {
+		stored, ok := value.(string)
+		if !ok {
+			continue
+		}
+		lease, err := p.decode(stored)
+		if err != nil {
+			log.Printf("Ignoring unreadable lease for %v in redis: %v", ips[i], err)
+			continue
+		}
+		leases[i] = lease
+	}
+	return leases, nil
+}
+
+func (p *RedisPersistence) LoadLeases() (map[FixedV4]*Lease, error) {
+	ctx, cancel := p.context()
+	defer cancel()
+
+	members, err := p.client.SMembers(ctx, p.indexKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	leases := map[FixedV4]*Lease{}
+	owned := map[FixedV4]MacAddress{}
+	if len(members) > 0 {
+		stored, err := p.stored(ctx, p.client, members)
+		if err != nil {
+			return nil, err
+		}
+
+		stale := []interface{}{}
+		for i, lease := range stored {
+			if lease == nil {
+				stale = append(stale, members[i])
+				continue
+			}
+			leases[lease.IP] = lease
+			owned[lease.IP] = lease.Mac
+		}
+
+		if len(stale) > 0 {
+			if err := p.client.SRem(ctx, p.indexKey(), stale...).Err(); err != nil {
+				log.Printf("Failed tidying expired leases from redis: %v", err)
+			}
+		}
+	}
+
+	p.m.Lock()
+	p.owned = owned
+	p.m.Unlock()
+	return leases, nil
+}
+
+func (p *RedisPersistence) encode(lease *Lease) (string, error) {
+	encoded, err := json.Marshal(&FilePersistenceLease{
+		Mac:        lease.Mac.String(),
+		Hostname:   lease.Hostname,
+		FQDN:       lease.FQDN,
+		IP:         lease.IP.String(),
+		Expiration: lease.Expiration,
+	})
+	return string(encoded), err
+}
+
+func (p *RedisPersistence) decode(stored string) (*Lease, error) {
+	var lease FilePersistenceLease
+	if err := json.Unmarshal([]byte(stored), &lease); err != nil {
+		return nil, err
+	}
+	return &Lease{
+		Mac:        StrToMac(lease.Mac),
+		Hostname:   lease.Hostname,
+		FQDN:       lease.FQDN,
+		IP:         IpToFixedV4(net.ParseIP(lease.IP)),
+		Expiration: lease.Expiration,
+	}, nil
+}
+
+// Replace our leases, removing any others we hold
+func (p *RedisPersistence) PersistLeases(leases map[FixedV4]*Lease) error {
+	changed := map[FixedV4]*Lease{}
+	p.m.Lock()
+	for ip := range p.owned {
+		changed[ip] = nil
+	}
+	p.m.Unlock()
+	for ip, lease := range leases {
+		changed[ip] = lease
+	}
+	return p.PersistChanges(changed)
+}
+
+func (p *RedisPersistence) PersistChanges(changed map[FixedV4]*Lease) error {
+	if len(changed) == 0 {
+		return nil
+	}
+
+	ctx, cancel := p.context()
+	defer cancel()
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	ips := make([]string, 0, len(changed))
+	keys := make([]string, 0, len(changed))
+	for ip := range changed {
+		ips = append(ips, ip.String())
+		keys = append(keys, p.leaseKey(ip.String()))
+	}
+
+	var lost []FixedV4
+	txn := func(tx *redis.Tx) error {
+		// The previous versions, to check they're still ours and to drop them
+		// from the MAC and hostname indexes
+		stored, err := p.stored(ctx, tx, ips)
+		if err != nil {
+			return err
+		}
+
+		lost = nil
+		now := time.Now()
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, old := range stored {
+				ip := IpToFixedV4(net.ParseIP(ips[i]))
+				lease := changed[ip]
+
+				if lease == nil || !lease.Expiration.After(now) {
+					mac, ok := p.owned[ip]
+					if lease != nil {
+						mac, ok = lease.Mac, true
+					}
+					if old != nil && (!ok || old.Mac != mac) {
+						continue
+					}
+					if old != nil {
+						p.unindex(ctx, pipe, old)
+					}
+					pipe.Del(ctx, keys[i])
+					pipe.SRem(ctx, p.indexKey(), ips[i])
+					continue
+				}
+
+				if old != nil {
+					if old.Mac != lease.Mac {
+						lost = append(lost, ip)
+						continue
+					}
+					p.unindex(ctx, pipe, old)
+				}
+				if err := p.set(ctx, pipe, lease); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		return err
+	}
+	if err := p.watch(ctx, txn, keys...); err != nil {
+		return err
+	}
+
+	for ip, lease := range changed {
+		if lease == nil {
+			delete(p.owned, ip)
+		} else {
+			p.owned[ip] = lease.Mac
+		}
+	}
+	for _, ip := range lost {
+		log.Printf("Lease on %v in redis was taken over by another server", ip.String())
+		delete(p.owned, ip)
+	}
+	return nil
+}
+
+// Queue storing a lease and indexing it, all expiring with it
+func (p *RedisPersistence) set(ctx context.Context, pipe redis.Pipeliner, lease *Lease) error {
+	encoded, err := p.encode(lease)
+	if err != nil {
+		return err
+	}
+	ip := lease.IP.String()
+
+	pipe.Set(ctx, p.leaseKey(ip), encoded, 0)
+	pipe.PExpireAt(ctx, p.leaseKey(ip), lease.Expiration)
+	pipe.SAdd(ctx, p.indexKey(), ip)
+	pipe.SAdd(ctx, p.macKey(lease.Mac.String()), ip)
+	pipe.PExpireAt(ctx, p.macKey(lease.Mac.String()), lease.Expiration)
+	if lease.Hostname != "" {
+		pipe.SAdd(ctx, p.hostnameKey(lease.Hostname), ip)
+		pipe.PExpireAt(ctx, p.hostnameKey(lease.Hostname), lease.Expiration)
+	}
+	return nil
+}
+
+func (p *RedisPersistence) unindex(ctx context.Context, pipe redis.Pipeliner, lease *Lease) {
+	ip := lease.IP.String()
+	pipe.SRem(ctx, p.macKey(lease.Mac.String()), ip)
+	if lease.Hostname != "" {
+		pipe.SRem(ctx, p.hostnameKey(lease.Hostname), ip)
+	}
+}
+
+// Claim an address for a client, unless another replica has it. Leases
+// which expired are gone from redis, so anything stored is live. Claiming
+// the client's own lease moves its expiration, so it doesn't lapse in redis
+// before the renewal is persisted
+func (p *RedisPersistence) ClaimLease(ip FixedV4, mac MacAddress, expiration time.Time) (bool, time.Time, error) {
+	ctx, cancel := p.context()
+	defer cancel()
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	var claimed bool
+	var heldUntil time.Time
+	txn := func(tx *redis.Tx) error {
+		stored, err := p.stored(ctx, tx, []string{ip.String()})
+		if err != nil {
+			return err
+		}
+		lease := &Lease{IP: ip, Mac: mac, Expiration: expiration}
+		if existing := stored[0]; existing != nil {
+			claimed = existing.Mac == mac
+			if !claimed {
+				heldUntil = existing.Expiration
+				return nil
+			}
+			lease.Hostname = existing.Hostname
+			lease.FQDN = existing.FQDN
+		}
+
+		claimed = true
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return p.set(ctx, pipe, lease)
+		})
+		return err
+	}
+	if err := p.watch(ctx, txn, p.leaseKey(ip.String())); err != nil {
+		return false, time.Time{}, err
+	}
+
+	if claimed {
+		p.owned[ip] = mac
+	} else {
+		delete(p.owned, ip)
+		log.Printf("%v is held by another server", ip.String())
+	}
+	return claimed, heldUntil, nil
+}
+
+func (p *RedisPersistence) Close() error {
+	return p.client.Close()
+}
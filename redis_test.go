@@ -0,0 +1,395 @@
+package main
+
+import (
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Just enough of a redis server for RedisPersistence, keeping expirations
+// and counting changes to each key for WATCH
+type fakeRedis struct {
+	m        sync.Mutex
+	strings  map[string]string
+	sets     map[string]map[string]bool
+	expiry   map[string]time.Time
+	versions map[string]int
+	conns    []net.Conn
+
+	// Called before a transaction commits, with the server locked
+	onExec func()
+}
+
+func (f *fakeRedis) expire(key string) {
+	if at, ok := f.expiry[key]; ok && !time.Now().Before(at) {
+		delete(f.strings, key)
+		delete(f.sets, key)
+		delete(f.expiry, key)
+		f.versions[key]++
+	}
+}
+
+// Drop every connection, as if the server restarted
+func (f *fakeRedis) disconnect() {
+	f.m.Lock()
+	defer f.m.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+func readRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var queued [][]string
+	inMulti := false
+	watched := map[string]int{}
+
+	for {
+		args, err := readRedisCommand(r)
+		if err != nil {
+			return
+		}
+
+		f.m.Lock()
+		var response string
+		switch strings.ToUpper(args[0]) {
+		case "MULTI":
+			inMulti = true
+			response = "+OK\r\n"
+		case "EXEC":
+			inMulti = false
+			if f.onExec != nil {
+				f.onExec()
+			}
+			response = fmt.Sprintf("*%d\r\n", len(queued))
+			for key, version := range watched {
+				f.expire(key)
+				if f.versions[key] != version {
+					response = "*-1\r\n"
+					queued = nil
+				}
+			}
+			for _, queuedArgs := range queued {
+				response += f.execute(queuedArgs)
+			}
+			queued = nil
+			watched = map[string]int{}
+		case "WATCH":
+			for _, key := range args[1:] {
+				f.expire(key)
+				watched[key] = f.versions[key]
+			}
+			response = "+OK\r\n"
+		case "UNWATCH":
+			watched = map[string]int{}
+			response = "+OK\r\n"
+		default:
+			if inMulti {
+				queued = append(queued, args)
+				response = "+QUEUED\r\n"
+			} else {
+				response = f.execute(args)
+			}
+		}
+		f.m.Unlock()
+
+		if _, err := conn.Write([]byte(response)); err != nil {
+			return
+		}
+	}
+}
+
+func redisBulk(value string, ok bool) string {
+	if !ok {
+		return "$-1\r\n"
+	}
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
+
+// Run a command, with the server locked
+func (f *fakeRedis) execute(args []string) string {
+	for _, key := range args[1:] {
+		f.expire(key)
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "SET":
+		f.strings[args[1]] = args[2]
+		delete(f.expiry, args[1])
+		f.versions[args[1]]++
+		return "+OK\r\n"
+	case "GET":
+		value, ok := f.strings[args[1]]
+		return redisBulk(value, ok)
+	case "MGET":
+		response := fmt.Sprintf("*%d\r\n", len(args)-1)
+		for _, key := range args[1:] {
+			value, ok := f.strings[key]
+			response += redisBulk(value, ok)
+		}
+		return response
+	case "DEL":
+		delete(f.strings, args[1])
+		delete(f.sets, args[1])
+		delete(f.expiry, args[1])
+		f.versions[args[1]]++
+		return ":1\r\n"
+	case "SADD":
+		if f.sets[args[1]] == nil {
+			f.sets[args[1]] = map[string]bool{}
+		}
+		for _, member := range args[2:] {
+			f.sets[args[1]][member] = true
+		}
+		return ":1\r\n"
+	case "SREM":
+		for _, member := range args[2:] {
+			delete(f.sets[args[1]], member)
+		}
+		return ":1\r\n"
+	case "SMEMBERS":
+		response := fmt.Sprintf("*%d\r\n", len(f.sets[args[1]]))
+		for member := range f.sets[args[1]] {
+			response += redisBulk(member, true)
+		}
+		return response
+	case "PEXPIREAT":
+		ms, _ := strconv.ParseInt(args[2], 10, 64)
+		f.expiry[args[1]] = time.UnixMilli(ms)
+		f.versions[args[1]]++
+		return ":1\r\n"
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+// Redis at MYGODHCPD_REDIS_URL if set, otherwise a fake one, which is
+// returned too
+func newTestRedis(t *testing.T) (string, *fakeRedis) {
+	if url := os.Getenv("MYGODHCPD_REDIS_URL"); url != "" {
+		return url, nil
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	fake := &fakeRedis{
+		strings:  map[string]string{},
+		sets:     map[string]map[string]bool{},
+		expiry:   map[string]time.Time{},
+		versions: map[string]int{},
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			fake.m.Lock()
+			fake.conns = append(fake.conns, conn)
+			fake.m.Unlock()
+			go fake.serve(conn)
+		}
+	}()
+	return "redis://:secret@" + ln.Addr().String() + "/1", fake
+}
+
+func TestRedisPersistence(t *testing.T) {
+	url, _ := newTestRedis(t)
+	pool := fmt.Sprintf("test-%v", time.Now().UnixNano())
+
+	p, err := NewRedisPersistence(url, pool)
+	require.Nil(t, err)
+	defer p.Close()
+	ctx := context.Background()
+
+	a, b := testLease("10.0.0.1", 1), testLease("10.0.0.2", 2)
+	require.Nil(t, p.PersistChanges(map[FixedV4]*Lease{a.IP: a, b.IP: b}))
+
+	leases, err := p.LoadLeases()
+	require.Nil(t, err)
+	require.Len(t, leases, 2)
+	require.True(t, a.Expiration.Equal(leases[a.IP].Expiration))
+	require.Equal(t, a.Hostname, leases[a.IP].Hostname)
+
+	// Indexed by MAC and hostname
+	members, err := p.client.SMembers(ctx, p.macKey(a.Mac.String())).Result()
+	require.Nil(t, err)
+	require.Equal(t, []string{"10.0.0.1"}, members)
+	members, err = p.client.SMembers(ctx, p.hostnameKey(b.Hostname)).Result()
+	require.Nil(t, err)
+	require.Equal(t, []string{"10.0.0.2"}, members)
+
+	// Renaming moves the hostname index
+	renamed := *b
+	renamed.Hostname = "renamed"
+	require.Nil(t, p.PersistChanges(map[FixedV4]*Lease{b.IP: &renamed, a.IP: nil}))
+	members, err = p.client.SMembers(ctx, p.hostnameKey(b.Hostname)).Result()
+	require.Nil(t, err)
+	require.Empty(t, members)
+	members, err = p.client.SMembers(ctx, p.hostnameKey("renamed")).Result()
+	require.Nil(t, err)
+	require.Len(t, members, 1)
+	require.ErrorIs(t, p.client.Get(ctx, p.leaseKey("10.0.0.1")).Err(), redis.Nil)
+
+	// Leases expire in redis along with the lease
+	short := testLease("10.0.0.3", 3)
+	short.Expiration = time.Now().Add(time.Millisecond * 50)
+	require.Nil(t, p.PersistChanges(map[FixedV4]*Lease{short.IP: short}))
+	leases, err = p.LoadLeases()
+	require.Nil(t, err)
+	require.Len(t, leases, 2)
+	time.Sleep(time.Millisecond * 100)
+	leases, err = p.LoadLeases()
+	require.Nil(t, err)
+	require.Len(t, leases, 1)
+
+	// Another replica sees the same leases, and can't claim held addresses
+	other, err := NewRedisPersistence(url, pool)
+	require.Nil(t, err)
+	defer other.Close()
+	leases, err = other.LoadLeases()
+	require.Nil(t, err)
+	require.Len(t, leases, 1)
+
+	claimed, heldUntil, err := other.ClaimLease(b.IP, MacAddress{9, 9, 9, 9, 9, 9}, time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	require.False(t, claimed)
+	require.True(t, heldUntil.Equal(b.Expiration))
+
+	// Claiming the client's own lease renews it there
+	renewed := time.Now().Add(time.Hour * 2)
+	claimed, _, err = other.ClaimLease(b.IP, b.Mac, renewed)
+	require.Nil(t, err)
+	require.True(t, claimed)
+	leases, err = other.LoadLeases()
+	require.Nil(t, err)
+	require.True(t, renewed.Equal(leases[b.IP].Expiration))
+	require.Equal(t, "renamed", leases[b.IP].Hostname)
+
+	claimed, _, err = other.ClaimLease(short.IP, MacAddress{9, 9, 9, 9, 9, 9}, time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	require.True(t, claimed)
+
+	// Nor overwrite them
+	stolen := testLease("10.0.0.2", 9)
+	require.Nil(t, other.PersistChanges(map[FixedV4]*Lease{stolen.IP: stolen}))
+	leases, err = other.LoadLeases()
+	require.Nil(t, err)
+	require.Equal(t, b.Mac, leases[b.IP].Mac)
+
+	// Replacing our leases leaves the address the other replica claimed
+	require.Nil(t, p.PersistLeases(map[FixedV4]*Lease{}))
+	leases, err = other.LoadLeases()
+	require.Nil(t, err)
+	require.Len(t, leases, 1)
+	require.Equal(t, MacAddress{9, 9, 9, 9, 9, 9}, leases[short.IP].Mac)
+}
+
+func TestRedisConcurrentChange(t *testing.T) {
+	url, fake := newTestRedis(t)
+	if fake == nil {
+		t.Skip("Needs the fake redis")
+	}
+	p, err := NewRedisPersistence(url, "concurrent")
+	require.Nil(t, err)
+	defer p.Close()
+
+	lease := testLease("10.0.0.1", 1)
+	require.Nil(t, p.PersistChanges(map[FixedV4]*Lease{lease.IP: lease}))
+
+	// Another replica gives the address to a different client between us
+	// reading the lease and writing it back, so we start over and leave it be
+	taken, err := p.encode(testLease("10.0.0.1", 9))
+	require.Nil(t, err)
+	fake.onExec = func() {
+		fake.strings[p.leaseKey("10.0.0.1")] = taken
+		fake.versions[p.leaseKey("10.0.0.1")]++
+		fake.onExec = nil
+	}
+	renewed := *lease
+	renewed.Hostname = "renewed"
+	require.Nil(t, p.PersistChanges(map[FixedV4]*Lease{lease.IP: &renewed}))
+
+	// Nor is it ours to remove
+	require.Nil(t, p.PersistChanges(map[FixedV4]*Lease{lease.IP: nil}))
+	leases, err := p.LoadLeases()
+	require.Nil(t, err)
+	require.Len(t, leases, 1)
+	require.Equal(t, byte(9), leases[lease.IP].Mac[5])
+}
+
+func TestRedisReconnect(t *testing.T) {
+	url, fake := newTestRedis(t)
+	if fake == nil {
+		t.Skip("Needs the fake redis")
+	}
+	p, err := NewRedisPersistence(url, "reconnect")
+	require.Nil(t, err)
+	defer p.Close()
+
+	_, err = p.LoadLeases()
+	require.Nil(t, err)
+
+	// A dropped connection is replaced transparently
+	fake.disconnect()
+	_, err = p.LoadLeases()
+	require.Nil(t, err)
+}
+
+func TestRedisUrl(t *testing.T) {
+	p, err := NewRedisPersistence("redis://:pw@cache.example.com/3", "lan")
+	require.Nil(t, err)
+	opts := p.client.Options()
+	require.Equal(t, "cache.example.com:6379", opts.Addr)
+	require.Equal(t, "pw", opts.Password)
+	require.Equal(t, 3, opts.DB)
+	require.Equal(t, "mygodhcpd:lan:lease:10.0.0.1", p.leaseKey("10.0.0.1"))
+
+	_, err = NewRedisPersistence("http://cache.example.com", "lan")
+	require.NotNil(t, err)
+	_, err = NewRedisPersistence("redis://cache.example.com/zero", "lan")
+	require.NotNil(t, err)
+}
@@ -7,12 +7,18 @@ import (
 	"net"
 	"sort"
 	"strings"
+	"time"
 )
 
 type RequestHandler struct {
 	header  *MessageHeader
 	options *Options
 	pool    *Pool
+	classes []*ClientClass
+
+	// Interface the request arrived on, for probing addresses. Nil for
+	// relayed requests
+	iface *net.Interface
 }
 
 func NewRequestHandler(message *DHCPMessage, pool *Pool) *RequestHandler {
@@ -20,7 +26,73 @@ func NewRequestHandler(message *DHCPMessage, pool *Pool) *RequestHandler {
 		pool:    pool,
 		header:  message.Header,
 		options: message.Options,
+		classes: MatchClasses(pool.Classes, message),
+	}
+}
+
+// Whether the client's classes allow it to use our pool
+func (r *RequestHandler) Permitted() bool {
+	return r.pool.Permits(r.classes)
+}
+
+// Lease time from the first of the client's classes setting one, falling back
+// to the pool's
+func (r *RequestHandler) LeaseTime() time.Duration {
+	for _, class := range r.classes {
+		if class.LeaseTime > 0 {
+			return class.LeaseTime
+		}
+	}
+	return r.pool.LeaseTime
+}
+
+// Client FQDN (option 81), if the client sent a valid one
+func (r *RequestHandler) ClientFQDN() *ClientFQDN {
+	option, ok := r.options.Get(OPTION_CLIENT_FQDN)
+	if !ok {
+		return nil
+	}
+	fqdn, err := ParseClientFQDN(option.Data)
+	if err != nil {
+		log.Printf("Ignoring invalid client FQDN from %v: %v", r.header.Mac.String(), err)
+		return nil
+	}
+	return fqdn
+}
+
+// Whether we maintain the client's A record. Without option 81, we do so
+// whenever the pool performs updates at all
+func (r *RequestHandler) UpdateForward() bool {
+	if fqdn := r.ClientFQDN(); fqdn != nil {
+		_, updateForward := fqdn.ReplyFlags(r.pool.DdnsUpdates)
+		return updateForward
+	}
+	return r.pool.DdnsUpdates != DDNS_UPDATES_NONE
+}
+
+func (r *RequestHandler) LeaseParams() LeaseParams {
+	params := LeaseParams{
+		LeaseTime: r.LeaseTime(),
+		Interface: r.iface,
+	}
+	if option, ok := r.options.Get(OPTION_HOST_NAME); ok {
+		params.Hostname = string(option.Data)
+	}
+	if option, ok := r.options.Get(OPTION_CLIENT_ID); ok {
+		params.ClientID = option.Data
+	}
+	if fqdn := r.ClientFQDN(); fqdn != nil {
+		params.FQDN = fqdn.Qualify(r.pool.Domain)
 	}
+	return params
+}
+
+func (r *RequestHandler) classNames() string {
+	names := make([]string, len(r.classes))
+	for i, class := range r.classes {
+		names[i] = class.Name
+	}
+	return strings.Join(names, ", ")
 }
 
 func (r *RequestHandler) Handle() *DHCPMessage {
@@ -49,12 +121,19 @@ func (r *RequestHandler) HandleDiscover() *DHCPMessage {
 
 	r.VerboseRequestLogging()
 
-	if lease, ok := r.pool.TouchLeaseByMac(mac); ok {
+	if !r.Permitted() {
+		log.Printf("Classes [%s] of %v not permitted in pool %v", r.classNames(), mac.String(), r.pool.Name)
+		return nil
+	}
+
+	params := r.LeaseParams()
+
+	if lease, ok := r.pool.TouchLeaseByMacWithParams(mac, params); ok {
 		log.Printf("Have old lease for %v: %v", mac.String(), lease.IP.String())
 		return r.SendLeaseInfo(lease, DHCPOFFER)
 	}
 
-	lease, err := r.pool.GetNextLease(mac, hostname)
+	lease, err := r.pool.GetNextLeaseWithParams(mac, params)
 	if err != nil {
 		log.Printf("Could not get a new lease for %v: %v", mac.String(), err)
 		return nil
@@ -69,9 +148,14 @@ func (r *RequestHandler) HandleRequest() *DHCPMessage {
 
 	r.VerboseRequestLogging()
 
+	if !r.Permitted() {
+		log.Printf("Classes [%s] of %v not permitted in pool %v", r.classNames(), mac.String(), r.pool.Name)
+		return r.SendNAK()
+	}
+
 	var lease *Lease
 	var ok bool
-	if lease, ok = r.pool.TouchLeaseByMac(mac); !ok {
+	if lease, ok = r.pool.TouchLeaseByMacWithParams(mac, r.LeaseParams()); !ok {
 		log.Printf("Unrecognized lease for %v", mac.String())
 		return r.SendNAK()
 	}
@@ -82,6 +166,14 @@ func (r *RequestHandler) HandleRequest() *DHCPMessage {
 		return r.SendNAK()
 	}
 
+	// Better the client tries again than holds a binding we could forget
+	if err := r.pool.Commit(lease); err != nil {
+		log.Printf("Failed persisting lease for %v: %v", mac.String(), err)
+		return r.SendNAK()
+	}
+
+	r.pool.LeaseBound(lease, r.UpdateForward())
+
 	// Need to send DHCPACK
 	return r.SendLeaseInfo(lease, DHCPACK)
 }
@@ -125,28 +217,93 @@ func (r *RequestHandler) SendLeaseInfo(lease *Lease, op byte) *DHCPMessage {
 	// Message type
 	options.Set(OPTION_MESSAGE_TYPE, []byte{op})
 
+	// Options from client classes take precedence over the pool's, and
+	// the first class to set an option wins
+	for _, class := range r.classes {
+		for _, option := range class.Options {
+			if _, ok := options.Get(option.Code); !ok {
+				options.Set(option.Code, option.Data)
+			}
+		}
+	}
+
 	// Netmask option
-	options.SetIPs(OPTION_SUBNET, r.pool.Netmask)
+	if _, ok := options.Get(OPTION_SUBNET); !ok {
+		options.SetIPs(OPTION_SUBNET, r.pool.Netmask)
+	}
 
 	// Router (defgw)
-	if len(r.pool.Router) > 0 {
+	if _, ok := options.Get(OPTION_ROUTER); !ok && len(r.pool.Router) > 0 {
 		options.SetIPs(OPTION_ROUTER, r.pool.Router...)
 	}
 
+	// Classless static routes, mirrored into the Microsoft specific option
+	if _, ok := options.Get(OPTION_STATIC_ROUTES); !ok {
+		if routes := r.pool.ClasslessRoutes(options.GetFixedV4s(OPTION_ROUTER)); len(routes) > 0 {
+			data := EncodeClasslessRoutes(routes)
+			options.SetLong(OPTION_STATIC_ROUTES, data)
+			options.SetLong(OPTION_MS_ROUTES, data)
+		}
+	}
+
 	// DNS servers
-	if len(r.pool.Dns) > 0 {
+	if _, ok := options.Get(OPTION_DNS_SERVER); !ok && len(r.pool.Dns) > 0 {
 		options.SetIPs(OPTION_DNS_SERVER, r.pool.Dns...)
 	}
 
+	// Tell clients sending their FQDN who will update DNS
+	if fqdn := r.ClientFQDN(); fqdn != nil {
+		options.Set(OPTION_CLIENT_FQDN, fqdn.EncodeReply(r.pool.DdnsUpdates, r.pool.Domain))
+	}
+
+	// Domain name and search list
+	if _, ok := options.Get(OPTION_DOMAIN_NAME); !ok && r.pool.Domain != "" {
+		options.Set(OPTION_DOMAIN_NAME, []byte(r.pool.Domain))
+	}
+	if _, ok := options.Get(OPTION_DNS_SEARCH); !ok && len(r.pool.Search) > 0 {
+		if data, err := EncodeDomainSearch(r.pool.Search); err == nil {
+			options.SetLong(OPTION_DNS_SEARCH, data)
+		}
+	}
+
 	// Lease time
-	options.Set(OPTION_LEASE_TIME, long2bytes(uint32(r.pool.LeaseTime.Seconds())))
+	if _, ok := options.Get(OPTION_LEASE_TIME); !ok {
+		options.Set(OPTION_LEASE_TIME, long2bytes(uint32(r.LeaseTime().Seconds())))
+	}
 
 	// DHCP server
 	options.SetFixedV4s(OPTION_SERVER_ID, r.pool.MyIp)
 
+	// Vendor-identifying vendor specific options
+	if _, ok := options.Get(OPTION_VIVSO); !ok {
+		if data := VendorIdentifyingOptionsFor(r.pool.VendorIdentifyingOptions, r.options); len(data) > 0 {
+			options.SetLong(OPTION_VIVSO, data)
+		}
+	}
+
+	// PXE or HTTP boot, and vendor specific options
+	if vendorClass := r.VendorClass(); vendorClass != "" {
+		if _, ok := options.Get(OPTION_VENDOR_INFO); !ok {
+			if data, ok := r.pool.VendorOptionsFor(vendorClass); ok {
+				options.Set(OPTION_VENDOR_INFO, data)
+			}
+		}
+		if r.pool.BootConfigFor(r.header.Mac).Apply(vendorClass, header, options) {
+			log.Printf("Sending boot info to %v client %v", vendorClass, r.header.Mac.String())
+		}
+	}
+
 	return &DHCPMessage{header, options}
 }
 
+// Vendor class identifier (option 60) of the client, if it sent one
+func (r *RequestHandler) VendorClass() string {
+	if option, ok := r.options.Get(OPTION_VENDOR); ok {
+		return string(option.Data)
+	}
+	return ""
+}
+
 func (r *RequestHandler) SendNAK() *DHCPMessage {
 	header := &MessageHeader{
 		Op:         BOOT_REPLY,
@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/stretchr/testify/require"
 
+	"bytes"
 	"net"
 	"testing"
 )
@@ -118,3 +119,76 @@ func TestDhcpDiscover(t *testing.T) {
 	require.False(t, ok)
 	require.Nil(t, lease)
 }
+
+func TestBootInfo(t *testing.T) {
+	pool := NewPool()
+	pool.Start = net.ParseIP("10.0.0.10")
+	pool.End = net.ParseIP("10.0.0.20")
+	pool.Netmask = net.ParseIP("255.255.255.0")
+	pool.MyIp = IpToFixedV4(net.ParseIP("10.0.0.254"))
+
+	boot, err := BootConf{
+		NextServer: "10.0.0.5",
+		Filename:   "pxelinux.0",
+		HttpUrl:    "http://10.0.0.5/boot/grubx64.efi",
+	}.ToBootConfig()
+	require.Nil(t, err)
+	pool.Boot = boot
+
+	discover := func(mac MacAddress, vendorClass string) *DHCPMessage {
+		message := NewDhcpMessage()
+		message.Header.Op = BOOT_REQUEST
+		message.Header.Mac = mac
+		message.Options.Set(OPTION_MESSAGE_TYPE, []byte{DHCPDISCOVER})
+		if vendorClass != "" {
+			message.Options.Set(OPTION_VENDOR, []byte(vendorClass))
+		}
+		return NewRequestHandler(message, pool).Handle()
+	}
+
+	filename := func(message *DHCPMessage) string {
+		return string(bytes.TrimRight(message.Header.Filename[:], "\x00"))
+	}
+
+	// UEFI HTTP boot gets its vendor class echoed back and the full URL
+	response := discover(MacAddress{0, 0, 0, 0, 0, 1}, "HTTPClient:Arch:00016:UNDI:003001")
+	opt, ok := response.Options.Get(OPTION_VENDOR)
+	require.True(t, ok)
+	require.Equal(t, []byte("HTTPClient"), opt.Data)
+	opt, ok = response.Options.Get(OPTION_BOOT_FILE)
+	require.True(t, ok)
+	require.Equal(t, []byte("http://10.0.0.5/boot/grubx64.efi"), opt.Data)
+	require.Equal(t, "http://10.0.0.5/boot/grubx64.efi", filename(response))
+	require.Equal(t, pool.MyIp, response.Header.ServerAddr)
+
+	// PXE gets the TFTP filename and next server
+	response = discover(MacAddress{0, 0, 0, 0, 0, 2}, "PXEClient:Arch:00000:UNDI:002001")
+	opt, ok = response.Options.Get(OPTION_VENDOR)
+	require.True(t, ok)
+	require.Equal(t, []byte("PXEClient"), opt.Data)
+	require.Equal(t, "pxelinux.0", filename(response))
+	require.Equal(t, IpToFixedV4(net.ParseIP("10.0.0.5")), response.Header.ServerAddr)
+
+	// Regular clients get neither
+	response = discover(MacAddress{0, 0, 0, 0, 0, 3}, "")
+	_, ok = response.Options.Get(OPTION_VENDOR)
+	require.False(t, ok)
+	require.Equal(t, "", filename(response))
+
+	// Reserved hosts can override the pool's boot settings
+	hostBoot, err := BootConf{HttpUrl: "https://boot.example.com/host.efi"}.ToBootConfig()
+	require.Nil(t, err)
+	err = pool.AddReservedHost(&ReservedHost{
+		Mac:  MacAddress{0, 0, 0, 0, 0, 4},
+		IP:   IpToFixedV4(net.ParseIP("10.0.0.50")),
+		Boot: hostBoot,
+	})
+	require.Nil(t, err)
+
+	response = discover(MacAddress{0, 0, 0, 0, 0, 4}, "HTTPClient")
+	require.Equal(t, "https://boot.example.com/host.efi", filename(response))
+
+	// Invalid URLs are refused
+	_, err = BootConf{HttpUrl: "tftp://10.0.0.5/boot.efi"}.ToBootConfig()
+	require.NotNil(t, err)
+}
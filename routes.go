@@ -0,0 +1,85 @@
+// Helpers for classless static routes (RFC 3442)
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// Static route, as it appears in yaml
+type RouteConf struct {
+	Destination string `yaml:"destination"`
+	Gateway     string `yaml:"gateway"`
+}
+
+type StaticRoute struct {
+	Destination net.IPNet
+	Gateway     FixedV4
+}
+
+func (rc RouteConf) ToRoute() (StaticRoute, error) {
+	var route StaticRoute
+
+	ip, ipnet, err := net.ParseCIDR(rc.Destination)
+	if err != nil || ip.To4() == nil {
+		return route, fmt.Errorf("Invalid route destination %v", rc.Destination)
+	}
+	if !ip.Equal(ipnet.IP) {
+		return route, fmt.Errorf("Route destination %v has host bits set", rc.Destination)
+	}
+
+	gateway := net.ParseIP(rc.Gateway)
+	if gateway == nil || gateway.To4() == nil {
+		return route, fmt.Errorf("Invalid route gateway %v", rc.Gateway)
+	}
+
+	route.Destination = net.IPNet{IP: ipnet.IP.To4(), Mask: ipnet.Mask}
+	route.Gateway = IpToFixedV4(gateway)
+	return route, nil
+}
+
+func (r StaticRoute) IsDefault() bool {
+	ones, _ := r.Destination.Mask.Size()
+	return ones == 0
+}
+
+// Encode routes in the compact format of option 121, where each destination
+// only includes its significant octets
+func EncodeClasslessRoutes(routes []StaticRoute) []byte {
+	buf := []byte{}
+	for _, route := range routes {
+		width, _ := route.Destination.Mask.Size()
+		significant := (width + 7) / 8
+		buf = append(buf, byte(width))
+		buf = append(buf, route.Destination.IP.To4()[:significant]...)
+		buf = append(buf, route.Gateway.Bytes()...)
+	}
+	return buf
+}
+
+// Routes to send clients along with the routers in their reply, which may
+// come from a client class rather than the pool. Clients ignore option 3
+// when given option 121, so the first router also needs to be sent as a
+// default route
+func (p *Pool) ClasslessRoutes(router []FixedV4) []StaticRoute {
+	if len(p.Routes) == 0 {
+		return nil
+	}
+
+	for _, route := range p.Routes {
+		if route.IsDefault() {
+			return p.Routes
+		}
+	}
+
+	if len(router) == 0 {
+		return p.Routes
+	}
+
+	defaultRoute := StaticRoute{
+		Destination: net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+		Gateway:     router[0],
+	}
+
+	return append([]StaticRoute{defaultRoute}, p.Routes...)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"net"
+	"testing"
+)
+
+func TestClasslessRoutes(t *testing.T) {
+	routes := []StaticRoute{}
+	for _, rc := range []RouteConf{
+		{Destination: "10.0.0.0/8", Gateway: "172.17.0.254"},
+		{Destination: "192.168.100.0/24", Gateway: "172.17.0.253"},
+		{Destination: "10.17.32.0/20", Gateway: "172.17.0.252"},
+		{Destination: "172.16.5.9/32", Gateway: "172.17.0.251"},
+	} {
+		route, err := rc.ToRoute()
+		require.Nil(t, err)
+		routes = append(routes, route)
+	}
+
+	// Only significant octets of each destination are encoded
+	require.Equal(t, []byte{
+		8, 10, 172, 17, 0, 254,
+		24, 192, 168, 100, 172, 17, 0, 253,
+		20, 10, 17, 32, 172, 17, 0, 252,
+		32, 172, 16, 5, 9, 172, 17, 0, 251,
+	}, EncodeClasslessRoutes(routes))
+
+	for _, rc := range []RouteConf{
+		{Destination: "10.0.0.1/8", Gateway: "172.17.0.254"},
+		{Destination: "10.0.0.0", Gateway: "172.17.0.254"},
+		{Destination: "fd00::/8", Gateway: "172.17.0.254"},
+		{Destination: "10.0.0.0/8", Gateway: "nope"},
+	} {
+		_, err := rc.ToRoute()
+		require.NotNil(t, err, rc)
+	}
+
+	pool := NewPool()
+	pool.Start = net.ParseIP("172.17.0.10")
+	pool.End = net.ParseIP("172.17.0.20")
+	pool.Netmask = net.ParseIP("255.255.255.0")
+	pool.Router = []net.IP{net.ParseIP("172.17.0.1")}
+	pool.Routes = routes[:1]
+
+	message := NewDhcpMessage()
+	message.Header.Mac = MacAddress{0, 0, 0, 0, 0, 1}
+	message.Options.Set(OPTION_MESSAGE_TYPE, []byte{DHCPDISCOVER})
+	response := NewRequestHandler(message, pool).Handle()
+
+	// The router gets included as the default route, and both options match
+	expected := []byte{0, 172, 17, 0, 1, 8, 10, 172, 17, 0, 254}
+	opt, ok := response.Options.Get(OPTION_STATIC_ROUTES)
+	require.True(t, ok)
+	require.Equal(t, expected, opt.Data)
+	opt, ok = response.Options.Get(OPTION_MS_ROUTES)
+	require.True(t, ok)
+	require.Equal(t, expected, opt.Data)
+	require.Equal(t, []FixedV4{IpToFixedV4(net.ParseIP("172.17.0.1"))}, response.Options.GetFixedV4s(OPTION_ROUTER))
+
+	// A router from the client's class is the default route instead
+	match, err := ParseClassExpr(`mac == "00:00:00:00:00:01"`)
+	require.Nil(t, err)
+	pool.Classes = []*ClientClass{{
+		Name:    "lab",
+		Match:   match,
+		Options: []ConfiguredOption{{Code: OPTION_ROUTER, Data: []byte{172, 17, 0, 3}}},
+	}}
+	response = NewRequestHandler(message, pool).Handle()
+	opt, ok = response.Options.Get(OPTION_STATIC_ROUTES)
+	require.True(t, ok)
+	require.Equal(t, []byte{0, 172, 17, 0, 3, 8, 10, 172, 17, 0, 254}, opt.Data)
+	pool.Classes = nil
+
+	// Unless a default route was configured explicitly
+	router := []FixedV4{IpToFixedV4(net.ParseIP("172.17.0.1"))}
+	defaultRoute, err := RouteConf{Destination: "0.0.0.0/0", Gateway: "172.17.0.2"}.ToRoute()
+	require.Nil(t, err)
+	pool.Routes = []StaticRoute{routes[0], defaultRoute}
+	require.Equal(t, []byte{8, 10, 172, 17, 0, 254, 0, 172, 17, 0, 2}, EncodeClasslessRoutes(pool.ClasslessRoutes(router)))
+
+	// No routes, no options
+	pool.Routes = nil
+	require.Nil(t, pool.ClasslessRoutes(router))
+}
@@ -0,0 +1,161 @@
+//go:build sqlite
+
+// Lease persistence in an SQLite database, updated a lease at a time, which
+// other tools can query while we run
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Schema changes, applied in order. The database's user_version records how
+// many have been applied, so append to this and never edit existing entries
+var sqliteMigrations = []string{
+	`CREATE TABLE leases (
+		ip TEXT PRIMARY KEY,
+		mac TEXT NOT NULL,
+		hostname TEXT NOT NULL DEFAULT '',
+		fqdn TEXT NOT NULL DEFAULT '',
+		expiration INTEGER NOT NULL
+	);
+	CREATE INDEX leases_mac ON leases (mac);
+	CREATE INDEX leases_hostname ON leases (hostname);
+	CREATE INDEX leases_expiration ON leases (expiration);`,
+}
+
+// Leases are rows keyed by IP, with expirations in unix nanoseconds
+type SqlitePersistence struct {
+	db *sql.DB
+}
+
+func newSqlitePersistence(path string) (Persistence, error) {
+	return NewSqlitePersistence(path)
+}
+
+func NewSqlitePersistence(path string) (*SqlitePersistence, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)")
+	if err != nil {
+		return nil, err
+	}
+	// One connection keeps writes serialized without relying on busy waits
+	db.SetMaxOpenConns(1)
+
+	p := &SqlitePersistence{db}
+	if err := p.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed migrating %v: %w", path, err)
+	}
+	return p, nil
+}
+
+func (p *SqlitePersistence) migrate() error {
+	var version int
+	if err := p.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("Schema version %v is newer than we support (%v)", version, len(sqliteMigrations))
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := p.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Migrated lease database to schema version %v", i+1)
+	}
+	return nil
+}
+
+func (p *SqlitePersistence) LoadLeases() (map[FixedV4]*Lease, error) {
+	rows, err := p.db.Query("SELECT ip, mac, hostname, fqdn, expiration FROM leases")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	leases := map[FixedV4]*Lease{}
+	for rows.Next() {
+		var ip, mac, hostname, fqdn string
+		var expiration int64
+		if err := rows.Scan(&ip, &mac, &hostname, &fqdn, &expiration); err != nil {
+			return nil, err
+		}
+		lease := &Lease{
+			IP:         IpToFixedV4(net.ParseIP(ip)),
+			Mac:        StrToMac(mac),
+			Hostname:   hostname,
+			FQDN:       fqdn,
+			Expiration: time.Unix(0, expiration),
+		}
+		leases[lease.IP] = lease
+	}
+	return leases, rows.Err()
+}
+
+// Replace every lease
+func (p *SqlitePersistence) PersistLeases(leases map[FixedV4]*Lease) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM leases"); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, lease := range leases {
+		if err := upsertSqliteLease(tx, lease); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *SqlitePersistence) PersistChanges(changed map[FixedV4]*Lease) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	for ip, lease := range changed {
+		if lease == nil {
+			_, err = tx.Exec("DELETE FROM leases WHERE ip = ?", ip.String())
+		} else {
+			err = upsertSqliteLease(tx, lease)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func upsertSqliteLease(tx *sql.Tx, lease *Lease) error {
+	_, err := tx.Exec(`INSERT INTO leases (ip, mac, hostname, fqdn, expiration) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (ip) DO UPDATE SET mac = excluded.mac, hostname = excluded.hostname,
+			fqdn = excluded.fqdn, expiration = excluded.expiration`,
+		lease.IP.String(), lease.Mac.String(), lease.Hostname, lease.FQDN, unixNanos(lease.Expiration))
+	return err
+}
+
+func (p *SqlitePersistence) Close() error {
+	return p.db.Close()
+}
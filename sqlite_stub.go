@@ -0,0 +1,13 @@
+//go:build !sqlite
+
+package main
+
+import (
+	"errors"
+)
+
+// newSqlitePersistence is a stub for builds without the sqlite tag, which
+// keeps the SQLite driver out of the default binary
+func newSqlitePersistence(path string) (Persistence, error) {
+	return nil, errors.New("SQLite lease storage requires building with -tags sqlite")
+}
@@ -0,0 +1,94 @@
+//go:build sqlite
+
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"database/sql"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSqlitePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pool.db")
+
+	p, err := NewSqlitePersistence(path)
+	require.Nil(t, err)
+	leases, err := p.LoadLeases()
+	require.Nil(t, err)
+	require.Empty(t, leases)
+
+	a, b := testLease("10.0.0.1", 1), testLease("10.0.0.2", 2)
+	b.FQDN = "b.example.com"
+	require.Nil(t, p.PersistLeases(map[FixedV4]*Lease{a.IP: a}))
+	require.Nil(t, p.PersistChanges(map[FixedV4]*Lease{b.IP: b}))
+
+	renewed := *a
+	renewed.Expiration = renewed.Expiration.Add(time.Hour)
+	require.Nil(t, p.PersistChanges(map[FixedV4]*Lease{a.IP: &renewed}))
+	require.Nil(t, p.Close())
+
+	// Reopening doesn't migrate again
+	p, err = NewSqlitePersistence(path)
+	require.Nil(t, err)
+	defer p.Close()
+	leases, err = p.LoadLeases()
+	require.Nil(t, err)
+	require.Len(t, leases, 2)
+	require.True(t, renewed.Expiration.Equal(leases[a.IP].Expiration))
+	require.Equal(t, "b.example.com", leases[b.IP].FQDN)
+	require.Equal(t, b.Mac, leases[b.IP].Mac)
+
+	require.Nil(t, p.PersistChanges(map[FixedV4]*Lease{a.IP: nil}))
+	leases, err = p.LoadLeases()
+	require.Nil(t, err)
+	require.Len(t, leases, 1)
+
+	// Other tools can query the database while we have it open
+	db, err := sql.Open("sqlite", path)
+	require.Nil(t, err)
+	defer db.Close()
+	var hostname string
+	require.Nil(t, db.QueryRow("SELECT hostname FROM leases WHERE mac = ?", b.Mac.String()).Scan(&hostname))
+	require.Equal(t, b.Hostname, hostname)
+	var version int
+	require.Nil(t, db.QueryRow("PRAGMA user_version").Scan(&version))
+	require.Equal(t, len(sqliteMigrations), version)
+}
+
+func TestSqliteNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pool.db")
+	db, err := sql.Open("sqlite", path)
+	require.Nil(t, err)
+	_, err = db.Exec("PRAGMA user_version = 99")
+	require.Nil(t, err)
+	db.Close()
+
+	_, err = NewSqlitePersistence(path)
+	require.NotNil(t, err)
+}
+
+func TestPoolSqlite(t *testing.T) {
+	p, err := NewPersistence(&Conf{Persistence: "sqlite", Leasedir: t.TempDir()}, "pool")
+	require.Nil(t, err)
+	defer p.(*SqlitePersistence).Close()
+
+	pool := NewPool()
+	pool.Start = net.ParseIP("10.0.0.10")
+	pool.End = net.ParseIP("10.0.0.20")
+	pool.LeaseTime = time.Hour
+	pool.Persistence = p
+
+	for i := 1; i <= 3; i++ {
+		_, err := pool.GetNextLease(MacAddress{0, 0, 0, 0, 0, byte(i)}, "")
+		require.Nil(t, err)
+	}
+	pool.ReleaseLeaseByMac(MacAddress{0, 0, 0, 0, 0, 2})
+
+	count, err := pool.LoadLeases()
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+}
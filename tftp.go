@@ -0,0 +1,383 @@
+// Minimal read-only TFTP server (RFC 1350) for serving network boot files,
+// supporting the blksize, tsize and timeout options (RFC 2347, 2348, 2349)
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TFTP opcodes
+const (
+	TFTP_RRQ   uint16 = 1
+	TFTP_WRQ   uint16 = 2
+	TFTP_DATA  uint16 = 3
+	TFTP_ACK   uint16 = 4
+	TFTP_ERROR uint16 = 5
+	TFTP_OACK  uint16 = 6
+)
+
+// TFTP error codes
+const (
+	TFTP_ERR_UNDEFINED        uint16 = 0
+	TFTP_ERR_NOT_FOUND        uint16 = 1
+	TFTP_ERR_ACCESS_VIOLATION uint16 = 2
+	TFTP_ERR_ILLEGAL_OP       uint16 = 4
+	TFTP_ERR_UNKNOWN_TID      uint16 = 5
+	TFTP_ERR_BAD_OPTION       uint16 = 8
+)
+
+const (
+	tftpDefaultBlockSize = 512
+	tftpMinBlockSize     = 8
+	tftpMaxBlockSize     = 65464
+	tftpMaxTimeout       = 255
+)
+
+var ErrTftpTimeout = errors.New("Timed out waiting for ACK")
+
+type TftpServer struct {
+	Root    *os.Root
+	Timeout time.Duration
+	Retries int
+}
+
+// Serve files out of dir. All lookups are confined to it, including via
+// symlinks
+func NewTftpServer(dir string) (*TftpServer, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &TftpServer{
+		Root:    root,
+		Timeout: time.Second * 3,
+		Retries: 5,
+	}, nil
+}
+
+func (s *TftpServer) ListenAndServe(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Printf("TFTP server listening on %v", conn.LocalAddr())
+	return s.Serve(conn)
+}
+
+// Accept requests on conn. Each transfer gets its own socket and goroutine
+func (s *TftpServer) Serve(conn *net.UDPConn) error {
+	buf := make([]byte, 1500)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Printf("TFTP: failed reading request: %v", err)
+			continue
+		}
+
+		request := make([]byte, n)
+		copy(request, buf[:n])
+
+		go s.handleRequest(request, remote)
+	}
+}
+
+func (s *TftpServer) Close() error {
+	return s.Root.Close()
+}
+
+// A parsed RRQ or WRQ
+type tftpRequest struct {
+	Op       uint16
+	Filename string
+	Mode     string
+	Options  map[string]string
+}
+
+func parseTftpRequest(b []byte) (*tftpRequest, error) {
+	if len(b) < 2 {
+		return nil, errors.New("Packet too short")
+	}
+
+	req := &tftpRequest{
+		Op:      binary.BigEndian.Uint16(b),
+		Options: map[string]string{},
+	}
+
+	// Remaining fields are all nul terminated strings
+	fields := strings.Split(string(b[2:]), "\x00")
+	if len(fields) < 3 || fields[len(fields)-1] != "" {
+		return nil, errors.New("Malformed request")
+	}
+	fields = fields[:len(fields)-1]
+
+	req.Filename = fields[0]
+	req.Mode = strings.ToLower(fields[1])
+
+	for i := 2; i+1 < len(fields); i += 2 {
+		req.Options[strings.ToLower(fields[i])] = fields[i+1]
+	}
+
+	return req, nil
+}
+
+// State of a single outgoing transfer
+type tftpTransfer struct {
+	conn      *net.UDPConn
+	remote    *net.UDPAddr
+	blockSize int
+	timeout   time.Duration
+	retries   int
+}
+
+func (s *TftpServer) handleRequest(b []byte, remote *net.UDPAddr) {
+	// Per RFC 1350, each transfer uses a fresh port as its transfer ID
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		log.Printf("TFTP: failed opening transfer socket for %v: %v", remote, err)
+		return
+	}
+	defer conn.Close()
+
+	t := &tftpTransfer{
+		conn:      conn,
+		remote:    remote,
+		blockSize: tftpDefaultBlockSize,
+		timeout:   s.Timeout,
+		retries:   s.Retries,
+	}
+
+	req, err := parseTftpRequest(b)
+	if err != nil {
+		log.Printf("TFTP: bad request from %v: %v", remote, err)
+		t.sendError(TFTP_ERR_ILLEGAL_OP, err.Error())
+		return
+	}
+
+	if req.Op != TFTP_RRQ {
+		log.Printf("TFTP: refusing op %v from %v; server is read-only", req.Op, remote)
+		t.sendError(TFTP_ERR_ACCESS_VIOLATION, "Server is read-only")
+		return
+	}
+
+	// netascii is served unconverted; boot files are binary anyway
+	if req.Mode != "octet" && req.Mode != "netascii" {
+		t.sendError(TFTP_ERR_ILLEGAL_OP, "Unsupported mode "+req.Mode)
+		return
+	}
+
+	file, size, err := s.open(req.Filename)
+	if err != nil {
+		log.Printf("TFTP: %v requested %v: %v", remote, req.Filename, err)
+		if errors.Is(err, fs.ErrNotExist) {
+			t.sendError(TFTP_ERR_NOT_FOUND, "File not found")
+		} else {
+			t.sendError(TFTP_ERR_ACCESS_VIOLATION, "Access violation")
+		}
+		return
+	}
+	defer file.Close()
+
+	log.Printf("TFTP: sending %v (%d bytes) to %v", req.Filename, size, remote)
+	start := time.Now()
+
+	oack, err := t.negotiate(req.Options, size)
+	if err != nil {
+		log.Printf("TFTP: bad options from %v: %v", remote, err)
+		t.sendError(TFTP_ERR_BAD_OPTION, err.Error())
+		return
+	}
+
+	if len(oack) > 0 {
+		// Client acknowledges an OACK with an ACK of block 0
+		if err := t.sendAndWait(oack, 0); err != nil {
+			log.Printf("TFTP: transfer of %v to %v failed: %v", req.Filename, remote, err)
+			return
+		}
+	}
+
+	sent, err := t.sendFile(file)
+	if err != nil {
+		log.Printf("TFTP: transfer of %v to %v failed after %d bytes: %v", req.Filename, remote, sent, err)
+		return
+	}
+
+	log.Printf("TFTP: sent %v (%d bytes) to %v in %v", req.Filename, sent, remote, time.Since(start))
+}
+
+// Open a regular file under our root. Clients commonly send leading slashes
+// and DOS style separators, so normalize those
+func (s *TftpServer) open(filename string) (*os.File, int64, error) {
+	name := strings.TrimLeft(strings.ReplaceAll(filename, "\\", "/"), "/")
+	if name == "" {
+		return nil, 0, fs.ErrNotExist
+	}
+
+	file, err := s.Root.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, 0, fmt.Errorf("Not a regular file")
+	}
+
+	return file, info.Size(), nil
+}
+
+// Apply supported options requested by the client, returning the OACK
+// payload, if any options were accepted
+func (t *tftpTransfer) negotiate(options map[string]string, size int64) ([]byte, error) {
+	accepted := []string{}
+
+	if value, ok := options["blksize"]; ok {
+		blockSize, err := strconv.Atoi(value)
+		if err != nil || blockSize < tftpMinBlockSize {
+			return nil, fmt.Errorf("Invalid blksize %v", value)
+		}
+		// Per RFC 2348 we may respond with a smaller block size than requested
+		if blockSize > tftpMaxBlockSize {
+			blockSize = tftpMaxBlockSize
+		}
+		t.blockSize = blockSize
+		accepted = append(accepted, "blksize", strconv.Itoa(blockSize))
+	}
+
+	if value, ok := options["timeout"]; ok {
+		timeout, err := strconv.Atoi(value)
+		if err != nil || timeout < 1 || timeout > tftpMaxTimeout {
+			return nil, fmt.Errorf("Invalid timeout %v", value)
+		}
+		t.timeout = time.Duration(timeout) * time.Second
+		accepted = append(accepted, "timeout", value)
+	}
+
+	if _, ok := options["tsize"]; ok {
+		accepted = append(accepted, "tsize", strconv.FormatInt(size, 10))
+	}
+
+	if len(accepted) == 0 {
+		return nil, nil
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, TFTP_OACK)
+	for _, field := range accepted {
+		buf.WriteString(field)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes(), nil
+}
+
+func (t *tftpTransfer) sendFile(file io.Reader) (int64, error) {
+	var sent int64
+	var block uint16 = 1
+
+	packet := make([]byte, 4+t.blockSize)
+	binary.BigEndian.PutUint16(packet, TFTP_DATA)
+
+	for {
+		n, err := io.ReadFull(file, packet[4:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			t.sendError(TFTP_ERR_UNDEFINED, "Read error")
+			return sent, err
+		}
+
+		binary.BigEndian.PutUint16(packet[2:], block)
+		if err := t.sendAndWait(packet[:4+n], block); err != nil {
+			return sent, err
+		}
+		sent += int64(n)
+
+		// A short block signals the end of the transfer
+		if n < t.blockSize {
+			return sent, nil
+		}
+
+		// Block numbers roll over for files larger than 65535 blocks
+		block++
+	}
+}
+
+// Send packet and wait for the matching ACK, retransmitting on timeout
+func (t *tftpTransfer) sendAndWait(packet []byte, block uint16) error {
+	buf := make([]byte, 516)
+
+	for attempt := 0; attempt <= t.retries; attempt++ {
+		if _, err := t.conn.WriteToUDP(packet, t.remote); err != nil {
+			return err
+		}
+
+		deadline := time.Now().Add(t.timeout)
+		for {
+			t.conn.SetReadDeadline(deadline)
+			n, remote, err := t.conn.ReadFromUDP(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return err
+			}
+
+			// Packets from anyone else get an error, without disturbing our transfer
+			if !remote.IP.Equal(t.remote.IP) || remote.Port != t.remote.Port {
+				t.sendErrorTo(remote, TFTP_ERR_UNKNOWN_TID, "Unknown transfer ID")
+				continue
+			}
+
+			if n < 4 {
+				continue
+			}
+
+			switch binary.BigEndian.Uint16(buf) {
+			case TFTP_ACK:
+				// Duplicate ACKs of earlier blocks are ignored
+				if binary.BigEndian.Uint16(buf[2:]) == block {
+					return nil
+				}
+			case TFTP_ERROR:
+				return fmt.Errorf("Client aborted: %s", bytes.TrimRight(buf[4:n], "\x00"))
+			}
+		}
+	}
+
+	return ErrTftpTimeout
+}
+
+func (t *tftpTransfer) sendError(code uint16, message string) {
+	t.sendErrorTo(t.remote, code, message)
+}
+
+func (t *tftpTransfer) sendErrorTo(remote *net.UDPAddr, code uint16, message string) {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, TFTP_ERROR)
+	binary.Write(buf, binary.BigEndian, code)
+	buf.WriteString(message)
+	buf.WriteByte(0)
+	t.conn.WriteToUDP(buf.Bytes(), remote)
+}
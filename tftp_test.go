@@ -0,0 +1,146 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startTestTftpServer(t *testing.T) (*net.UDPAddr, string) {
+	dir := t.TempDir()
+
+	server, err := NewTftpServer(dir)
+	require.Nil(t, err)
+	server.Timeout = time.Millisecond * 200
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+
+	go server.Serve(conn)
+	t.Cleanup(func() {
+		conn.Close()
+		server.Close()
+	})
+
+	return conn.LocalAddr().(*net.UDPAddr), dir
+}
+
+// Fetch a file, returning its contents, the OACK options or the error message
+func tftpGet(t *testing.T, server *net.UDPAddr, filename string, options ...string) ([]byte, map[string]string, string) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer conn.Close()
+
+	req := new(bytes.Buffer)
+	binary.Write(req, binary.BigEndian, TFTP_RRQ)
+	for _, field := range append([]string{filename, "octet"}, options...) {
+		req.WriteString(field)
+		req.WriteByte(0)
+	}
+	_, err = conn.WriteToUDP(req.Bytes(), server)
+	require.Nil(t, err)
+
+	ack := func(remote *net.UDPAddr, block uint16) {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint16(b, TFTP_ACK)
+		binary.BigEndian.PutUint16(b[2:], block)
+		conn.WriteToUDP(b, remote)
+	}
+
+	contents := new(bytes.Buffer)
+	oack := map[string]string{}
+	blockSize := 512
+	var expected uint16 = 1
+
+	buf := make([]byte, 70000)
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+		n, remote, err := conn.ReadFromUDP(buf)
+		require.Nil(t, err)
+
+		// Transfers happen on a different port than the one we sent the request to
+		require.NotEqual(t, server.Port, remote.Port)
+
+		switch binary.BigEndian.Uint16(buf) {
+		case TFTP_ERROR:
+			return nil, nil, string(bytes.TrimRight(buf[4:n], "\x00"))
+		case TFTP_OACK:
+			fields := strings.Split(string(buf[2:n-1]), "\x00")
+			for i := 0; i+1 < len(fields); i += 2 {
+				oack[fields[i]] = fields[i+1]
+			}
+			if value, ok := oack["blksize"]; ok {
+				blockSize, err = strconv.Atoi(value)
+				require.Nil(t, err)
+			}
+			ack(remote, 0)
+		case TFTP_DATA:
+			block := binary.BigEndian.Uint16(buf[2:])
+			require.Equal(t, expected, block)
+			contents.Write(buf[4:n])
+			ack(remote, block)
+			expected++
+			if n-4 < blockSize {
+				return contents.Bytes(), oack, ""
+			}
+		}
+	}
+}
+
+func TestTftpTransfers(t *testing.T) {
+	server, dir := startTestTftpServer(t)
+
+	// Exact multiple of the block size, which needs a trailing empty block
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "efi"), 0755))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "efi", "boot.efi"), payload, 0644))
+
+	// Plain RFC 1350 transfer
+	contents, oack, errMsg := tftpGet(t, server, "efi/boot.efi")
+	require.Equal(t, "", errMsg)
+	require.Equal(t, payload, contents)
+	require.Empty(t, oack)
+
+	// Negotiated options, with a leading slash and DOS separators
+	contents, oack, errMsg = tftpGet(t, server, "\\efi\\boot.efi", "blksize", "1468", "tsize", "0", "timeout", "2")
+	require.Equal(t, "", errMsg)
+	require.Equal(t, payload, contents)
+	require.Equal(t, map[string]string{"blksize": "1468", "tsize": "1024", "timeout": "2"}, oack)
+
+	// Missing files
+	_, _, errMsg = tftpGet(t, server, "nope.efi")
+	require.Equal(t, "File not found", errMsg)
+
+	// Escaping the root, directly or via symlinks
+	_, _, errMsg = tftpGet(t, server, "../../../../etc/passwd")
+	require.Equal(t, "Access violation", errMsg)
+
+	require.Nil(t, os.Symlink("/etc/passwd", filepath.Join(dir, "passwd")))
+	_, _, errMsg = tftpGet(t, server, "passwd")
+	require.Equal(t, "Access violation", errMsg)
+
+	// Directories
+	_, _, errMsg = tftpGet(t, server, "efi")
+	require.Equal(t, "Access violation", errMsg)
+}
+
+func TestParseTftpRequest(t *testing.T) {
+	req, err := parseTftpRequest([]byte("\x00\x01pxelinux.0\x00OCTET\x00BLKSIZE\x001432\x00"))
+	require.Nil(t, err)
+	require.Equal(t, TFTP_RRQ, req.Op)
+	require.Equal(t, "pxelinux.0", req.Filename)
+	require.Equal(t, "octet", req.Mode)
+	require.Equal(t, map[string]string{"blksize": "1432"}, req.Options)
+
+	// Missing terminator
+	_, err = parseTftpRequest([]byte("\x00\x01pxelinux.0\x00octet"))
+	require.NotNil(t, err)
+}
@@ -0,0 +1,137 @@
+// Helpers for the Vendor-Identifying vendor options (RFC 3925), which scope
+// vendor classes (option 124) and vendor specific information (option 125)
+// by IANA enterprise number
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// A single enterprise-number scoped block within option 124 or 125
+type EnterpriseData struct {
+	Enterprise uint32
+	Data       []byte
+}
+
+// Split the value of option 124 or 125 into its per enterprise blocks
+func ParseEnterpriseData(data []byte) ([]EnterpriseData, error) {
+	result := []EnterpriseData{}
+	for i := 0; i < len(data); {
+		if i+5 > len(data) {
+			return nil, fmt.Errorf("Truncated enterprise block")
+		}
+		enterprise := binary.BigEndian.Uint32(data[i:])
+		length := int(data[i+4])
+		if i+5+length > len(data) {
+			return nil, fmt.Errorf("Enterprise %v data length %v overflows", enterprise, length)
+		}
+		result = append(result, EnterpriseData{enterprise, data[i+5 : i+5+length]})
+		i += 5 + length
+	}
+	return result, nil
+}
+
+func EncodeEnterpriseData(blocks []EnterpriseData) ([]byte, error) {
+	buf := []byte{}
+	for _, block := range blocks {
+		if len(block.Data) > 255 {
+			return nil, fmt.Errorf("Enterprise %v data too long", block.Enterprise)
+		}
+		buf = binary.BigEndian.AppendUint32(buf, block.Enterprise)
+		buf = append(buf, byte(len(block.Data)))
+		buf = append(buf, block.Data...)
+	}
+	return buf, nil
+}
+
+// Vendor classes from option 124, by enterprise number. Each enterprise's
+// length prefixed class data items are comma joined
+func ParseVendorIdentifyingClasses(data []byte) (map[uint32]string, error) {
+	blocks, err := ParseEnterpriseData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[uint32]string{}
+	for _, block := range blocks {
+		classes := []string{}
+		for i := 0; i < len(block.Data); {
+			length := int(block.Data[i])
+			if i+1+length > len(block.Data) {
+				return nil, fmt.Errorf("Enterprise %v class data overflows", block.Enterprise)
+			}
+			classes = append(classes, string(block.Data[i+1:i+1+length]))
+			i += 1 + length
+		}
+		result[block.Enterprise] = strings.Join(classes, ",")
+	}
+	return result, nil
+}
+
+// Option 125 sub-options for one enterprise number
+type VendorIdentifyingConf struct {
+	Enterprise uint32       `yaml:"enterprise"`
+	SubOptions []OptionConf `yaml:"suboptions"`
+}
+
+func (vc VendorIdentifyingConf) ToEnterpriseData() (EnterpriseData, error) {
+	var result EnterpriseData
+
+	if vc.Enterprise == 0 {
+		return result, fmt.Errorf("Vendor-identifying options need an enterprise number")
+	}
+
+	data, err := encodeSubOptionConfs(vc.SubOptions)
+	if err != nil {
+		return result, fmt.Errorf("Enterprise %v: %v", vc.Enterprise, err)
+	}
+	if len(data) > 255 {
+		return result, fmt.Errorf("Enterprise %v sub-options too long", vc.Enterprise)
+	}
+
+	result.Enterprise = vc.Enterprise
+	result.Data = data
+	return result, nil
+}
+
+// Option 125 payload for the client. Clients get the blocks for enterprises
+// they identified with in option 124, or all of them if they asked for
+// option 125 without sending 124
+func VendorIdentifyingOptionsFor(blocks []EnterpriseData, options *Options) []byte {
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	selected := []EnterpriseData{}
+
+	if option, ok := options.Get(OPTION_VIVC); ok {
+		classes, err := ParseVendorIdentifyingClasses(option.Data)
+		if err != nil {
+			return nil
+		}
+		for _, block := range blocks {
+			if _, ok := classes[block.Enterprise]; ok {
+				selected = append(selected, block)
+			}
+		}
+	} else if option, ok := options.Get(OPTION_PARAM_REQ); ok {
+		for _, code := range option.Data {
+			if code == OPTION_VIVSO {
+				selected = blocks
+				break
+			}
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil
+	}
+
+	data, err := EncodeEnterpriseData(selected)
+	if err != nil {
+		return nil
+	}
+	return data
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestVendorIdentifyingOptions(t *testing.T) {
+	// Option 124 with two enterprises, the first with two class data items
+	vivc := []byte{
+		0, 0, 0x0d, 0xe9, 18, 12, 'd', 's', 'l', 'f', 'o', 'r', 'u', 'm', '.', 'o', 'r', 'g', 4, 'c', 'p', 'e', '1',
+		0, 0, 0, 9, 4, 3, 'a', 't', 'a',
+	}
+
+	classes, err := ParseVendorIdentifyingClasses(vivc)
+	require.Nil(t, err)
+	require.Equal(t, map[uint32]string{3561: "dslforum.org,cpe1", 9: "ata"}, classes)
+
+	_, err = ParseVendorIdentifyingClasses(vivc[:10])
+	require.NotNil(t, err)
+
+	// Option 125 with nested sub-options
+	broadband, err := VendorIdentifyingConf{
+		Enterprise: 3561,
+		SubOptions: []OptionConf{
+			{Code: 1, Type: "string", Value: "http://acs.example.com"},
+			{Code: 2, Type: "suboptions", SubOptions: []OptionConf{
+				{Code: 1, Type: "uint16", Value: 7547},
+				{Code: 2, Type: "ip", Value: "10.0.0.7"},
+			}},
+		},
+	}.ToEnterpriseData()
+	require.Nil(t, err)
+
+	cisco, err := VendorIdentifyingConf{
+		Enterprise: 9,
+		SubOptions: []OptionConf{{Code: 5, Type: "ip", Value: "10.0.0.8"}},
+	}.ToEnterpriseData()
+	require.Nil(t, err)
+
+	other, err := VendorIdentifyingConf{
+		Enterprise: 4491,
+		SubOptions: []OptionConf{{Code: 2, Type: "ip", Value: "10.0.0.9"}},
+	}.ToEnterpriseData()
+	require.Nil(t, err)
+
+	pool := NewPool()
+	pool.Start = net.ParseIP("10.0.0.10")
+	pool.End = net.ParseIP("10.0.0.20")
+	pool.Netmask = net.ParseIP("255.255.255.0")
+	pool.VendorIdentifyingOptions = []EnterpriseData{broadband, cisco, other}
+
+	offer := func(mac MacAddress, options map[byte][]byte) []EnterpriseData {
+		message := NewDhcpMessage()
+		message.Header.Mac = mac
+		message.Options.Set(OPTION_MESSAGE_TYPE, []byte{DHCPDISCOVER})
+		for code, data := range options {
+			message.Options.Set(code, data)
+		}
+		response := NewRequestHandler(message, pool).Handle()
+		option, ok := response.Options.Get(OPTION_VIVSO)
+		if !ok {
+			return nil
+		}
+		blocks, err := ParseEnterpriseData(option.Data)
+		require.Nil(t, err)
+		return blocks
+	}
+
+	// Clients identifying with enterprises get just those
+	blocks := offer(MacAddress{0, 0, 0, 0, 0, 1}, map[byte][]byte{OPTION_VIVC: vivc})
+	require.Equal(t, []EnterpriseData{broadband, cisco}, blocks)
+
+	subOptions, err := ParseSubOptions(blocks[0].Data)
+	require.Nil(t, err)
+	require.Equal(t, []byte("http://acs.example.com"), subOptions[1])
+	nested, err := ParseSubOptions(subOptions[2])
+	require.Nil(t, err)
+	require.Equal(t, map[byte][]byte{1: {0x1d, 0x7b}, 2: {10, 0, 0, 7}}, nested)
+
+	// Clients asking for 125 without identifying get everything
+	blocks = offer(MacAddress{0, 0, 0, 0, 0, 2}, map[byte][]byte{OPTION_PARAM_REQ: {1, 3, OPTION_VIVSO}})
+	require.Equal(t, []EnterpriseData{broadband, cisco, other}, blocks)
+
+	// Everyone else gets nothing
+	blocks = offer(MacAddress{0, 0, 0, 0, 0, 3}, map[byte][]byte{OPTION_PARAM_REQ: {1, 3}})
+	require.Nil(t, blocks)
+
+	// Classification by enterprise scoped vendor class
+	message := NewDhcpMessage()
+	message.Options.Set(OPTION_VIVC, vivc)
+	fields := NewRequestFields(message)
+	for input, expected := range map[string]bool{
+		`vivc.3561 contains "dslforum.org"`: true,
+		`vivc.9 == "ata"`:                   true,
+		`vivc.4491`:                         false,
+	} {
+		expr, err := ParseClassExpr(input)
+		require.Nil(t, err)
+		require.Equal(t, expected, expr.Eval(fields), input)
+	}
+
+	_, err = ParseClassExpr(`vivc.cisco == "x"`)
+	require.NotNil(t, err)
+}
+
+func TestLongVendorIdentifyingOption(t *testing.T) {
+	// Two enterprises with full blocks need more than one option instance
+	data, err := EncodeEnterpriseData([]EnterpriseData{
+		{Enterprise: 3561, Data: make([]byte, 200)},
+		{Enterprise: 9, Data: make([]byte, 200)},
+	})
+	require.Nil(t, err)
+
+	options := NewOptions()
+	options.SetLong(OPTION_VIVSO, data)
+	buf := new(bytes.Buffer)
+	require.Nil(t, options.Encode(buf))
+
+	instances := 0
+	encoded := buf.Bytes()
+	for i := 0; i < len(encoded) && encoded[i] != OPTION_SENTINEL; i += 2 + int(encoded[i+1]) {
+		require.Equal(t, OPTION_VIVSO, encoded[i])
+		instances++
+	}
+	require.Equal(t, 2, instances)
+
+	// And joined back together when parsed
+	parsed := ParseOptions(bytes.NewReader(encoded))
+	option, ok := parsed.Get(OPTION_VIVSO)
+	require.True(t, ok)
+	require.Equal(t, data, option.Data)
+}